@@ -2,86 +2,150 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/woodsaj/go-server/cfg"
 	"github.com/woodsaj/go-server/components"
+	"github.com/woodsaj/go-server/metrics"
 	"github.com/woodsaj/go-server/registry"
 	"gopkg.in/macaron.v1"
 )
 
 func init() {
 	registry.RegisterService(&Api{}, 5)
-	cfg.SetDefault("api.listen", ":8080")
+	cfg.RegisterSection("api", &Config{})
+}
+
+// Config holds the api settings.
+type Config struct {
+	Listen string `cfg:"listen,static" default:":8080" validate:"required,regexp=:[0-9]+$"`
+}
+
+func (c *Config) Validate() error {
+	host := strings.Split(c.Listen, ":")
+	port, err := strconv.ParseInt(host[len(host)-1], 10, 64)
+	if err != nil {
+		return &cfg.FieldError{Key: "listen", Message: fmt.Sprintf("Could not parse address. %s", err)}
+	}
+	if port < 0 || port > 65535 {
+		return &cfg.FieldError{Key: "listen", Message: "Invalid TCP port for listen address."}
+	}
+	return nil
 }
 
 type Api struct {
 	Cfg         *cfg.Cfg                        `inject:""`
 	WorkerPool  *components.WorkerPool          `inject:""`
+	Scheduler   *components.Scheduler           `inject:""`
 	PController *components.ProcessorController `inject:""`
+	Health      *components.Health              `inject:""`
+	Router      *components.Router              `inject:""`
+	Lifecycle   registry.Lifecycle              `inject:""`
+	Metrics     *metrics.Registry               `inject:""`
+	Log         *log.Entry                      `inject:""`
+
+	ctx context.Context
+	srv *http.Server
+	sync.Mutex
 
-	processor components.Processor
-	ctx       context.Context
+	// reverts are the log levels set through /debug/loglevel that are
+	// waiting for their TTL to expire, by config key.
+	reverts   map[string]*LogLevelRevert
+	revertsMu sync.Mutex
 }
 
 func (a *Api) Init() error {
-	log.Debug("Initializing Api service")
-
-	// validate config
-	listen := a.Cfg.GetString("api.listen")
-	if listen == "" {
-		return fmt.Errorf("api.listen is not set")
-	}
-	host := strings.Split(listen, ":")
-	port, err := strconv.ParseInt(host[len(host)-1], 10, 64)
-	if err != nil {
-		return fmt.Errorf("Could not parse api.listen address. %s", err)
-	}
-	if port < 0 || port > 65535 {
-		return fmt.Errorf("Invalid TCP port for listen address.")
-	}
+	a.Log.Debug("Initializing Api service")
 
-	a.processor = a.PController.Get()
+	a.PController.OnSwitch(func(e components.SwitchEvent) {
+		a.Log.Infof("Api now serving /processor from %s", e.New)
+	})
 	return nil
 }
 
 func (a *Api) Run(ctx context.Context) error {
 	a.ctx = ctx
-	addr := a.Cfg.GetString("api.listen")
+	addr := a.Cfg.Section("api").(*Config).Listen
 	m := macaron.New()
 	m.Use(macaron.Logger())
 	m.Use(macaron.Recovery())
 	m.Use(macaron.Renderer())
-	m.Get("/", a.Hello)
-	m.Get("/processor", a.Processor)
-	m.Get("/workers", a.Workers)
-	m.Get("/config", a.Config)
+
+	// the routes of every service, including our own, have already been
+	// collected and checked by the Router.
+	a.Router.Mount(m)
 
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 	go a.handleShutdown(l)
-	srv := http.Server{
+	srv := &http.Server{
 		Addr:    addr,
 		Handler: m,
 	}
-	log.Infof("Api server listening on %s", l.Addr().String())
+	a.Lock()
+	a.srv = srv
+	a.Unlock()
+	a.Log.Infof("Api server listening on %s", l.Addr().String())
 	err = srv.Serve(l)
-	if ctx.Err() != nil {
+	if ctx.Err() != nil || err == http.ErrServerClosed {
 		return nil
 	}
 	return err
 }
 
+// Stop stops accepting new connections and waits for active requests
+// to complete.
+func (a *Api) Stop(ctx context.Context) error {
+	a.Lock()
+	srv := a.srv
+	a.Unlock()
+	if srv == nil {
+		return nil
+	}
+	a.Log.Info("API shutdown started. Draining active connections.")
+	return srv.Shutdown(ctx)
+}
+
+func (a *Api) RegisterRoutes(r *components.RouteGroup) {
+	r.Get("/", a.Hello).Name("hello")
+	r.Get("/processor", a.Processor).Name("processor")
+	r.Get("/processor/:name", a.ProcessorByName).Name("processor-by-name")
+	r.Get("/processors", a.Processors).Name("processors")
+	r.Get("/workers", a.Workers).Name("workers")
+	r.Get("/config", a.Config).Name("config")
+	r.Get("/config/status", a.ConfigStatus).Name("config-status")
+	r.Get("/config/sources", a.ConfigSources).Name("config-sources")
+	r.Get("/config/history", a.ConfigHistory).Name("config-history")
+	r.Get("/config/history/:rev", a.ConfigAtRevision).Name("config-at-revision")
+	r.Get("/config/diff", a.ConfigDiff).Name("config-diff")
+	admin := r.Admin()
+	admin.Post("/services/:name/:action", a.ServiceAction).Name("service-action")
+	admin.Post("/config/rollback/:rev", a.ConfigRollback).Name("config-rollback")
+	admin.Put("/config/:key", a.SetConfig).Name("config-set")
+	admin.Patch("/config/:key", a.PatchConfig).Name("config-patch")
+	admin.Delete("/config/:key", a.UnsetConfig).Name("config-unset")
+	r.Get("/services", a.Services).Name("services")
+	r.Get("/services/graph", a.ServiceGraph).Name("services-graph")
+	r.Get("/debug/loglevel", a.LogLevels).Name("loglevel")
+	admin.Put("/debug/loglevel", a.SetLogLevel).Name("loglevel-set")
+	r.Get("/metrics", a.MetricsText).Name("metrics")
+	r.Get("/healthz", a.Healthz).Name("healthz")
+	r.Get("/readyz", a.Readyz).Name("readyz")
+}
+
 func (a *Api) handleShutdown(l net.Listener) {
 	<-a.ctx.Done()
-	log.Info("API shutdown started.")
+	a.Log.Info("API shutdown started.")
 	l.Close()
 }
 
@@ -91,16 +155,304 @@ func (a *Api) Hello(ctx *macaron.Context) {
 }
 
 func (a *Api) Processor(ctx *macaron.Context) {
-	ctx.PlainText(200, []byte(a.processor.Data()))
+	p, release, err := a.PController.Acquire("")
+	if err != nil {
+		ctx.PlainText(503, []byte(err.Error()))
+		return
+	}
+	defer release()
+	ctx.PlainText(200, []byte(p.Data(ctx.Req.Context())))
+	return
+}
+
+func (a *Api) ProcessorByName(ctx *macaron.Context) {
+	p, release, err := a.PController.AcquireByName(ctx.Params(":name"))
+	if err != nil {
+		ctx.PlainText(404, []byte(err.Error()))
+		return
+	}
+	defer release()
+	ctx.PlainText(200, []byte(p.Data(ctx.Req.Context())))
+	return
+}
+
+func (a *Api) Processors(ctx *macaron.Context) {
+	ctx.JSON(200, a.PController.List())
 	return
 }
 
 func (a *Api) Workers(ctx *macaron.Context) {
-	ctx.PlainText(200, []byte(strings.Join(a.WorkerPool.Status(), "\n")))
+	lines := a.WorkerPool.Status()
+	for _, t := range a.Scheduler.Status() {
+		lines = append(lines, fmt.Sprintf("%s schedule=%q timezone=%s overlap=%s jitter=%s next-run=%s last-run=%s running=%t runs=%d skipped=%d queued=%d",
+			t.Name, t.Schedule, t.Timezone, t.Overlap, t.Jitter, formatTime(t.NextRun), formatTime(t.LastRun), t.Running, t.Runs, t.Skipped, t.Queued))
+	}
+	ctx.PlainText(200, []byte(strings.Join(lines, "\n")))
 	return
 }
 
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// ConfigReport is the response of the /config endpoint.
+type ConfigReport struct {
+	Revision int `json:"revision"`
+	// RestartRequired is true if there are changes to static settings that
+	// will only take effect after a restart.
+	RestartRequired bool         `json:"restartRequired"`
+	PendingRestart  []cfg.Change `json:"pendingRestart"`
+	StaticKeys      []string     `json:"staticKeys"`
+	// Runtime are the settings changed through the API, which override
+	// all other sources.
+	Runtime  map[string]interface{} `json:"runtime"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
 func (a *Api) Config(ctx *macaron.Context) {
-	ctx.JSON(200, a.Cfg.AllSettings())
+	pending := a.Cfg.PendingRestart()
+	ctx.JSON(200, ConfigReport{
+		Revision:        a.Cfg.Revision(),
+		RestartRequired: len(pending) > 0,
+		PendingRestart:  pending,
+		StaticKeys:      cfg.StaticKeys(),
+		Runtime:         a.Cfg.RuntimeSettings(),
+		Settings:        a.Cfg.AllSettings(),
+	})
+	return
+}
+
+// ConfigStatus reports the current config revision and the outcome of the
+// last reload.
+func (a *Api) ConfigStatus(ctx *macaron.Context) {
+	ctx.JSON(200, a.Cfg.ReloadStatus())
+	return
+}
+
+// ConfigSources reports which layer each setting came from and the values
+// it overrides. The "key" query param limits the report to a key prefix.
+func (a *Api) ConfigSources(ctx *macaron.Context) {
+	ctx.JSON(200, a.Cfg.Provenance(ctx.Query("key")))
+	return
+}
+
+// ConfigHistory lists the recently published config revisions, along with
+// what changed in each of them.
+func (a *Api) ConfigHistory(ctx *macaron.Context) {
+	ctx.JSON(200, a.Cfg.History())
+	return
+}
+
+// ConfigAtRevision returns the settings that were live at a revision.
+func (a *Api) ConfigAtRevision(ctx *macaron.Context) {
+	snapshot, err := a.Cfg.SnapshotAt(ctx.ParamsInt(":rev"))
+	if err != nil {
+		ctx.PlainText(404, []byte(err.Error()))
+		return
+	}
+	ctx.JSON(200, map[string]interface{}{
+		"revision": snapshot.Revision,
+		"time":     snapshot.Time,
+		"settings": snapshot.AllSettings(),
+	})
+	return
+}
+
+// ConfigDiff returns the settings that differ between the "from" and "to"
+// revisions. "to" defaults to the current revision.
+func (a *Api) ConfigDiff(ctx *macaron.Context) {
+	from, err := strconv.Atoi(ctx.Query("from"))
+	if err != nil {
+		ctx.PlainText(400, []byte("from must be a revision number"))
+		return
+	}
+	to := a.Cfg.Revision()
+	if ctx.Query("to") != "" {
+		if to, err = strconv.Atoi(ctx.Query("to")); err != nil {
+			ctx.PlainText(400, []byte("to must be a revision number"))
+			return
+		}
+	}
+	changes, err := a.Cfg.Diff(from, to)
+	if err != nil {
+		ctx.PlainText(404, []byte(err.Error()))
+		return
+	}
+	ctx.JSON(200, changes)
+	return
+}
+
+// ConfigRollback re-applies the settings of an earlier revision.
+func (a *Api) ConfigRollback(ctx *macaron.Context) {
+	rev := ctx.ParamsInt(":rev")
+	err := a.Cfg.Rollback(rev)
+	if err == cfg.ErrRevisionNotFound {
+		ctx.PlainText(404, []byte(err.Error()))
+		return
+	}
+	if err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("rollback to revision %d rejected. %s", rev, err)))
+		return
+	}
+	a.Log.Infof("config rolled back to revision %d", rev)
+	ctx.JSON(200, a.Cfg.ReloadStatus())
+	return
+}
+
+// SetConfig sets the value of a key at runtime. The body is the JSON
+// encoded value, eg. "foo" or 10. With ?persist=true the value is also
+// written to the config file.
+func (a *Api) SetConfig(ctx *macaron.Context) {
+	var value interface{}
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&value); err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("invalid JSON value. %s", err)))
+		return
+	}
+	a.applyConfig(ctx, map[string]interface{}{ctx.Params(":key"): value})
+	return
+}
+
+// PatchConfig sets several settings below a key at runtime. The body is a
+// JSON object of the settings, eg. {"data": "foo", "schedule": "10s"} for
+// /config/worker-a. The settings are applied together, or not at all.
+func (a *Api) PatchConfig(ctx *macaron.Context) {
+	var settings map[string]interface{}
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&settings); err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("invalid JSON object. %s", err)))
+		return
+	}
+	a.applyConfig(ctx, map[string]interface{}{ctx.Params(":key"): settings})
+	return
+}
+
+func (a *Api) applyConfig(ctx *macaron.Context, settings map[string]interface{}) {
+	if err := a.Cfg.Set(settings); err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("config change rejected. %s", err)))
+		return
+	}
+	a.Log.Infof("config %s changed through the api", ctx.Params(":key"))
+	if ctx.QueryBool("persist") {
+		if err := a.Cfg.Persist(settings); err != nil {
+			ctx.PlainText(500, []byte(fmt.Sprintf("config change applied but not persisted. %s", err)))
+			return
+		}
+	}
+	ctx.JSON(200, a.Cfg.Provenance(ctx.Params(":key")))
+}
+
+// UnsetConfig removes the runtime settings for a key, so the value from
+// the config file, environment or flags applies again.
+func (a *Api) UnsetConfig(ctx *macaron.Context) {
+	if err := a.Cfg.Unset(ctx.Params(":key")); err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("config change rejected. %s", err)))
+		return
+	}
+	ctx.JSON(200, a.Cfg.Provenance(ctx.Params(":key")))
+	return
+}
+
+// Services reports the status of every registered service, in the order
+// they are initialized in.
+func (a *Api) Services(ctx *macaron.Context) {
+	services := registry.GetServices()
+	result := make([]registry.ServiceStatus, 0, len(services))
+	for _, s := range services {
+		result = append(result, s.Status())
+	}
+	ctx.JSON(200, result)
+	return
+}
+
+// ServiceGraph reports the dependency graph of the services as JSON, or in
+// the Graphviz DOT language with ?format=dot.
+func (a *Api) ServiceGraph(ctx *macaron.Context) {
+	graph := registry.GetGraph()
+	switch ctx.Query("format") {
+	case "", "json":
+		ctx.JSON(200, graph)
+	case "dot":
+		ctx.Resp.Header().Set("Content-Type", "text/vnd.graphviz; charset=UTF-8")
+		ctx.Resp.WriteHeader(200)
+		ctx.Resp.Write([]byte(graph.DOT()))
+	default:
+		ctx.PlainText(400, []byte(fmt.Sprintf("invalid format %q. must be json or dot", ctx.Query("format"))))
+	}
+	return
+}
+
+// ServiceAction starts, stops or restarts a service, along with the services
+// that depend on it.
+func (a *Api) ServiceAction(ctx *macaron.Context) {
+	name := ctx.Params(":name")
+	d := registry.GetService(name)
+	if d == nil {
+		ctx.PlainText(404, []byte(fmt.Sprintf("unknown service %s", name)))
+		return
+	}
+	var action func(context.Context, string) error
+	switch ctx.Params(":action") {
+	case "start":
+		action = a.Lifecycle.StartService
+	case "stop":
+		action = a.Lifecycle.StopService
+	case "restart":
+		action = a.Lifecycle.RestartService
+	default:
+		ctx.PlainText(404, []byte(fmt.Sprintf("unknown action %s. must be one of start, stop or restart", ctx.Params(":action"))))
+		return
+	}
+	if ctx.Params(":action") != "start" {
+		// the Api would wait for this request to complete before stopping.
+		for _, s := range append([]*registry.Descriptor{d}, registry.Dependents(d)...) {
+			if s.Instance == registry.Service(a) {
+				ctx.PlainText(409, []byte(fmt.Sprintf("%s can not be stopped through the api as it would stop the Api", d.Name)))
+				return
+			}
+		}
+	}
+	if err := action(ctx.Req.Context(), d.Name); err != nil {
+		ctx.PlainText(409, []byte(err.Error()))
+		return
+	}
+	a.Log.Infof("%s of %s requested through the api", ctx.Params(":action"), d.Name)
+	ctx.JSON(200, d.Status())
+	return
+}
+
+// MetricsText serves all metrics in the Prometheus text exposition format.
+func (a *Api) MetricsText(ctx *macaron.Context) {
+	ctx.Resp.Header().Set("Content-Type", metrics.ContentType)
+	ctx.Resp.WriteHeader(200)
+	if err := a.Metrics.WriteText(ctx.Resp); err != nil {
+		a.Log.Errorf("failed to write metrics. %s", err)
+	}
+	return
+}
+
+// Healthz reports whether the process is alive. It only fails if a service
+// has failed. The health checks of the services are only run by Readyz.
+func (a *Api) Healthz(ctx *macaron.Context) {
+	report := a.Health.Liveness()
+	code := 200
+	if !report.Live() {
+		code = 503
+	}
+	ctx.JSON(code, report)
+	return
+}
+
+// Readyz reports whether the process is ready to receive traffic. It runs
+// the health checks of the services, and fails until all services have
+// finished starting up or while a service is down.
+func (a *Api) Readyz(ctx *macaron.Context) {
+	report := a.Health.Check(ctx.Req.Context())
+	code := 200
+	if !report.Ready() {
+		code = 503
+	}
+	ctx.JSON(code, report)
 	return
 }
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/registry"
+	"gopkg.in/macaron.v1"
+)
+
+// fakeLifecycle records the services it is asked to start, stop or restart.
+type fakeLifecycle struct {
+	calls []string
+}
+
+func (f *fakeLifecycle) StartService(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "start "+name)
+	return nil
+}
+
+func (f *fakeLifecycle) StopService(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "stop "+name)
+	return nil
+}
+
+func (f *fakeLifecycle) RestartService(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "restart "+name)
+	return nil
+}
+
+type fakeService struct{}
+
+func (f *fakeService) Init() error { return nil }
+
+func TestServiceAction(t *testing.T) {
+	logger := log.New()
+	logger.Out = io.Discard
+	lifecycle := &fakeLifecycle{}
+	a := &Api{Lifecycle: lifecycle, Log: log.NewEntry(logger)}
+
+	// the Api depends on Store, and Worker depends on nothing.
+	store := &registry.Descriptor{Name: "Store", Instance: &fakeService{}}
+	worker := &registry.Descriptor{Name: "Worker", Instance: &fakeService{}}
+	api := &registry.Descriptor{Name: "Api", Instance: a, Dependencies: []*registry.Descriptor{store}}
+	saved := registry.SetServices([]*registry.Descriptor{store, worker, api})
+	defer registry.SetServices(saved)
+
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	m.Post("/services/:name/:action", a.ServiceAction)
+
+	tests := []struct {
+		path string
+		code int
+		call string
+	}{
+		{"/services/Worker/stop", 200, "stop Worker"},
+		{"/services/Worker/restart", 200, "restart Worker"},
+		{"/services/Store/start", 200, "start Store"},
+		{"/services/Api/stop", 409, ""},
+		{"/services/Api/restart", 409, ""},
+		{"/services/Store/stop", 409, ""},
+		{"/services/Worker/pause", 404, ""},
+		{"/services/Nope/stop", 404, ""},
+	}
+	for _, tt := range tests {
+		lifecycle.calls = nil
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d. %s", tt.path, w.Code, tt.code, w.Body.String())
+		}
+		var call string
+		if len(lifecycle.calls) > 0 {
+			call = lifecycle.calls[0]
+		}
+		if len(lifecycle.calls) > 1 || call != tt.call {
+			t.Errorf("%s: got calls %q, want %q", tt.path, lifecycle.calls, tt.call)
+		}
+	}
+}
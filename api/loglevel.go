@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/macaron.v1"
+)
+
+// LogLevels is the response of the /debug/loglevel endpoint.
+type LogLevels struct {
+	// Level is the level of the services without a level of their own.
+	Level string `json:"level"`
+	// Services are the levels of individual services, by config key.
+	Services map[string]string `json:"services"`
+	// Reverts are the levels that will be reverted once their TTL expires.
+	Reverts []LogLevelRevert `json:"reverts"`
+}
+
+// LogLevelRequest is the body of PUT /debug/loglevel, eg.
+// {"level": "debug", "service": "worker-a", "ttl": "10m"}.
+type LogLevelRequest struct {
+	Level string `json:"level"`
+	// Service sets the level of a single service instead of the default
+	// level.
+	Service string `json:"service"`
+	// TTL, if set, reverts the level to what it was before once it has
+	// passed.
+	TTL string `json:"ttl"`
+}
+
+// LogLevelRevert is a log level that is reverted once its TTL expires.
+type LogLevelRevert struct {
+	Key     string    `json:"key"`
+	Level   string    `json:"level"`
+	Expires time.Time `json:"expires"`
+
+	// previous is the runtime value of the key before the level was set,
+	// or nil if it had none.
+	previous interface{}
+	timer    *time.Timer
+}
+
+// LogLevels reports the current log levels, and when temporary levels will
+// be reverted.
+func (a *Api) LogLevels(ctx *macaron.Context) {
+	ctx.JSON(200, a.logLevels())
+	return
+}
+
+func (a *Api) logLevels() LogLevels {
+	levels := LogLevels{
+		Level:    a.Cfg.GetString("log.level"),
+		Services: make(map[string]string),
+		Reverts:  make([]LogLevelRevert, 0),
+	}
+	for _, key := range a.Cfg.AllKeys() {
+		if strings.HasPrefix(key, "log.levels.") {
+			levels.Services[strings.TrimPrefix(key, "log.levels.")] = a.Cfg.GetString(key)
+		}
+	}
+	a.revertsMu.Lock()
+	for _, r := range a.reverts {
+		levels.Reverts = append(levels.Reverts, *r)
+	}
+	a.revertsMu.Unlock()
+	sort.Slice(levels.Reverts, func(i, j int) bool {
+		return levels.Reverts[i].Key < levels.Reverts[j].Key
+	})
+	return levels
+}
+
+// SetLogLevel changes the default log level, or the level of a single
+// service, at runtime. The level is set like any other runtime setting, so
+// it overrides the config file until it is reverted. A level set without a
+// TTL cancels any pending revert of the same level.
+func (a *Api) SetLogLevel(ctx *macaron.Context) {
+	var req LogLevelRequest
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&req); err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("invalid JSON object. %s", err)))
+		return
+	}
+	if _, err := log.ParseLevel(req.Level); err != nil {
+		ctx.PlainText(400, []byte(fmt.Sprintf("invalid level %q", req.Level)))
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			ctx.PlainText(400, []byte(fmt.Sprintf("invalid ttl %q. must be a positive duration", req.TTL)))
+			return
+		}
+	}
+	key := "log.level"
+	if req.Service != "" {
+		key = "log.levels." + strings.ToLower(req.Service)
+	}
+
+	a.revertsMu.Lock()
+	previous := a.Cfg.RuntimeSettings()[key]
+	if err := a.Cfg.Set(map[string]interface{}{key: req.Level}); err != nil {
+		a.revertsMu.Unlock()
+		ctx.PlainText(400, []byte(fmt.Sprintf("log level change rejected. %s", err)))
+		return
+	}
+	if pending, ok := a.reverts[key]; ok {
+		pending.timer.Stop()
+		delete(a.reverts, key)
+		// revert to the level from before the first temporary change.
+		previous = pending.previous
+	}
+	if ttl > 0 {
+		r := &LogLevelRevert{
+			Key:      key,
+			Level:    req.Level,
+			Expires:  time.Now().Add(ttl),
+			previous: previous,
+		}
+		r.timer = time.AfterFunc(ttl, func() {
+			a.revertLogLevel(r)
+		})
+		if a.reverts == nil {
+			a.reverts = make(map[string]*LogLevelRevert)
+		}
+		a.reverts[key] = r
+		a.Log.Infof("%s set to %s through the api for %s", key, req.Level, ttl)
+	} else {
+		a.Log.Infof("%s set to %s through the api", key, req.Level)
+	}
+	a.revertsMu.Unlock()
+
+	ctx.JSON(200, a.logLevels())
+	return
+}
+
+// revertLogLevel restores the runtime value the key had before r was set.
+// If the level has been changed since, eg. through /config, it is kept.
+func (a *Api) revertLogLevel(r *LogLevelRevert) {
+	a.revertsMu.Lock()
+	defer a.revertsMu.Unlock()
+	if a.reverts[r.Key] != r {
+		// replaced by a later change.
+		return
+	}
+	delete(a.reverts, r.Key)
+	if current := a.Cfg.RuntimeSettings()[r.Key]; current != r.Level {
+		a.Log.Infof("not reverting %s as it was changed to %v since", r.Key, current)
+		return
+	}
+	var err error
+	if r.previous == nil {
+		err = a.Cfg.Unset(r.Key)
+	} else {
+		err = a.Cfg.Set(map[string]interface{}{r.Key: r.previous})
+	}
+	if err != nil {
+		a.Log.Errorf("failed to revert %s. %s", r.Key, err)
+		return
+	}
+	a.Log.Infof("%s reverted as its ttl expired", r.Key)
+}
@@ -1,52 +1,332 @@
 package cfg
 
 import (
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"github.com/spf13/cast"
 )
 
+func init() {
+	RegisterSection("config", &reloadSettings{})
+}
+
+// reloadSettings control how config reloads are applied.
+type reloadSettings struct {
+	// what happens when a reload changes a static setting. "warn" keeps
+	// the current value until restart, "reject" rejects the whole reload.
+	StaticChanges string `cfg:"static-changes" default:"warn" validate:"oneof=warn reject"`
+	// number of published revisions kept for /config/history and rollbacks.
+	HistorySize int `cfg:"history-size" default:"20" validate:"min=1"`
+}
+
 // wrapper for setting default values.
+// Only keys that have a default are allowed in the config.
 func SetDefault(key string, value interface{}) {
-	viper.SetDefault(key, value)
+	addKnownKey(key, false)
+	setDefault(key, value)
+}
+
+// SetStaticDefault sets the default value of a key that is only read at
+// startup. Changes to the key are not applied until the next restart.
+func SetStaticDefault(key string, value interface{}) {
+	addKnownKey(key, true)
+	setDefault(key, value)
 }
 
+// Cfg provides the settings of the current config snapshot. Settings are
+// read from the layered Sources, but only published once they have been
+// validated, so a bad config change never becomes visible to services.
 type Cfg struct {
-	*viper.Viper
+	sources Sources
 	sync.Mutex
 
-	listeners []listener
+	subscriptions []*Subscription
+	snapshot      *Snapshot
+	reload        ReloadStatus
+	// pending are the changes to static settings waiting for a restart.
+	pending []Change
+	// reloadMu ensures reloads are published, and their changes delivered,
+	// in order.
+	reloadMu sync.Mutex
+	// history holds the most recently published snapshots, oldest first.
+	history []*Snapshot
+	// runtime holds the settings changed with Set(), which override all
+	// other sources.
+	runtime map[string]interface{}
 }
 
-type listener func()
+// Snapshot is an immutable view of all settings at a config revision.
+type Snapshot struct {
+	Revision int
+	Time     time.Time
+	// settings maps every key to its value.
+	settings map[string]interface{}
+	// sections holds the typed sections registered with RegisterSection.
+	sections map[string]interface{}
+	// provenance records where each setting came from.
+	provenance map[string]Provenance
+	// cause is what published the snapshot and changes are the settings
+	// that changed from the previous revision.
+	cause   string
+	changes []Change
+}
 
-func New(v *viper.Viper) *Cfg {
-	return &Cfg{
-		listeners: make([]listener, 0),
-		Viper:     v,
+// ReloadStatus describes the outcome of the most recent config reloads.
+type ReloadStatus struct {
+	Revision int `json:"revision"`
+	// Reloads and Failures count the reloads that were applied and
+	// rejected, including rollbacks and changes made with Set().
+	Reloads    int        `json:"reloads"`
+	Failures   int        `json:"failures"`
+	LastReload *time.Time `json:"lastReload,omitempty"`
+	// LastError, LastErrorTime and Rejected describe the last reload if it
+	// failed. They are cleared by the next reload that succeeds, even if it
+	// has no changes.
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	// Rejected are the changes that were discarded by the failed reload.
+	Rejected []Change `json:"rejected,omitempty"`
+}
+
+func New(sources Sources) *Cfg {
+	c := &Cfg{
+		subscriptions: make([]*Subscription, 0),
+		sources:       sources,
 	}
+	// until Load() is called the settings and sections are available
+	// unvalidated.
+	settings, provenance, _ := c.read()
+	c.snapshot, _ = c.stage(settings, provenance)
+	return c
 }
 
-func (c *Cfg) OnChange(l listener) {
+// Watch reloads the config whenever a config file changes.
+func (c *Cfg) Watch() {
+	err := c.sources.watch(func(name string) {
+		log.Infof("Config file changed: %s", name)
+		c.Reload()
+	})
+	if err != nil {
+		log.Errorf("unable to watch config files. %s", err)
+	}
+}
+
+// Reload re-reads all config sources and publishes the new settings if
+// they are all valid. Otherwise the current settings are kept, the
+// rejected changes are logged and the error is recorded in the
+// ReloadStatus.
+func (c *Cfg) Reload() error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	return c.reapply("reload")
+}
+
+// reapply reads all settings and applies them. c.reloadMu must be held.
+func (c *Cfg) reapply(cause string) error {
+	settings, provenance, err := c.read()
+	if err != nil {
+		c.rejected(err, nil)
+		return err
+	}
+	if errs := resolveSecrets(settings); len(errs) > 0 {
+		sort.Sort(errs)
+		c.rejected(errs, diff(c.current().settings, settings))
+		return errs
+	}
+	return c.apply(settings, provenance, cause)
+}
+
+// apply validates the settings and publishes them as a new revision if
+// they changed. c.reloadMu must be held.
+func (c *Cfg) apply(settings map[string]interface{}, provenance map[string]Provenance, cause string) error {
+	current := c.current()
+
+	// static settings keep their current value until restart.
+	pending := staticChanges(current.settings, settings)
+	if len(pending) > 0 && current.sections["config"].(*reloadSettings).StaticChanges == "reject" {
+		var errs ValidationErrors
+		for _, change := range pending {
+			errs = append(errs, &FieldError{Key: change.Key, Message: "requires a restart to change"})
+		}
+		c.rejected(errs, diff(current.settings, settings))
+		return errs
+	}
+	for _, change := range pending {
+		if old, ok := current.settings[change.Key]; ok {
+			settings[change.Key] = old
+			provenance[change.Key] = current.provenance[change.Key]
+		} else {
+			delete(settings, change.Key)
+			delete(provenance, change.Key)
+		}
+	}
+
+	snapshot, err := c.stage(settings, provenance)
+	changes := diff(current.settings, snapshot.settings)
+	if err != nil {
+		c.rejected(err, append(changes, pending...))
+		return err
+	}
+	c.setPending(pending)
 	c.Lock()
-	c.listeners = append(c.listeners, l)
+	c.reload.Reloads++
+	c.reload.LastError = ""
+	c.reload.LastErrorTime = nil
+	c.reload.Rejected = nil
 	c.Unlock()
+	if len(changes) == 0 {
+		log.Debug("config reloaded with no changes")
+		return nil
+	}
+	snapshot.cause = cause
+	snapshot.changes = changes
+	c.publish(snapshot)
+	log.Infof("config revision %d published with %d changes. cause: %s", snapshot.Revision, len(changes), cause)
+	c.notify(ChangeEvent{Revision: snapshot.Revision, Changes: changes})
+	return nil
 }
 
-func (c *Cfg) notify() {
+// rejected records a failed reload. The changes that were rejected are
+// logged along with the error for the key, if there is one.
+func (c *Cfg) rejected(err error, changes []Change) {
+	fieldErrs := make(map[string]string)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			fieldErrs[e.Key] = e.Message
+		}
+	}
+	for i := range changes {
+		changes[i].Error = fieldErrs[changes[i].Key]
+	}
+
 	c.Lock()
-	for _, l := range c.listeners {
-		go l()
+	now := time.Now()
+	c.reload.Failures++
+	c.reload.LastError = err.Error()
+	c.reload.LastErrorTime = &now
+	c.reload.Rejected = changes
+	revision := c.snapshot.Revision
+	c.Unlock()
+
+	log.Errorf("config reload rejected, keeping revision %d. %s", revision, err)
+	for _, change := range changes {
+		log.WithFields(log.Fields{
+			"key":   change.Key,
+			"old":   change.Old,
+			"new":   change.New,
+			"error": change.Error,
+		}).Warn("rejected config change")
 	}
+}
+
+func (c *Cfg) setPending(pending []Change) {
+	c.Lock()
+	c.pending = pending
 	c.Unlock()
+	for _, change := range pending {
+		log.WithFields(log.Fields{
+			"key":     change.Key,
+			"current": change.Old,
+			"pending": change.New,
+		}).Warn("config change requires a restart to take effect")
+	}
 }
 
-func (c *Cfg) Watch() {
-	c.Viper.WatchConfig()
-	c.Viper.OnConfigChange(func(e fsnotify.Event) {
-		log.Infof("Config file changed: %s", e.Name)
-		c.notify()
-	})
+// PendingRestart returns the changes to static settings that will only
+// take effect after a restart. Old is the current value and New is the
+// value in the config.
+func (c *Cfg) PendingRestart() []Change {
+	c.Lock()
+	defer c.Unlock()
+	pending := make([]Change, len(c.pending))
+	copy(pending, c.pending)
+	return pending
+}
+
+// staticChanges returns the changes to static settings.
+func staticChanges(old, new map[string]interface{}) []Change {
+	var result []Change
+	for _, change := range diff(old, new) {
+		if IsStatic(change.Key) {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+// ReloadStatus returns the outcome of the most recent reloads.
+func (c *Cfg) ReloadStatus() ReloadStatus {
+	c.Lock()
+	defer c.Unlock()
+	status := c.reload
+	status.Revision = c.snapshot.Revision
+	return status
+}
+
+func (c *Cfg) publish(s *Snapshot) {
+	c.Lock()
+	s.Revision = c.snapshot.Revision + 1
+	c.snapshot = s
+	now := s.Time
+	c.reload.LastReload = &now
+	c.record(s)
+	c.Unlock()
+}
+
+func (c *Cfg) current() *Snapshot {
+	c.Lock()
+	defer c.Unlock()
+	return c.snapshot
+}
+
+// Revision returns the revision of the current snapshot.
+func (c *Cfg) Revision() int {
+	return c.current().Revision
+}
+
+func (c *Cfg) Get(key string) interface{} {
+	return c.current().Get(key)
+}
+
+func (c *Cfg) GetString(key string) string {
+	return cast.ToString(c.Get(key))
+}
+
+func (c *Cfg) GetBool(key string) bool {
+	return cast.ToBool(c.Get(key))
+}
+
+func (c *Cfg) GetInt(key string) int {
+	return cast.ToInt(c.Get(key))
+}
+
+func (c *Cfg) GetFloat64(key string) float64 {
+	return cast.ToFloat64(c.Get(key))
+}
+
+func (c *Cfg) GetDuration(key string) time.Duration {
+	return cast.ToDuration(c.Get(key))
+}
+
+func (c *Cfg) GetStringSlice(key string) []string {
+	return cast.ToStringSlice(c.Get(key))
+}
+
+// AllKeys returns all keys of the current snapshot.
+func (c *Cfg) AllKeys() []string {
+	return c.current().AllKeys()
+}
+
+// AllSettings returns the current settings as a nested map.
+func (c *Cfg) AllSettings() map[string]interface{} {
+	return c.current().AllSettings()
+}
+
+// Provenance returns where the current settings with the given key prefix
+// came from, sorted by key. An empty prefix returns all settings.
+func (c *Cfg) Provenance(prefix string) []Provenance {
+	return c.current().Provenance(prefix)
 }
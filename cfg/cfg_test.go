@@ -0,0 +1,76 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadStatusClearsError(t *testing.T) {
+	c, err := load(map[string]string{"cfgtest.name": "demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(map[string]interface{}{"cfgtest.mode": "medium"}); err == nil {
+		t.Fatal("expected an invalid mode to be rejected")
+	}
+	status := c.ReloadStatus()
+	if status.Failures != 1 || status.LastError == "" || status.LastErrorTime == nil || len(status.Rejected) != 1 {
+		t.Fatalf("rejected change not recorded: %+v", status)
+	}
+
+	// a reload without changes still succeeds.
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	status = c.ReloadStatus()
+	if status.LastError != "" || status.LastErrorTime != nil || status.Rejected != nil {
+		t.Errorf("error of an earlier reload still reported: %+v", status)
+	}
+	if status.Failures != 1 {
+		t.Errorf("Failures = %d, want 1", status.Failures)
+	}
+
+	if err := c.Set(map[string]interface{}{"cfgtest.mode": "medium"}); err == nil {
+		t.Fatal("expected an invalid mode to be rejected")
+	}
+	if err := c.Set(map[string]interface{}{"cfgtest.mode": "slow"}); err != nil {
+		t.Fatal(err)
+	}
+	status = c.ReloadStatus()
+	if status.LastError != "" || status.LastErrorTime != nil || status.Rejected != nil {
+		t.Errorf("error of an earlier reload still reported: %+v", status)
+	}
+	if status.Failures != 2 || status.LastReload == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestBeforeLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(config string) {
+		if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("cfgtest:\n  name: demo\n  count: 2\n  timeout: soon\n")
+	c := New(Sources{Files: []string{file}})
+
+	// the sections hold the unvalidated settings.
+	got, ok := c.Section("cfgtest").(*testConfig)
+	if !ok {
+		t.Fatalf("got section %T before Load", c.Section("cfgtest"))
+	}
+	if got.Name != "demo" || got.Count != 2 || got.Mode != "fast" || got.Timeout != 0 {
+		t.Errorf("unexpected section %+v", got)
+	}
+
+	// a reload that changes a static setting needs the config section.
+	write("cfgtest:\n  name: demo\n  count: 3\n")
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if pending := c.PendingRestart(); len(pending) != 1 || pending[0].Key != "cfgtest.count" {
+		t.Errorf("got pending changes %+v", pending)
+	}
+}
@@ -0,0 +1,110 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrRevisionNotFound = errors.New("config revision not found in history")
+
+// HistoryEntry describes a published config revision.
+type HistoryEntry struct {
+	Revision int       `json:"revision"`
+	Time     time.Time `json:"time"`
+	// Cause is what published the revision, eg. "load", "reload" or
+	// "rollback to 3".
+	Cause string `json:"cause"`
+	// Changes are the settings that changed from the previous revision.
+	Changes []Change `json:"changes"`
+}
+
+// History returns the most recently published revisions, oldest first.
+// The number of revisions kept is set by config.history-size.
+func (c *Cfg) History() []HistoryEntry {
+	c.Lock()
+	defer c.Unlock()
+	entries := make([]HistoryEntry, 0, len(c.history))
+	for _, s := range c.history {
+		changes := s.changes
+		if changes == nil {
+			changes = make([]Change, 0)
+		}
+		entries = append(entries, HistoryEntry{
+			Revision: s.Revision,
+			Time:     s.Time,
+			Cause:    s.cause,
+			Changes:  changes,
+		})
+	}
+	return entries
+}
+
+// SnapshotAt returns the snapshot of a revision that is still in the
+// history.
+func (c *Cfg) SnapshotAt(revision int) (*Snapshot, error) {
+	c.Lock()
+	defer c.Unlock()
+	for _, s := range c.history {
+		if s.Revision == revision {
+			return s, nil
+		}
+	}
+	return nil, ErrRevisionNotFound
+}
+
+// Diff returns the settings that differ between two revisions in the
+// history.
+func (c *Cfg) Diff(from, to int) ([]Change, error) {
+	old, err := c.SnapshotAt(from)
+	if err != nil {
+		return nil, fmt.Errorf("revision %d: %s", from, err)
+	}
+	new, err := c.SnapshotAt(to)
+	if err != nil {
+		return nil, fmt.Errorf("revision %d: %s", to, err)
+	}
+	changes := diff(old.settings, new.settings)
+	if changes == nil {
+		changes = make([]Change, 0)
+	}
+	return changes, nil
+}
+
+// Rollback re-applies the settings of an earlier revision as a new
+// revision. The settings are validated and delivered to subscribers just
+// like a reload. The rollback stays in effect until the config sources
+// next change.
+func (c *Cfg) Rollback(revision int) error {
+	target, err := c.SnapshotAt(revision)
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]interface{}, len(target.settings))
+	for key, value := range target.settings {
+		settings[key] = value
+	}
+	provenance := make(map[string]Provenance, len(target.provenance))
+	for key, p := range target.provenance {
+		provenance[key] = p
+	}
+
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	// secrets in the snapshot are already resolved.
+	return c.apply(settings, provenance, fmt.Sprintf("rollback to %d", revision))
+}
+
+// record adds a published snapshot to the history, dropping the oldest
+// revisions once there are more than config.history-size.
+// c must be locked.
+func (c *Cfg) record(s *Snapshot) {
+	size := 1
+	if settings, ok := s.sections["config"].(*reloadSettings); ok && settings.HistorySize > 0 {
+		size = settings.HistorySize
+	}
+	c.history = append(c.history, s)
+	if len(c.history) > size {
+		c.history = append([]*Snapshot(nil), c.history[len(c.history)-size:]...)
+	}
+}
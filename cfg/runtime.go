@@ -0,0 +1,202 @@
+package cfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// read returns the merged settings of all sources and of the settings
+// changed at runtime, along with where each setting came from.
+func (c *Cfg) read() (map[string]interface{}, map[string]Provenance, error) {
+	layers, err := c.sources.layers()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Lock()
+	if len(c.runtime) > 0 {
+		runtime := layer{source: "api", settings: make(map[string]interface{}, len(c.runtime))}
+		for key, value := range c.runtime {
+			runtime.settings[key] = value
+		}
+		layers = append(layers, runtime)
+	}
+	c.Unlock()
+	settings, provenance := mergeLayers(layers)
+	return settings, provenance, nil
+}
+
+// Set changes settings at runtime, eg. {"worker-a.data": "foo"} or
+// {"worker-a": {"data": "foo"}}. The settings override all other sources
+// and are applied like a reload, so they are validated along with the rest
+// of the config and delivered to subscribers. Either all of the settings
+// are applied or none are. Static settings can not be set at runtime.
+func (c *Cfg) Set(settings map[string]interface{}) error {
+	updates := flattenAll(settings)
+	keys := make([]string, 0, len(updates))
+	var errs ValidationErrors
+	for key := range updates {
+		keys = append(keys, key)
+		if IsStatic(key) {
+			errs = append(errs, &FieldError{Key: key, Message: "requires a restart to change"})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Sort(errs)
+		return errs
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no settings given")
+	}
+	sort.Strings(keys)
+
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.Lock()
+	previous := c.runtime
+	runtime := make(map[string]interface{}, len(previous)+len(updates))
+	for key, value := range previous {
+		runtime[key] = value
+	}
+	for key, value := range updates {
+		runtime[key] = value
+	}
+	c.runtime = runtime
+	c.Unlock()
+
+	if err := c.reapply("api set " + strings.Join(keys, ",")); err != nil {
+		c.Lock()
+		c.runtime = previous
+		c.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Persist writes settings to the first config file, so that settings
+// changed with Set() survive a restart.
+func (c *Cfg) Persist(settings map[string]interface{}) error {
+	if len(c.sources.Files) == 0 {
+		return fmt.Errorf("there is no config file to persist settings to")
+	}
+	return writeSettings(c.sources.Files[0], flattenAll(settings))
+}
+
+func flattenAll(settings map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range settings {
+		flatten(strings.ToLower(key), value, result)
+	}
+	return result
+}
+
+// Unset removes the runtime settings for the key, and any keys below it,
+// so the values from the other sources apply again.
+func (c *Cfg) Unset(key string) error {
+	key = strings.ToLower(key)
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.Lock()
+	previous := c.runtime
+	runtime := make(map[string]interface{}, len(previous))
+	for k, value := range previous {
+		if !hasPrefix(k, key) {
+			runtime[k] = value
+		}
+	}
+	c.runtime = runtime
+	c.Unlock()
+	if len(runtime) == len(previous) {
+		return nil
+	}
+
+	if err := c.reapply("api unset " + key); err != nil {
+		c.Lock()
+		c.runtime = previous
+		c.Unlock()
+		return err
+	}
+	return nil
+}
+
+// RuntimeSettings returns the settings changed with Set(). The values of
+// secret settings are redacted.
+func (c *Cfg) RuntimeSettings() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+	result := make(map[string]interface{}, len(c.runtime))
+	for key, value := range c.runtime {
+		result[key] = redact(key, value)
+	}
+	return result
+}
+
+// writeSettings writes the settings to a yaml config file, keeping the
+// order of the existing settings. Comments in the file are not kept. The
+// file is replaced atomically, so watchers never see a partial file.
+func writeSettings(path string, settings map[string]interface{}) error {
+	if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+		return fmt.Errorf("only yaml config files are supported, not %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("invalid config file %s. %s", path, err)
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		doc = setPath(doc, strings.Split(key, "."), settings[key])
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, info.Mode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// setPath sets the value at the path of keys in a yaml document, creating
+// any maps that are missing.
+func setPath(doc yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	for i, item := range doc {
+		if strings.ToLower(fmt.Sprint(item.Key)) != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			doc[i].Value = value
+		} else {
+			child, _ := item.Value.(yaml.MapSlice)
+			doc[i].Value = setPath(child, path[1:], value)
+		}
+		return doc
+	}
+	if len(path) == 1 {
+		return append(doc, yaml.MapItem{Key: path[0], Value: value})
+	}
+	return append(doc, yaml.MapItem{Key: path[0], Value: setPath(nil, path[1:], value)})
+}
@@ -0,0 +1,201 @@
+package cfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Redacted replaces the value of secret settings wherever settings are
+// exposed, eg. in /config and in logs.
+const Redacted = "******"
+
+// Secret is a string setting that is redacted when it is printed or
+// encoded. Section fields of this type are always secret.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return Redacted
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Value returns the secret itself.
+func (s Secret) Value() string {
+	return string(s)
+}
+
+var secretType = reflect.TypeOf(Secret(""))
+
+// SecretProvider resolves a reference to a secret, eg. the name of the
+// environment variable that holds it.
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretProviderFunc adapts a function to a SecretProvider.
+type SecretProviderFunc func(ref string) (string, error)
+
+func (f SecretProviderFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	secretProviders = map[string]SecretProvider{
+		"env":  SecretProviderFunc(envSecret),
+		"file": SecretProviderFunc(fileSecret),
+	}
+	// secretKeys are the keys whose values are secret.
+	secretKeys = make(map[string]bool)
+	secretsMu  sync.Mutex
+)
+
+func init() {
+	// path to a yaml file of secret names and values, used by "local:<name>"
+	// secret references. Intended for testing.
+	SetDefault("secrets.local-file", "")
+}
+
+// RegisterSecretProvider makes a provider available for the values of
+// secret settings. A secret setting with a value of "<scheme>:<ref>" is
+// resolved by calling the provider registered for the scheme with ref.
+// The "env", "file" and "local" schemes are built in.
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretsMu.Lock()
+	secretProviders[scheme] = p
+	secretsMu.Unlock()
+}
+
+// SetSecretDefault sets the default value of a secret key.
+func SetSecretDefault(key string, value interface{}) {
+	markSecret(key)
+	SetDefault(key, value)
+}
+
+func markSecret(key string) {
+	secretsMu.Lock()
+	secretKeys[strings.ToLower(key)] = true
+	secretsMu.Unlock()
+}
+
+// IsSecret returns true if the value of the key is secret.
+func IsSecret(key string) bool {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	return secretKeys[strings.ToLower(key)]
+}
+
+// resolveSecrets replaces references in the values of secret settings with
+// the secrets they refer to. Values without a known scheme are used as is.
+func resolveSecrets(settings map[string]interface{}) ValidationErrors {
+	var errs ValidationErrors
+	var local map[string]string
+	for key, value := range settings {
+		if !IsSecret(key) {
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		i := strings.Index(s, ":")
+		if i < 0 {
+			continue
+		}
+		scheme, ref := s[:i], s[i+1:]
+
+		var p SecretProvider
+		if scheme == "local" {
+			if local == nil {
+				var err error
+				if local, err = readLocalSecrets(settings["secrets.local-file"]); err != nil {
+					errs = append(errs, &FieldError{Key: "secrets.local-file", Message: err.Error()})
+					local = make(map[string]string)
+				}
+			}
+			p = SecretProviderFunc(func(ref string) (string, error) {
+				v, ok := local[ref]
+				if !ok {
+					return "", fmt.Errorf("secret %s is not in secrets.local-file", ref)
+				}
+				return v, nil
+			})
+		} else {
+			secretsMu.Lock()
+			p, ok = secretProviders[scheme]
+			secretsMu.Unlock()
+			if !ok {
+				continue
+			}
+		}
+
+		secret, err := p.Resolve(ref)
+		if err != nil {
+			errs = append(errs, &FieldError{Key: key, Message: fmt.Sprintf("could not resolve %s secret. %s", scheme, err)})
+			continue
+		}
+		settings[key] = secret
+	}
+	return errs
+}
+
+func envSecret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+func fileSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func readLocalSecrets(path interface{}) (map[string]string, error) {
+	p, _ := path.(string)
+	if p == "" {
+		return nil, fmt.Errorf("must be set to use local secrets")
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(b, &secrets); err != nil {
+		return nil, fmt.Errorf("invalid secrets file. %s", err)
+	}
+	return secrets, nil
+}
+
+// redact returns the value to expose for the key.
+func redact(key string, value interface{}) interface{} {
+	if !IsSecret(key) || value == nil || value == "" {
+		return value
+	}
+	return Redacted
+}
+
+// redactMessage removes the value of a secret setting from an error message.
+func redactMessage(key string, value interface{}, msg string) string {
+	if !IsSecret(key) || value == nil {
+		return msg
+	}
+	if s := fmt.Sprint(value); s != "" {
+		msg = strings.Replace(msg, s, Redacted, -1)
+	}
+	return msg
+}
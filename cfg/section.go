@@ -0,0 +1,402 @@
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+var (
+	// sections maps the name of each registered section to its struct type.
+	sections = make(map[string]reflect.Type)
+	// knownKeys are all keys that have a default value.
+	knownKeys = make(map[string]bool)
+	// mapKeys are the keys of map fields, which hold settings with
+	// arbitrary keys.
+	mapKeys = make(map[string]bool)
+	// staticKeys are the keys that are only read at startup.
+	staticKeys = make(map[string]bool)
+	keysMu     sync.Mutex
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Validator can be implemented by section structs to validate settings
+// that depend on each other. It is called after the individual fields have
+// been validated. Returned *FieldError keys are relative to the section.
+type Validator interface {
+	Validate() error
+}
+
+// RegisterSection binds the config section with the given name to a struct
+// type. config must be a pointer to a struct. Fields are mapped to keys
+// using the `cfg` tag, and nested structs map to nested sections. Settings
+// that are only read at startup are marked with the static option, and
+// settings that must not be exposed with the secret option or by using the
+// Secret type, eg.
+//
+//	type Config struct {
+//		Password    Secret        `cfg:"password" validate:"required"`
+//		Concurrency int           `cfg:"concurrency,static" default:"1" validate:"min=1,max=100"`
+//		Timeout     time.Duration `cfg:"timeout" default:"10s" validate:"min=1s,max=1m"`
+//		Mode        string        `cfg:"mode" default:"fast" validate:"oneof=fast slow"`
+//		Retry       struct {
+//			MaxAttempts int `cfg:"max-attempts" default:"3"`
+//		} `cfg:"retry"`
+//	}
+//
+// The `default` tag sets the default value of the key. The `validate` tag
+// is a comma separated list of rules that are checked by Cfg.Load():
+//
+//	required   the value must not be the zero value
+//	min=N      numbers and durations must be >= N, strings and lists must have at least N elements
+//	max=N      numbers and durations must be <= N, strings and lists must have at most N elements
+//	oneof=a b  the value must be one of the space separated values
+//	regexp=re  the value must match the regular expression. must be the last rule
+//
+// Maps with string keys hold settings with arbitrary keys, eg. a field
+// `Levels map[string]string cfg:"levels"` in the "log" section is set from
+// log.levels.api, log.levels.worker-a and so on. Maps have no default, and
+// their validate rules apply to each value.
+//
+// RegisterSection should be called from init() and panics if config is not
+// valid, as that is a programming error.
+func RegisterSection(name string, config interface{}) {
+	t := reflect.TypeOf(config)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("cfg: section %s must be a pointer to a struct, got %T", name, config))
+	}
+	keysMu.Lock()
+	if _, ok := sections[name]; ok {
+		keysMu.Unlock()
+		panic(fmt.Sprintf("cfg: section %s is already registered", name))
+	}
+	sections[name] = t.Elem()
+	keysMu.Unlock()
+
+	walk(name, reflect.New(t.Elem()).Elem(), func(key string, f reflect.StructField, _ reflect.Value) {
+		_, opts := tagOptions(f)
+		if f.Type.Kind() == reflect.Map {
+			if f.Type.Key().Kind() != reflect.String {
+				panic(fmt.Sprintf("cfg: %s must be a map with string keys, got %s", key, f.Type))
+			}
+			if _, err := parseRules(f.Tag.Get("validate"), f.Type.Elem()); err != nil {
+				panic(fmt.Sprintf("cfg: invalid validate tag for %s. %s", key, err))
+			}
+			// the keys below a map are known, as they are checked
+			// against their parents.
+			addKnownKey(key, opts["static"])
+			keysMu.Lock()
+			mapKeys[strings.ToLower(key)] = true
+			keysMu.Unlock()
+			return
+		}
+		def := reflect.New(f.Type).Elem()
+		if tag, ok := f.Tag.Lookup("default"); ok {
+			if err := setValue(def, tag); err != nil {
+				panic(fmt.Sprintf("cfg: invalid default for %s. %s", key, err))
+			}
+		}
+		if _, err := parseRules(f.Tag.Get("validate"), f.Type); err != nil {
+			panic(fmt.Sprintf("cfg: invalid validate tag for %s. %s", key, err))
+		}
+		if opts["secret"] || f.Type == secretType {
+			markSecret(key)
+		}
+		if opts["static"] {
+			SetStaticDefault(key, def.Interface())
+		} else {
+			SetDefault(key, def.Interface())
+		}
+	})
+}
+
+func addKnownKey(key string, static bool) {
+	keysMu.Lock()
+	knownKeys[strings.ToLower(key)] = true
+	if static {
+		staticKeys[strings.ToLower(key)] = true
+	}
+	keysMu.Unlock()
+}
+
+// IsStatic returns true if the key is only read at startup, so changing it
+// requires a restart.
+func IsStatic(key string) bool {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	return staticKeys[strings.ToLower(key)]
+}
+
+// StaticKeys returns all keys that require a restart to change, sorted.
+func StaticKeys() []string {
+	keysMu.Lock()
+	keys := make([]string, 0, len(staticKeys))
+	for key := range staticKeys {
+		keys = append(keys, key)
+	}
+	keysMu.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// isKnown returns true if the key has a default, or is below a map field.
+// Keys below other settings, eg. worker-a.data.foo when worker-a.data is a
+// string, are not known.
+func isKnown(key string) bool {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if knownKeys[key] {
+		return true
+	}
+	for {
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			return false
+		}
+		key = key[:i]
+		if mapKeys[key] {
+			return true
+		}
+	}
+}
+
+// Load reads and validates all settings, and publishes them as the
+// current snapshot. All invalid settings, and any settings in the config
+// that are not known, are returned together as ValidationErrors. The
+// current snapshot is only replaced if there are no errors.
+func (c *Cfg) Load() error {
+	settings, provenance, err := c.read()
+	if err != nil {
+		return err
+	}
+	if errs := resolveSecrets(settings); len(errs) > 0 {
+		sort.Sort(errs)
+		return errs
+	}
+	snapshot, err := c.stage(settings, provenance)
+	if err != nil {
+		return err
+	}
+	snapshot.cause = "load"
+	c.publish(snapshot)
+	return nil
+}
+
+// stage creates a new snapshot of the settings and validates it. The
+// snapshot has all sections even if it is invalid, with the settings that
+// could not be decoded left as zero values.
+func (c *Cfg) stage(settings map[string]interface{}, provenance map[string]Provenance) (*Snapshot, error) {
+	snapshot := &Snapshot{
+		Time:       time.Now(),
+		settings:   settings,
+		provenance: provenance,
+	}
+
+	keysMu.Lock()
+	types := make(map[string]reflect.Type, len(sections))
+	for name, t := range sections {
+		types[name] = t
+	}
+	keysMu.Unlock()
+
+	var errs ValidationErrors
+	loaded := make(map[string]interface{}, len(types))
+	for name, t := range types {
+		ptr := reflect.New(t)
+		fieldErrs := snapshot.decode(name, ptr.Elem())
+		if v, ok := ptr.Interface().(Validator); ok && len(fieldErrs) == 0 {
+			fieldErrs = append(fieldErrs, qualify(name, v.Validate())...)
+		}
+		errs = append(errs, fieldErrs...)
+		loaded[name] = ptr.Interface()
+	}
+	snapshot.sections = loaded
+	for key := range snapshot.settings {
+		if !isKnown(key) {
+			errs = append(errs, &FieldError{Key: key, Message: "unknown setting"})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Sort(errs)
+		return snapshot, errs
+	}
+	return snapshot, nil
+}
+
+// Section returns the value of a registered section in the current
+// snapshot, as a pointer to the struct type it was registered with. The
+// returned value is shared and must not be modified. Before Load the
+// section holds the unvalidated settings. Nil is only returned if no
+// section is registered with the name.
+func (c *Cfg) Section(name string) interface{} {
+	return c.current().sections[name]
+}
+
+// decode sets the fields of v from the settings under prefix, and
+// validates them.
+func (s *Snapshot) decode(prefix string, v reflect.Value) ValidationErrors {
+	var errs ValidationErrors
+	walk(prefix, v, func(key string, f reflect.StructField, field reflect.Value) {
+		if field.Kind() == reflect.Map {
+			errs = append(errs, s.decodeMap(key, f, field)...)
+			return
+		}
+		raw := s.Get(key)
+		if err := setValue(field, raw); err != nil {
+			errs = append(errs, &FieldError{Key: key, Message: redactMessage(key, raw, err.Error())})
+			return
+		}
+		// the rules were validated by RegisterSection.
+		rules, _ := parseRules(f.Tag.Get("validate"), f.Type)
+		for _, r := range rules {
+			if err := r(field); err != nil {
+				errs = append(errs, &FieldError{Key: key, Message: redactMessage(key, raw, err.Error())})
+			}
+		}
+	})
+	return errs
+}
+
+// decodeMap sets the map field from the settings below key, and validates
+// each value.
+func (s *Snapshot) decodeMap(key string, f reflect.StructField, field reflect.Value) ValidationErrors {
+	if raw := s.Get(key); raw != nil {
+		return ValidationErrors{&FieldError{Key: key, Message: redactMessage(key, raw, "must be a map")}}
+	}
+	var errs ValidationErrors
+	m := reflect.MakeMap(f.Type)
+	// the rules were validated by RegisterSection.
+	rules, _ := parseRules(f.Tag.Get("validate"), f.Type.Elem())
+	for _, k := range s.AllKeys() {
+		if !strings.HasPrefix(k, key+".") {
+			continue
+		}
+		raw := s.settings[k]
+		value := reflect.New(f.Type.Elem()).Elem()
+		if err := setValue(value, raw); err != nil {
+			errs = append(errs, &FieldError{Key: k, Message: redactMessage(k, raw, err.Error())})
+			continue
+		}
+		for _, r := range rules {
+			if err := r(value); err != nil {
+				errs = append(errs, &FieldError{Key: k, Message: redactMessage(k, raw, err.Error())})
+			}
+		}
+		m.SetMapIndex(reflect.ValueOf(strings.TrimPrefix(k, key+".")), value)
+	}
+	field.Set(m)
+	return errs
+}
+
+// walk calls fn for each setting of the struct v, with its full key and
+// the value of the field.
+func walk(prefix string, v reflect.Value, fn func(key string, f reflect.StructField, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, _ := tagOptions(f)
+		if name == "-" {
+			continue
+		}
+		key := prefix + "." + name
+		if f.Type.Kind() == reflect.Struct {
+			walk(key, v.Field(i), fn)
+			continue
+		}
+		fn(key, f, v.Field(i))
+	}
+}
+
+// tagOptions returns the key name of the field, and the options set in
+// its `cfg` tag.
+func tagOptions(f reflect.StructField) (string, map[string]bool) {
+	parts := strings.Split(f.Tag.Get("cfg"), ",")
+	name := parts[0]
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	opts := make(map[string]bool)
+	for _, opt := range parts[1:] {
+		opts[opt] = true
+	}
+	return name, opts
+}
+
+// setValue converts raw to the type of v and stores it in v.
+func setValue(v reflect.Value, raw interface{}) error {
+	if v.Type() == durationType {
+		d, err := cast.ToDurationE(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %v", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		s, err := cast.ToStringE(raw)
+		if err != nil {
+			return fmt.Errorf("invalid string %v", raw)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := cast.ToBoolE(raw)
+		if err != nil {
+			return fmt.Errorf("invalid bool %v", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := cast.ToInt64E(raw)
+		if err != nil || v.OverflowInt(i) {
+			return fmt.Errorf("invalid integer %v", raw)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := cast.ToUint64E(raw)
+		if err != nil || v.OverflowUint(i) {
+			return fmt.Errorf("invalid unsigned integer %v", raw)
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := cast.ToFloat64E(raw)
+		if err != nil || v.OverflowFloat(f) {
+			return fmt.Errorf("invalid number %v", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var s []string
+		var err error
+		if str, ok := raw.(string); ok {
+			// a list can be given as a comma separated string, eg. in env vars.
+			s = splitList(str)
+		} else if s, err = cast.ToStringSliceE(raw); err != nil {
+			return fmt.Errorf("invalid list %v", raw)
+		}
+		v.Set(reflect.ValueOf(s))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	result := make([]string, 0)
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
@@ -0,0 +1,235 @@
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name    string        `cfg:"name" validate:"required"`
+	Count   int           `cfg:"count,static" default:"1" validate:"min=1,max=10"`
+	Timeout time.Duration `cfg:"timeout" default:"1s" validate:"min=1s,max=1m"`
+	Mode    string        `cfg:"mode" default:"fast" validate:"oneof=fast slow"`
+	Pattern string        `cfg:"pattern" default:"a,b" validate:"regexp=^[a-z]+(,[a-z]+)*$"`
+	Tags    []string      `cfg:"tags" validate:"max=2"`
+	Retry   struct {
+		MaxAttempts int `cfg:"max-attempts" default:"3" validate:"min=0"`
+	} `cfg:"retry"`
+	Levels map[string]string `cfg:"levels" validate:"oneof=debug info"`
+	Token  Secret            `cfg:"token" validate:"regexp=^[a-z]*$"`
+}
+
+// Validate checks settings that depend on each other.
+func (c *testConfig) Validate() error {
+	if c.Mode == "slow" && c.Count > 5 {
+		return &FieldError{Key: "count", Message: "must be <= 5 in slow mode"}
+	}
+	return nil
+}
+
+func init() {
+	RegisterSection("cfgtest", &testConfig{})
+}
+
+func load(overrides map[string]string) (*Cfg, error) {
+	c := New(Sources{Overrides: overrides})
+	return c, c.Load()
+}
+
+func TestLoadSection(t *testing.T) {
+	c, err := load(map[string]string{
+		"cfgtest.name":               "demo",
+		"cfgtest.mode":               "slow",
+		"cfgtest.tags":               "a,b",
+		"cfgtest.retry.max-attempts": "0",
+		"cfgtest.levels.api":         "debug",
+		"cfgtest.levels.worker-a":    "info",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.Section("cfgtest").(*testConfig)
+	want := &testConfig{
+		Name:    "demo",
+		Count:   1,
+		Timeout: time.Second,
+		Mode:    "slow",
+		Pattern: "a,b",
+		Tags:    []string{"a", "b"},
+		Levels:  map[string]string{"api": "debug", "worker-a": "info"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !IsStatic("cfgtest.count") || IsStatic("cfgtest.name") {
+		t.Errorf("only cfgtest.count should be static")
+	}
+}
+
+func TestLoadValidationErrors(t *testing.T) {
+	_, err := load(map[string]string{
+		"cfgtest.count":              "11",
+		"cfgtest.timeout":            "500ms",
+		"cfgtest.mode":               "medium",
+		"cfgtest.pattern":            "A",
+		"cfgtest.tags":               "a,b,c",
+		"cfgtest.retry.max-attempts": "many",
+		"cfgtest.levels.api":         "trace",
+	})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T: %v", err, err)
+	}
+	// all errors are reported at once, sorted by key.
+	want := []string{
+		`cfgtest.count: must be <= 10, got 11`,
+		`cfgtest.levels.api: must be one of debug, info, got "trace"`,
+		`cfgtest.mode: must be one of fast, slow, got "medium"`,
+		`cfgtest.name: is required`,
+		`cfgtest.pattern: must match ^[a-z]+(,[a-z]+)*$, got "A"`,
+		`cfgtest.retry.max-attempts: invalid integer many`,
+		`cfgtest.tags: length must be <= 2, got 3`,
+		`cfgtest.timeout: must be >= 1s, got 500ms`,
+	}
+	checkErrors(t, errs, want)
+	if !strings.HasPrefix(err.Error(), fmt.Sprintf("%d invalid settings: cfgtest.count: ", len(want))) {
+		t.Errorf("unexpected error message %q", err)
+	}
+}
+
+func TestLoadValidator(t *testing.T) {
+	_, err := load(map[string]string{
+		"cfgtest.name":  "demo",
+		"cfgtest.mode":  "slow",
+		"cfgtest.count": "8",
+	})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T: %v", err, err)
+	}
+	checkErrors(t, errs, []string{"cfgtest.count: must be <= 5 in slow mode"})
+
+	// the validator is not called while fields are invalid.
+	_, err = load(map[string]string{
+		"cfgtest.mode":  "slow",
+		"cfgtest.count": "8",
+	})
+	errs, _ = err.(ValidationErrors)
+	checkErrors(t, errs, []string{"cfgtest.name: is required"})
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	_, err := load(map[string]string{
+		"cfgtest.name":                      "demo",
+		"cfgtest.nope":                      "x",
+		"cfgtest.name.nested":               "x",
+		"cfgtest.retry.nope":                "x",
+		"cfgtest.retry.max-attempts.nested": "x",
+		"nosuchsection.key":                 "x",
+		// keys below a map are known.
+		"cfgtest.levels.api": "info",
+	})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T: %v", err, err)
+	}
+	checkErrors(t, errs, []string{
+		"cfgtest.name.nested: unknown setting",
+		"cfgtest.nope: unknown setting",
+		"cfgtest.retry.max-attempts.nested: unknown setting",
+		"cfgtest.retry.nope: unknown setting",
+		"nosuchsection.key: unknown setting",
+	})
+}
+
+func TestLoadMapScalar(t *testing.T) {
+	_, err := load(map[string]string{
+		"cfgtest.name":   "demo",
+		"cfgtest.levels": "debug",
+	})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T: %v", err, err)
+	}
+	checkErrors(t, errs, []string{`cfgtest.levels: must be a map`})
+}
+
+func TestSecretRules(t *testing.T) {
+	c, err := load(map[string]string{"cfgtest.name": "demo", "cfgtest.token": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := c.Section("cfgtest").(*testConfig).Token.Value(); token != "abc" {
+		t.Errorf("got token %q, want %q", token, "abc")
+	}
+
+	_, err = load(map[string]string{"cfgtest.name": "demo", "cfgtest.token": "ABC"})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T: %v", err, err)
+	}
+	checkErrors(t, errs, []string{`cfgtest.token: must match ^[a-z]*$, got "******"`})
+}
+
+func checkErrors(t *testing.T, errs ValidationErrors, want []string) {
+	t.Helper()
+	got := make([]string, len(errs))
+	for i, e := range errs {
+		got[i] = e.Error()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRegisterSectionPanics(t *testing.T) {
+	tests := []struct {
+		name   string
+		config interface{}
+		panic  string
+	}{
+		{"cfgtest-nil", nil, "must be a pointer to a struct, got <nil>"},
+		{"cfgtest-struct", testConfig{}, "must be a pointer to a struct, got cfg.testConfig"},
+		{"cfgtest", &testConfig{}, "section cfgtest is already registered"},
+		{"cfgtest-rule", &struct {
+			A int `cfg:"a" validate:"between=1"`
+		}{}, `invalid validate tag for cfgtest-rule.a. unknown rule "between"`},
+		{"cfgtest-bound", &struct {
+			A time.Duration `cfg:"a" validate:"min=1"`
+		}{}, `invalid validate tag for cfgtest-bound.a. invalid duration "1" for min`},
+		{"cfgtest-unsupported", &struct {
+			A bool `cfg:"a" validate:"max=1"`
+		}{}, `invalid validate tag for cfgtest-unsupported.a. max is not supported for bool`},
+		{"cfgtest-regexp", &struct {
+			A string `cfg:"a" validate:"regexp=("`
+		}{}, `invalid validate tag for cfgtest-regexp.a. invalid regexp "("`},
+		{"cfgtest-default", &struct {
+			A int `cfg:"a" default:"one"`
+		}{}, `invalid default for cfgtest-default.a`},
+		{"cfgtest-map", &struct {
+			A map[int]string `cfg:"a"`
+		}{}, `cfgtest-map.a must be a map with string keys`},
+	}
+	for _, tt := range tests {
+		msg := func() (msg string) {
+			defer func() {
+				msg = fmt.Sprint(recover())
+				if tt.name != "cfgtest" {
+					// sections are registered before their fields are
+					// checked, so remove them for the next run.
+					keysMu.Lock()
+					delete(sections, tt.name)
+					keysMu.Unlock()
+				}
+			}()
+			RegisterSection(tt.name, tt.config)
+			return
+		}()
+		if !strings.Contains(msg, tt.panic) {
+			t.Errorf("RegisterSection(%s): got panic %q, want it to contain %q", tt.name, msg, tt.panic)
+		}
+	}
+}
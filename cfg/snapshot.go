@@ -0,0 +1,102 @@
+package cfg
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a setting that differs between two snapshots.
+// Old and New are redacted for secret settings.
+type Change struct {
+	Key   string      `json:"key"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+	Error string      `json:"error,omitempty"`
+
+	// rawOld and rawNew are the values before redaction, so that changes
+	// to secrets can be told apart when events are merged.
+	rawOld, rawNew interface{}
+}
+
+func (s *Snapshot) Get(key string) interface{} {
+	return s.settings[strings.ToLower(key)]
+}
+
+// AllKeys returns all keys in the snapshot, sorted.
+func (s *Snapshot) AllKeys() []string {
+	keys := make([]string, 0, len(s.settings))
+	for key := range s.settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AllSettings returns the settings as a nested map, split on ".". The
+// values of secret settings are redacted.
+func (s *Snapshot) AllSettings() map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range s.settings {
+		path := strings.Split(key, ".")
+		m := result
+		for _, part := range path[:len(path)-1] {
+			next, ok := m[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				m[part] = next
+			}
+			m = next
+		}
+		m[path[len(path)-1]] = redact(key, value)
+	}
+	return result
+}
+
+// Provenance returns where the settings with the given key prefix came
+// from, sorted by key. The values of secret settings are redacted.
+func (s *Snapshot) Provenance(prefix string) []Provenance {
+	prefix = strings.ToLower(prefix)
+	result := make([]Provenance, 0)
+	for _, key := range s.AllKeys() {
+		if !hasPrefix(key, prefix) {
+			continue
+		}
+		p := s.provenance[key]
+		p.Key = key
+		p.Value = redact(key, p.Value)
+		overridden := make([]LayerValue, len(p.Overridden))
+		for i, lv := range p.Overridden {
+			overridden[i] = LayerValue{Source: lv.Source, Value: redact(key, lv.Value)}
+		}
+		p.Overridden = overridden
+		result = append(result, p)
+	}
+	return result
+}
+
+// diff returns the keys that were added, removed or changed, sorted by key.
+// The values of secret settings are redacted.
+func diff(old, new map[string]interface{}) []Change {
+	var changes []Change
+	for key, value := range new {
+		if oldValue, ok := old[key]; !ok || !reflect.DeepEqual(oldValue, value) {
+			changes = append(changes, Change{
+				Key:    key,
+				Old:    redact(key, oldValue),
+				New:    redact(key, value),
+				rawOld: oldValue,
+				rawNew: value,
+			})
+		}
+	}
+	for key, value := range old {
+		if _, ok := new[key]; !ok {
+			changes = append(changes, Change{Key: key, Old: redact(key, value), rawOld: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
@@ -0,0 +1,332 @@
+package cfg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Sources are the layers that settings are read from. Each layer overrides
+// the layers before it:
+//
+//	defaults set with SetDefault()
+//	Defaults, eg. from flags that only apply if the config does not set them
+//	Files, in order
+//	*.yaml files in Dirs, in lexical order
+//	environment variables, eg. DEMO_WORKER_A_DATA for worker-a.data
+//	Overrides, eg. from --set flags
+//	settings changed at runtime with Cfg.Set()
+type Sources struct {
+	Files []string
+	Dirs  []string
+	// EnvPrefix is prepended to the names of environment variables. If
+	// empty, settings are not read from the environment.
+	EnvPrefix string
+	Defaults  map[string]string
+	Overrides map[string]string
+}
+
+// Provenance describes where the value of a setting came from.
+type Provenance struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+	// Overridden are the values of the key in lower layers, highest first.
+	Overridden []LayerValue `json:"overridden,omitempty"`
+}
+
+// LayerValue is the value of a setting in a single layer.
+type LayerValue struct {
+	Source string      `json:"source"`
+	Value  interface{} `json:"value"`
+}
+
+var (
+	// defaults are the values set with SetDefault, by key.
+	defaults   = make(map[string]interface{})
+	defaultsMu sync.Mutex
+)
+
+func setDefault(key string, value interface{}) {
+	defaultsMu.Lock()
+	defaults[strings.ToLower(key)] = value
+	defaultsMu.Unlock()
+}
+
+var (
+	// aliases maps deprecated keys to the keys that replaced them.
+	aliases = make(map[string]string)
+	// aliasWarnings records the deprecated keys that have been warned
+	// about, by source, so that reloads do not repeat the warning.
+	aliasWarnings = make(map[string]bool)
+	aliasesMu     sync.Mutex
+)
+
+// RegisterAlias makes old a deprecated name for the key new, eg. after a
+// setting has been renamed. Any source that sets old sets new instead, and
+// a warning is logged. If a source sets both, old is ignored.
+func RegisterAlias(old, new string) {
+	aliasesMu.Lock()
+	aliases[strings.ToLower(old)] = strings.ToLower(new)
+	aliasesMu.Unlock()
+}
+
+// layer is the settings from a single source.
+type layer struct {
+	source   string
+	settings map[string]interface{}
+}
+
+// layers returns the settings of each source, lowest first.
+func (s Sources) layers() ([]layer, error) {
+	layers := []layer{s.defaults()}
+	if len(s.Defaults) > 0 {
+		flags := layer{source: "flag:defaults", settings: make(map[string]interface{})}
+		for key, value := range s.Defaults {
+			flags.settings[strings.ToLower(key)] = value
+		}
+		layers = append(layers, flags)
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		l, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
+	}
+
+	// environment variables can only set keys that are already known, or
+	// keys in a map.
+	known := make(map[string]bool)
+	for _, l := range layers {
+		for key := range l.settings {
+			known[key] = true
+		}
+	}
+	aliasesMu.Lock()
+	for old := range aliases {
+		known[old] = true
+	}
+	aliasesMu.Unlock()
+	layers = append(layers, s.env(known)...)
+
+	if len(s.Overrides) > 0 {
+		overrides := layer{source: "flag:--set", settings: make(map[string]interface{})}
+		for key, value := range s.Overrides {
+			overrides.settings[strings.ToLower(key)] = value
+		}
+		layers = append(layers, overrides)
+	}
+	return layers, nil
+}
+
+// mergeLayers returns the settings of all layers, along with where each setting
+// came from. Later layers override earlier ones.
+func mergeLayers(layers []layer) (map[string]interface{}, map[string]Provenance) {
+	settings := make(map[string]interface{})
+	provenance := make(map[string]Provenance)
+	for _, l := range layers {
+		l.resolveAliases()
+		for key, value := range l.settings {
+			p, ok := provenance[key]
+			if ok {
+				p.Overridden = append([]LayerValue{{Source: p.Source, Value: p.Value}}, p.Overridden...)
+			}
+			p.Key, p.Value, p.Source = key, value, l.source
+			provenance[key] = p
+			settings[key] = value
+		}
+	}
+	return settings, provenance
+}
+
+// resolveAliases moves the settings of deprecated keys to the keys that
+// replaced them.
+func (l layer) resolveAliases() {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	for old, new := range aliases {
+		value, ok := l.settings[old]
+		if !ok {
+			continue
+		}
+		delete(l.settings, old)
+		_, both := l.settings[new]
+		if warned := l.source + " " + old; !aliasWarnings[warned] {
+			aliasWarnings[warned] = true
+			if both {
+				log.Warnf("%s: ignoring %s as %s is also set. %s is deprecated", l.source, old, new, old)
+			} else {
+				log.Warnf("%s: %s is deprecated. use %s instead", l.source, old, new)
+			}
+		}
+		if !both {
+			l.settings[new] = value
+		}
+	}
+}
+
+func (s Sources) defaults() layer {
+	l := layer{source: "default", settings: make(map[string]interface{})}
+	defaultsMu.Lock()
+	for key, value := range defaults {
+		flatten(key, value, l.settings)
+	}
+	defaultsMu.Unlock()
+	return l
+}
+
+// files returns the config files to read, in order.
+func (s Sources) files() ([]string, error) {
+	files := make([]string, 0, len(s.Files))
+	files = append(files, s.Files...)
+	for _, dir := range s.Dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+func readFile(path string) (layer, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return layer{}, fmt.Errorf("could not read %s. %s", path, err)
+	}
+	l := layer{source: "file:" + path, settings: make(map[string]interface{})}
+	for _, key := range v.AllKeys() {
+		l.settings[key] = v.Get(key)
+	}
+	return l, nil
+}
+
+// env returns a layer for each environment variable that sets a known key,
+// or a key in a map.
+func (s Sources) env(known map[string]bool) []layer {
+	if s.EnvPrefix == "" {
+		return nil
+	}
+	replacer := strings.NewReplacer("-", "_", ".", "_")
+	envName := func(key string) string {
+		return strings.ToUpper(s.EnvPrefix + "_" + replacer.Replace(key))
+	}
+	keys := make([]string, 0, len(known))
+	for key := range known {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var layers []layer
+	used := make(map[string]bool)
+	for _, key := range keys {
+		name := envName(key)
+		if value, ok := os.LookupEnv(name); ok {
+			layers = append(layers, layer{source: "env:" + name, settings: map[string]interface{}{key: value}})
+			used[name] = true
+		}
+	}
+
+	// the keys of a map are not known in advance, so any variable below a
+	// map adds a key to it, eg. DEMO_LOG_LEVELS_WORKER_A sets
+	// log.levels.worker-a. "_" in the map key is read as "-".
+	keysMu.Lock()
+	maps := make(map[string]string, len(mapKeys))
+	for key := range mapKeys {
+		maps[envName(key)+"_"] = key
+	}
+	keysMu.Unlock()
+	var mapLayers []layer
+	for _, env := range os.Environ() {
+		i := strings.Index(env, "=")
+		if i < 0 || used[env[:i]] {
+			continue
+		}
+		name, value := env[:i], env[i+1:]
+		for prefix, key := range maps {
+			if len(name) > len(prefix) && strings.HasPrefix(name, prefix) {
+				key += "." + strings.Replace(strings.ToLower(name[len(prefix):]), "_", "-", -1)
+				mapLayers = append(mapLayers, layer{source: "env:" + name, settings: map[string]interface{}{key: value}})
+			}
+		}
+	}
+	sort.Slice(mapLayers, func(i, j int) bool { return mapLayers[i].source < mapLayers[j].source })
+	return append(layers, mapLayers...)
+}
+
+// flatten adds value to settings under key. Maps are flattened into a key
+// per leaf, eg. "log.levels.api".
+func flatten(key string, value interface{}, settings map[string]interface{}) {
+	m, err := cast.ToStringMapE(value)
+	if err != nil || len(m) == 0 {
+		settings[key] = value
+		return
+	}
+	for k, v := range m {
+		flatten(key+"."+strings.ToLower(k), v, settings)
+	}
+}
+
+// watch calls fn whenever one of the config files, or a *.yaml file in one
+// of the config directories, is written, created or removed.
+func (s Sources) watch(fn func(name string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, file := range s.Files {
+		files[filepath.Clean(file)] = true
+		dirs[filepath.Dir(filepath.Clean(file))] = false
+	}
+	for _, dir := range s.Dirs {
+		dirs[filepath.Clean(dir)] = true
+	}
+	for dir := range dirs {
+		// watch the directory rather than the files, to pick up atomic
+		// saves and new files.
+		if err := watcher.Add(dir); err != nil && !os.IsNotExist(err) {
+			log.Warnf("unable to watch %s for config changes. %s", dir, err)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				if !files[name] && !(dirs[filepath.Dir(name)] && filepath.Ext(name) == ".yaml") {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					fn(name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("config watcher error. %s", err)
+			}
+		}
+	}()
+	return nil
+}
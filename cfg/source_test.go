@@ -0,0 +1,133 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func init() {
+	RegisterAlias("cfgtest.speed", "cfgtest.mode")
+}
+
+func TestAlias(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		env       string
+		overrides map[string]string
+		mode      string
+		source    string
+	}{
+		{
+			name:   "alias sets the new key",
+			file:   "cfgtest:\n  name: demo\n  speed: slow\n",
+			mode:   "slow",
+			source: "file",
+		},
+		{
+			name:   "new key wins within a source",
+			file:   "cfgtest:\n  name: demo\n  speed: slow\n  mode: fast\n",
+			mode:   "fast",
+			source: "file",
+		},
+		{
+			name:      "later sources override the alias",
+			file:      "cfgtest:\n  name: demo\n  speed: slow\n",
+			overrides: map[string]string{"cfgtest.mode": "fast"},
+			mode:      "fast",
+			source:    "flag:--set",
+		},
+		{
+			name:      "alias overrides earlier sources",
+			file:      "cfgtest:\n  name: demo\n  mode: fast\n",
+			overrides: map[string]string{"cfgtest.speed": "slow"},
+			mode:      "slow",
+			source:    "flag:--set",
+		},
+		{
+			name:   "alias in the environment",
+			file:   "cfgtest:\n  name: demo\n",
+			env:    "slow",
+			mode:   "slow",
+			source: "env:CFGTEST_CFGTEST_SPEED",
+		},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(file, []byte(tt.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.env != "" {
+			t.Setenv("CFGTEST_CFGTEST_SPEED", tt.env)
+		}
+		c := New(Sources{Files: []string{file}, EnvPrefix: "cfgtest", Overrides: tt.overrides})
+		if err := c.Load(); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if mode := c.Section("cfgtest").(*testConfig).Mode; mode != tt.mode {
+			t.Errorf("%s: mode is %s, want %s", tt.name, mode, tt.mode)
+		}
+		if tt.source == "file" {
+			tt.source = "file:" + file
+		}
+		p := c.Provenance("cfgtest.mode")
+		if len(p) != 1 || p[0].Source != tt.source {
+			t.Errorf("%s: got provenance %+v, want source %s", tt.name, p, tt.source)
+		}
+		if c.Get("cfgtest.speed") != nil {
+			t.Errorf("%s: the deprecated key is still set", tt.name)
+		}
+	}
+}
+
+func TestEnvMapKeys(t *testing.T) {
+	t.Setenv("CFGTEST_CFGTEST_LEVELS_WORKER_A", "debug")
+	t.Setenv("CFGTEST_CFGTEST_LEVELS_API", "info")
+	// a variable for the map itself is not a key in it.
+	t.Setenv("CFGTEST_CFGTEST_LEVELS_", "debug")
+	c := New(Sources{EnvPrefix: "cfgtest", Overrides: map[string]string{"cfgtest.name": "x"}})
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"api": "info", "worker-a": "debug"}
+	if got := c.Section("cfgtest").(*testConfig).Levels; !reflect.DeepEqual(got, want) {
+		t.Errorf("got levels %v, want %v", got, want)
+	}
+	p := c.Provenance("cfgtest.levels.worker-a")
+	if len(p) != 1 || p[0].Source != "env:CFGTEST_CFGTEST_LEVELS_WORKER_A" {
+		t.Errorf("got provenance %+v", p)
+	}
+}
+
+func TestDefaultsLayer(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		mode   string
+		source string
+	}{
+		{"defaults apply", "cfgtest:\n  name: demo\n", "slow", "flag:defaults"},
+		{"files override", "cfgtest:\n  name: demo\n  mode: fast\n", "fast", "file"},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(file, []byte(tt.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := New(Sources{Files: []string{file}, Defaults: map[string]string{"cfgtest.mode": "slow"}})
+		if err := c.Load(); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if mode := c.Section("cfgtest").(*testConfig).Mode; mode != tt.mode {
+			t.Errorf("%s: mode is %s, want %s", tt.name, mode, tt.mode)
+		}
+		if tt.source == "file" {
+			tt.source = "file:" + file
+		}
+		if p := c.Provenance("cfgtest.mode"); len(p) != 1 || p[0].Source != tt.source {
+			t.Errorf("%s: got provenance %+v, want source %s", tt.name, p, tt.source)
+		}
+	}
+}
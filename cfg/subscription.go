@@ -0,0 +1,158 @@
+package cfg
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChangeEvent describes the settings that changed when a new config
+// revision was published.
+type ChangeEvent struct {
+	Revision int
+	Changes  []Change
+}
+
+// Changed returns true if the key, or any key below it, changed.
+func (e ChangeEvent) Changed(key string) bool {
+	for _, c := range e.Changes {
+		if hasPrefix(c.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription delivers the changes to keys under a prefix to a listener.
+// Events are delivered in order by a goroutine owned by the subscription,
+// so a slow listener never blocks the publishing of new config. If several
+// revisions are published while the listener is busy, they are coalesced
+// into a single event for the latest revision.
+type Subscription struct {
+	prefix string
+	fn     func(ChangeEvent)
+	cfg    *Cfg
+
+	pending *ChangeEvent
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+// Subscribe calls fn whenever a setting with the given key prefix changes,
+// eg. "worker-a" for all worker-a settings. An empty prefix subscribes to
+// all changes. The event only includes the changes under the prefix.
+func (c *Cfg) Subscribe(prefix string, fn func(ChangeEvent)) *Subscription {
+	s := &Subscription{
+		prefix: strings.ToLower(prefix),
+		fn:     fn,
+		cfg:    c,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	c.Lock()
+	c.subscriptions = append(c.subscriptions, s)
+	c.Unlock()
+	go s.run()
+	return s
+}
+
+// Unsubscribe stops delivery of events. An event that is already being
+// delivered is not interrupted.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.cfg.Lock()
+		for i, sub := range s.cfg.subscriptions {
+			if sub == s {
+				s.cfg.subscriptions = append(s.cfg.subscriptions[:i], s.cfg.subscriptions[i+1:]...)
+				break
+			}
+		}
+		s.cfg.Unlock()
+		close(s.done)
+	})
+}
+
+// notify queues the changes under the prefix for delivery. It never blocks.
+func (s *Subscription) notify(e ChangeEvent) {
+	var changes []Change
+	for _, c := range e.Changes {
+		if hasPrefix(c.Key, s.prefix) {
+			changes = append(changes, c)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	s.Lock()
+	if s.pending == nil {
+		s.pending = &ChangeEvent{Revision: e.Revision, Changes: changes}
+	} else {
+		s.pending = &ChangeEvent{Revision: e.Revision, Changes: merge(s.pending.Changes, changes)}
+	}
+	s.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+		s.Lock()
+		e := s.pending
+		s.pending = nil
+		s.Unlock()
+		if e != nil && len(e.Changes) > 0 {
+			s.fn(*e)
+		}
+	}
+}
+
+// notify delivers the event to all subscriptions.
+func (c *Cfg) notify(e ChangeEvent) {
+	c.Lock()
+	subscriptions := make([]*Subscription, len(c.subscriptions))
+	copy(subscriptions, c.subscriptions)
+	c.Unlock()
+	for _, s := range subscriptions {
+		s.notify(e)
+	}
+}
+
+// merge combines the changes of two consecutive events. Keys that changed
+// in both keep the old value of the first event and the new value of the
+// second, and are dropped if they changed back to their original value.
+func merge(first, second []Change) []Change {
+	byKey := make(map[string]Change, len(first)+len(second))
+	for _, c := range first {
+		byKey[c.Key] = c
+	}
+	for _, c := range second {
+		if prev, ok := byKey[c.Key]; ok {
+			c.Old, c.rawOld = prev.Old, prev.rawOld
+		}
+		byKey[c.Key] = c
+	}
+	result := make([]Change, 0, len(byKey))
+	for _, c := range byKey {
+		if !reflect.DeepEqual(c.rawOld, c.rawNew) {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+func hasPrefix(key, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+".")
+}
@@ -0,0 +1,208 @@
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError is an invalid setting.
+type FieldError struct {
+	Key     string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// ValidationErrors are all the invalid settings found by Cfg.Load().
+type ValidationErrors []*FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d invalid settings: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e ValidationErrors) Len() int           { return len(e) }
+func (e ValidationErrors) Less(i, j int) bool { return e[i].Key < e[j].Key }
+func (e ValidationErrors) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// qualify converts an error returned by a Validator to ValidationErrors
+// with keys relative to the root of the config.
+func qualify(section string, err error) ValidationErrors {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *FieldError:
+		return ValidationErrors{{Key: section + "." + e.Key, Message: e.Message}}
+	case ValidationErrors:
+		result := make(ValidationErrors, len(e))
+		for i, fe := range e {
+			result[i] = &FieldError{Key: section + "." + fe.Key, Message: fe.Message}
+		}
+		return result
+	}
+	return ValidationErrors{{Key: section, Message: err.Error()}}
+}
+
+// rule checks the value of a field, and returns an error if it is invalid.
+type rule func(v reflect.Value) error
+
+// parseRules parses a `validate` tag for a field of type t.
+func parseRules(tag string, t reflect.Type) ([]rule, error) {
+	var rules []rule
+	for tag != "" {
+		var part string
+		if strings.HasPrefix(tag, "regexp=") {
+			// the expression may contain commas, so it is always the last rule.
+			part, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			part, tag = tag[:i], tag[i+1:]
+		} else {
+			part, tag = tag, ""
+		}
+		name, arg := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, arg = part[:i], part[i+1:]
+		}
+		var r rule
+		var err error
+		switch name {
+		case "required":
+			r = checkRequired
+		case "min", "max":
+			r, err = boundCheck(name, arg, t)
+		case "oneof":
+			r = oneOfCheck(strings.Fields(arg))
+		case "regexp":
+			r, err = regexpCheck(arg)
+		default:
+			err = fmt.Errorf("unknown rule %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func checkRequired(v reflect.Value) error {
+	if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) ||
+		(v.Kind() == reflect.Slice && v.Len() == 0) {
+		return fmt.Errorf("is required")
+	}
+	return nil
+}
+
+// boundCheck returns a check for a min or max rule. Durations are compared
+// by value, as are numbers. Strings and lists are compared by length.
+func boundCheck(name, arg string, t reflect.Type) (rule, error) {
+	inRange := func(x, bound float64) bool {
+		if name == "min" {
+			return x >= bound
+		}
+		return x <= bound
+	}
+	relation := ">="
+	if name == "max" {
+		relation = "<="
+	}
+
+	if t == durationType {
+		bound, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q for %s", arg, name)
+		}
+		return func(v reflect.Value) error {
+			if !inRange(float64(v.Int()), float64(bound)) {
+				return fmt.Errorf("must be %s %s, got %s", relation, bound, time.Duration(v.Int()))
+			}
+			return nil
+		}, nil
+	}
+
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q for %s", arg, name)
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Slice:
+		return func(v reflect.Value) error {
+			if !inRange(float64(v.Len()), bound) {
+				return fmt.Errorf("length must be %s %s, got %d", relation, arg, v.Len())
+			}
+			return nil
+		}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) error {
+			if !inRange(float64(v.Int()), bound) {
+				return fmt.Errorf("must be %s %s, got %d", relation, arg, v.Int())
+			}
+			return nil
+		}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(v reflect.Value) error {
+			if !inRange(float64(v.Uint()), bound) {
+				return fmt.Errorf("must be %s %s, got %d", relation, arg, v.Uint())
+			}
+			return nil
+		}, nil
+	case reflect.Float32, reflect.Float64:
+		return func(v reflect.Value) error {
+			if !inRange(v.Float(), bound) {
+				return fmt.Errorf("must be %s %s, got %v", relation, arg, v.Float())
+			}
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%s is not supported for %s", name, t)
+}
+
+func oneOfCheck(values []string) rule {
+	return func(v reflect.Value) error {
+		s, shown := checkedString(v)
+		for _, allowed := range values {
+			if s == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s, got %q", strings.Join(values, ", "), shown)
+	}
+}
+
+func regexpCheck(expr string) (rule, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp %q. %s", expr, err)
+	}
+	return func(v reflect.Value) error {
+		s, shown := checkedString(v)
+		if !re.MatchString(s) {
+			return fmt.Errorf("must match %s, got %q", expr, shown)
+		}
+		return nil
+	}, nil
+}
+
+// checkedString returns the value that oneof and regexp check, and how it
+// is shown in errors. Secrets are checked by their value, not the redacted
+// string, but are still redacted in errors.
+func checkedString(v reflect.Value) (value, shown string) {
+	if v.Kind() != reflect.String {
+		value = fmt.Sprint(v.Interface())
+		return value, value
+	}
+	value = v.String()
+	if v.Type() == secretType && value != "" {
+		return value, Redacted
+	}
+	return value, value
+}
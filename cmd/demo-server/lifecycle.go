@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/registry"
+)
+
+// StartService starts a stopped service, along with any services it
+// depends on that are not running and any services that were stopped
+// because it was stopped.
+func (srv *CoreSrv) StartService(ctx context.Context, name string) error {
+	descriptor, err := srv.lookup(name)
+	if err != nil {
+		return err
+	}
+	srv.opMu.Lock()
+	defer srv.opMu.Unlock()
+	if srv.isShuttingDown() {
+		return fmt.Errorf("server is shutting down")
+	}
+	return srv.start(ctx, descriptor)
+}
+
+// StopService stops a service, after stopping the services that depend on
+// it. The rest of the services keep running.
+func (srv *CoreSrv) StopService(ctx context.Context, name string) error {
+	descriptor, err := srv.lookup(name)
+	if err != nil {
+		return err
+	}
+	srv.opMu.Lock()
+	defer srv.opMu.Unlock()
+	if srv.isShuttingDown() {
+		return fmt.Errorf("server is shutting down")
+	}
+	return srv.stop(ctx, descriptor)
+}
+
+// RestartService stops and then starts a service, along with the services
+// that depend on it. Init is not called again, as services may register
+// routes, metrics and config subscriptions in Init that can only be
+// registered once. Settings that are only read in Init need a restart of
+// the process to take effect.
+func (srv *CoreSrv) RestartService(ctx context.Context, name string) error {
+	descriptor, err := srv.lookup(name)
+	if err != nil {
+		return err
+	}
+	srv.opMu.Lock()
+	defer srv.opMu.Unlock()
+	if srv.isShuttingDown() {
+		return fmt.Errorf("server is shutting down")
+	}
+	if err := srv.stop(ctx, descriptor); err != nil {
+		return err
+	}
+	return srv.start(ctx, descriptor)
+}
+
+func (srv *CoreSrv) lookup(name string) (*registry.Descriptor, error) {
+	descriptor := registry.GetService(name)
+	if descriptor == nil {
+		return nil, fmt.Errorf("unknown service %s", name)
+	}
+	return descriptor, nil
+}
+
+// canStop returns true if the service can be stopped at runtime. Services
+// that are neither BackgroundServices nor can be disabled are core
+// components that other services rely on for the life of the process.
+func canStop(descriptor *registry.Descriptor) bool {
+	if _, ok := descriptor.BackgroundService(); ok {
+		return true
+	}
+	_, ok := descriptor.Instance.(registry.CanBeDisabled)
+	return ok
+}
+
+// start starts the service and then the services that were held back
+// because it was stopped. srv.opMu must be held.
+func (srv *CoreSrv) start(ctx context.Context, descriptor *registry.Descriptor) error {
+	if descriptor.IsDisabled() {
+		return fmt.Errorf("%s is disabled in config", descriptor.Name)
+	}
+	if err := srv.startOne(ctx, descriptor); err != nil {
+		return err
+	}
+	for _, dependent := range registry.Dependents(descriptor) {
+		srv.Lock()
+		held := srv.held[dependent]
+		srv.Unlock()
+		if !held || dependent.IsDisabled() {
+			continue
+		}
+		if err := srv.startOne(ctx, dependent); err != nil {
+			dependent.Logger().Errorf("Failed to start %s. reason: %s", dependent.Name, err)
+		}
+	}
+	return nil
+}
+
+// startOne starts a single service, after starting the services it depends
+// on. Services that have never been initialized, eg. because they were
+// disabled at startup, are initialized first. Services that were stopped
+// are not initialized again.
+func (srv *CoreSrv) startOne(ctx context.Context, descriptor *registry.Descriptor) error {
+	if descriptor.State() == registry.StateRunning {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, dep := range descriptor.Dependencies {
+		if dep.State() == registry.StateRunning {
+			continue
+		}
+		if dep.IsDisabled() {
+			descriptor.Logger().Warnf("%s depends on %s which is disabled", descriptor.Name, dep.Name)
+			continue
+		}
+		if err := srv.startOne(ctx, dep); err != nil {
+			return fmt.Errorf("could not start %s, which %s depends on. %s", dep.Name, descriptor.Name, err)
+		}
+	}
+
+	srv.Lock()
+	delete(srv.held, descriptor)
+	initialized := false
+	for _, d := range srv.initialized {
+		if d == descriptor {
+			initialized = true
+			break
+		}
+	}
+	srv.Unlock()
+
+	if !initialized {
+		descriptor.Logger().Info("Initializing " + descriptor.Name)
+		if err := srv.initService(descriptor); err != nil {
+			return fmt.Errorf("%s init failed. %s", descriptor.Name, err)
+		}
+	}
+	if _, ok := descriptor.BackgroundService(); ok {
+		srv.launch(descriptor)
+	} else {
+		descriptor.SetState(registry.StateRunning)
+	}
+	descriptor.Logger().Info("Started " + descriptor.Name)
+	return nil
+}
+
+// stop stops the services that depend on the service, in the reverse
+// order they were started in, then the service itself. srv.opMu must be
+// held.
+func (srv *CoreSrv) stop(ctx context.Context, descriptor *registry.Descriptor) error {
+	if !canStop(descriptor) {
+		return fmt.Errorf("%s can not be stopped at runtime", descriptor.Name)
+	}
+	dependents := registry.Dependents(descriptor)
+	for _, dependent := range dependents {
+		if dependent.State() == registry.StateRunning && !canStop(dependent) {
+			return fmt.Errorf("%s can not be stopped as %s depends on it", descriptor.Name, dependent.Name)
+		}
+	}
+	for i := len(dependents) - 1; i >= 0; i-- {
+		dependent := dependents[i]
+		if dependent.State() != registry.StateRunning {
+			continue
+		}
+		dependent.Logger().Infof("Stopping %s as it depends on %s", dependent.Name, descriptor.Name)
+		if err := srv.stopOne(ctx, dependent); err != nil {
+			return err
+		}
+		srv.Lock()
+		srv.held[dependent] = true
+		srv.Unlock()
+	}
+	return srv.stopOne(ctx, descriptor)
+}
+
+func (srv *CoreSrv) stopOne(ctx context.Context, descriptor *registry.Descriptor) error {
+	if descriptor.State() != registry.StateRunning {
+		return nil
+	}
+	descriptor.Logger().Info("Stopping " + descriptor.Name)
+	descriptor.SetState(registry.StateStopping)
+	if err := srv.stopService(ctx, descriptor); err != nil {
+		descriptor.RecordFailure(err)
+		descriptor.SetState(registry.StateFailed)
+		return fmt.Errorf("failed to stop %s. %s", descriptor.Name, err)
+	}
+	descriptor.SetState(registry.StateStopped)
+	return nil
+}
+
+// configChanged starts the services that have been enabled in config, and
+// stops the services that have been disabled.
+func (srv *CoreSrv) configChanged(e cfg.ChangeEvent) {
+	enabledChanged := false
+	for _, c := range e.Changes {
+		if strings.HasSuffix(c.Key, ".enabled") {
+			enabledChanged = true
+			break
+		}
+	}
+	if !enabledChanged {
+		return
+	}
+
+	srv.opMu.Lock()
+	defer srv.opMu.Unlock()
+	if srv.isShuttingDown() {
+		return
+	}
+	ctx := context.Background()
+	for _, descriptor := range registry.GetServices() {
+		if _, ok := descriptor.Instance.(registry.CanBeDisabled); !ok {
+			continue
+		}
+		state := descriptor.State()
+		switch {
+		case descriptor.IsDisabled() && state != registry.StateDisabled:
+			descriptor.Logger().Infof("%s has been disabled", descriptor.Name)
+			if err := srv.stop(ctx, descriptor); err != nil {
+				descriptor.Logger().Errorf("Failed to stop %s. reason: %s", descriptor.Name, err)
+				continue
+			}
+			descriptor.SetState(registry.StateDisabled)
+		case !descriptor.IsDisabled() && state == registry.StateDisabled:
+			descriptor.Logger().Infof("%s has been enabled", descriptor.Name)
+			if err := srv.start(ctx, descriptor); err != nil {
+				descriptor.Logger().Errorf("Failed to start %s. reason: %s", descriptor.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/registry"
+)
+
+// checkStates checks the state of each service, by name.
+func checkStates(t *testing.T, f *fakeServices, want map[string]registry.ServiceState) {
+	t.Helper()
+	for name, state := range want {
+		if got := f.d[name].State(); got != state {
+			t.Errorf("%s is %s, want %s", name, got, state)
+		}
+	}
+}
+
+// lifecycleEvents returns the init and stop events. Background services
+// run concurrently, so the order of the run events is not checked.
+func lifecycleEvents(rec *recorder) []string {
+	var events []string
+	for _, e := range rec.list() {
+		if !strings.HasPrefix(e, "run ") {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestStopAndStartService(t *testing.T) {
+	f := registerFakes(t)
+	srv := startSrv(t, f, nil)
+	ctx := context.Background()
+	f.rec.reset()
+
+	// the worker depends on the cache, so it is stopped first.
+	if err := srv.StopService(ctx, "Cache"); err != nil {
+		t.Fatal(err)
+	}
+	if events := lifecycleEvents(f.rec); strings.Join(events, ",") != "stop Worker,stop Cache" {
+		t.Errorf("got events %q, want %q", events, []string{"stop Worker", "stop Cache"})
+	}
+	checkStates(t, f, map[string]registry.ServiceState{
+		"Store":  registry.StateRunning,
+		"Cache":  registry.StateStopped,
+		"Worker": registry.StateStopped,
+	})
+
+	// starting the cache starts the worker that was stopped with it. The
+	// services are not initialized again.
+	f.rec.reset()
+	if err := srv.StartService(ctx, "Cache"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "Worker to run", func() bool { return f.d["Worker"].State() == registry.StateRunning })
+	checkStates(t, f, map[string]registry.ServiceState{"Cache": registry.StateRunning})
+	if events := lifecycleEvents(f.rec); len(events) != 0 {
+		t.Errorf("unexpected events %q", events)
+	}
+}
+
+func TestStartServiceStartsDependencies(t *testing.T) {
+	f := registerFakes(t)
+	srv := startSrv(t, f, nil)
+	ctx := context.Background()
+	if err := srv.StopService(ctx, "Cache"); err != nil {
+		t.Fatal(err)
+	}
+
+	// starting the worker starts the cache it depends on.
+	if err := srv.StartService(ctx, "Worker"); err != nil {
+		t.Fatal(err)
+	}
+	checkStates(t, f, map[string]registry.ServiceState{
+		"Cache":  registry.StateRunning,
+		"Worker": registry.StateRunning,
+	})
+}
+
+func TestRestartService(t *testing.T) {
+	f := registerFakes(t)
+	srv := startSrv(t, f, nil)
+	f.rec.reset()
+	if err := srv.RestartService(context.Background(), "Cache"); err != nil {
+		t.Fatal(err)
+	}
+	// Init is not called again on a restart.
+	if events := lifecycleEvents(f.rec); strings.Join(events, ",") != "stop Worker,stop Cache" {
+		t.Errorf("got events %q, want %q", events, []string{"stop Worker", "stop Cache"})
+	}
+	checkStates(t, f, map[string]registry.ServiceState{
+		"Cache":  registry.StateRunning,
+		"Worker": registry.StateRunning,
+	})
+}
+
+func TestServiceActionErrors(t *testing.T) {
+	f := registerFakes(t)
+	srv := startSrv(t, f, nil)
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		action func(context.Context, string) error
+		err    string
+	}{
+		{"Store", srv.StopService, "Store can not be stopped at runtime"},
+		{"Store", srv.RestartService, "Store can not be stopped at runtime"},
+		{"Nope", srv.StartService, "unknown service Nope"},
+	}
+	for _, tt := range tests {
+		if err := tt.action(ctx, tt.name); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+
+	if err := srv.StopService(ctx, "Cache"); err != nil {
+		t.Fatal(err)
+	}
+	f.cache.setDisabled(true)
+	if err := srv.StartService(ctx, "Cache"); err == nil || err.Error() != "Cache is disabled in config" {
+		t.Errorf("got error %v starting a disabled service", err)
+	}
+	checkStates(t, f, map[string]registry.ServiceState{"Store": registry.StateRunning})
+}
+
+func TestEnabledChanged(t *testing.T) {
+	f := registerFakes(t)
+	srv := startSrv(t, f, nil)
+	changed := func(key string) {
+		srv.configChanged(cfg.ChangeEvent{Changes: []cfg.Change{{Key: key}}})
+	}
+
+	// only changes to an enabled setting start or stop services.
+	f.cache.setDisabled(true)
+	changed("cache.size")
+	checkStates(t, f, map[string]registry.ServiceState{"Cache": registry.StateRunning})
+
+	changed("cache.enabled")
+	checkStates(t, f, map[string]registry.ServiceState{
+		"Store":  registry.StateRunning,
+		"Cache":  registry.StateDisabled,
+		"Worker": registry.StateStopped,
+	})
+
+	f.cache.setDisabled(false)
+	changed("cache.enabled")
+	waitFor(t, "Worker to run", func() bool { return f.d["Worker"].State() == registry.StateRunning })
+	checkStates(t, f, map[string]registry.ServiceState{"Cache": registry.StateRunning})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/registry"
+)
+
+func init() {
+	cfg.RegisterSection("log", &LogConfig{})
+}
+
+// LogConfig holds the log settings.
+type LogConfig struct {
+	// text, or json for one object per line, eg. for log aggregators.
+	Format string `cfg:"format,static" default:"text" validate:"oneof=text json"`
+	// level of the services that do not have a level of their own.
+	Level string `cfg:"level" default:"info" validate:"oneof=debug info warn warning error fatal panic"`
+	// levels of individual services, eg. worker-a: debug. Service names
+	// are matched ignoring case and dashes.
+	Levels map[string]string `cfg:"levels" validate:"oneof=debug info warn warning error fatal panic"`
+}
+
+func (c *LogConfig) Validate() error {
+	var errs cfg.ValidationErrors
+	for name := range c.Levels {
+		if serviceByKey(name) == nil {
+			errs = append(errs, &cfg.FieldError{Key: "levels." + name, Message: "unknown service"})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// serviceByKey returns the service for a config key, eg. worker-a for
+// WorkerA, or nil if there is none.
+func serviceByKey(key string) *registry.Descriptor {
+	return registry.GetService(strings.Replace(key, "-", "", -1))
+}
+
+// loggers holds the logger of each service. The loggers write to the
+// output of the standard logger with its formatter, but each has its own
+// level so that a single noisy service can be turned up or down.
+type loggers struct {
+	byService map[*registry.Descriptor]*log.Logger
+	conf      *LogConfig
+	sync.Mutex
+}
+
+func newLoggers() *loggers {
+	return &loggers{
+		byService: make(map[*registry.Descriptor]*log.Logger),
+		conf:      &LogConfig{},
+	}
+}
+
+// entry returns the logger of the service, with the service field set to
+// the name of the service.
+func (l *loggers) entry(d *registry.Descriptor) *log.Entry {
+	std := log.StandardLogger()
+	logger := &log.Logger{
+		Out:       std.Out,
+		Formatter: std.Formatter,
+		Hooks:     std.Hooks,
+	}
+	l.Lock()
+	logger.SetLevel(l.levelOf(d))
+	l.byService[d] = logger
+	l.Unlock()
+	return logger.WithField("service", d.Name)
+}
+
+// configure sets the format of the standard logger, and the levels of all
+// loggers. It must be called before the service loggers are created, as
+// the format can not be changed afterwards.
+func (l *loggers) configure(conf *LogConfig) {
+	if conf.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	l.setLevels(conf)
+}
+
+// setLevels sets the level of the standard logger and of each service
+// logger.
+func (l *loggers) setLevels(conf *LogConfig) {
+	l.Lock()
+	defer l.Unlock()
+	l.conf = conf
+	// the levels were validated by LogConfig.
+	level, _ := log.ParseLevel(conf.Level)
+	log.SetLevel(level)
+	for d, logger := range l.byService {
+		logger.SetLevel(l.levelOf(d))
+	}
+}
+
+// levelOf returns the level of the service. l must be locked.
+func (l *loggers) levelOf(d *registry.Descriptor) log.Level {
+	for name, lvl := range l.conf.Levels {
+		if serviceByKey(name) == d {
+			level, _ := log.ParseLevel(lvl)
+			return level
+		}
+	}
+	return log.GetLevel()
+}
+
+// logConfigChanged applies changes to the log levels.
+func (srv *CoreSrv) logConfigChanged(e cfg.ChangeEvent) {
+	conf := srv.cfg.Section("log").(*LogConfig)
+	srv.loggers.setLevels(conf)
+	log.Infof("log levels changed. level: %s, service levels: %v", conf.Level, conf.Levels)
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/woodsaj/go-server/cfg"
 
 	// self registering services
 	_ "github.com/woodsaj/go-server/api"
@@ -29,34 +32,83 @@ func init() {
 
 }
 
+// overrides collects repeated "-set key=value" flags.
+type overrides map[string]string
+
+func (o overrides) String() string {
+	pairs := make([]string, 0, len(o))
+	for key, value := range o {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (o overrides) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value")
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
+
 func main() {
 	var logLevel string
+	var logFormat string
 	var confDir string
-	flag.StringVar(&logLevel, "log-level", "info", "One of debug,info,warn,error,fatal,panic")
+	var explain string
+	set := make(overrides)
+	flag.StringVar(&logLevel, "log-level", "info", "One of debug,info,warn,error,fatal,panic. Used if the config does not set log.level")
+	flag.StringVar(&logFormat, "log-format", "text", "One of text,json. Used if the config does not set log.format")
 	flag.StringVar(&confDir, "config-dir", "/etc/demo", "path to configuration dir")
+	flag.Var(set, "set", "override a setting, eg. -set worker-a.data=foo. May be repeated")
+	flag.StringVar(&explain, "explain", "", "print where the settings with the given key prefix come from and exit. Use \"all\" for every setting")
 	flag.Parse()
 
-	lvl, err := log.ParseLevel(logLevel)
-	if err != nil {
-		log.Fatal(err)
+	// the log flags replace the defaults when they are given, so the config
+	// can still set and reload the levels. Use -set to override the config.
+	defaults := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "log-level":
+			defaults["log.level"] = logLevel
+		case "log-format":
+			defaults["log.format"] = logFormat
+		}
+	})
+
+	// initialize our config. Settings are read from the log flags, then
+	// config.yaml, then conf.d/*.yaml, then DEMO_* environment variables and
+	// then -set flags.
+	sources := cfg.Sources{
+		Dirs:      []string{filepath.Join(confDir, "conf.d")},
+		EnvPrefix: "DEMO",
+		Defaults:  defaults,
+		Overrides: set,
+	}
+	for _, ext := range viper.SupportedExts {
+		file := filepath.Join(confDir, "config."+ext)
+		if _, err := os.Stat(file); err == nil {
+			sources.Files = []string{file}
+			break
+		}
 	}
-	log.SetLevel(lvl)
-
-	// initialize our config
-	if _, err := os.Stat(confDir); err == nil {
-		viper.SetConfigName("config")
-		viper.AddConfigPath(confDir)
-		err := viper.ReadInConfig()
-		if err != nil {
-			log.Fatal(err)
+	config := cfg.New(sources)
+
+	if explain != "" {
+		if explain == "all" {
+			explain = ""
+		}
+		if err := config.Load(); err != nil {
+			log.Fatalf("Invalid config: %v", err)
 		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(config.Provenance(explain))
+		return
 	}
-	viper.SetEnvPrefix("DEMO")
-	viper.AutomaticEnv()
-	replacer := strings.NewReplacer("-", "_", ".", "_")
-	viper.SetEnvKeyReplacer(replacer)
 
-	srv := NewCoreSrv()
+	srv := NewCoreSrv(config)
 	go listenToSystemSignals(srv)
 
 	log.Exit(srv.Exit(srv.Run()))
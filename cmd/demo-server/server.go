@@ -2,52 +2,128 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/facebookgo/inject"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/metrics"
 	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
 	"golang.org/x/sync/errgroup"
 )
 
+func init() {
+	// maximum time allowed for all services to stop
+	cfg.SetDefault("shutdown.timeout", time.Second*30)
+	// maximum time allowed for each individual service to stop
+	cfg.SetDefault("shutdown.service-timeout", time.Second*10)
+	// maximum time services that need to warm up may take to become ready.
+	// 0 disables the deadline. Services can set their own deadline.
+	cfg.SetStaticDefault("startup.ready-timeout", time.Duration(0))
+	// what happens when a service is not ready in time. one of fail, degraded or fallback
+	cfg.SetStaticDefault("startup.ready-policy", "degraded")
+}
+
 type CoreSrv struct {
 	context            context.Context
 	shutdownFn         context.CancelFunc
 	childRoutines      *errgroup.Group
 	shutdownReason     string
 	shutdownInProgress bool
+	cfg                *cfg.Cfg
+	metrics            *metrics.Registry
+	initDuration       *metrics.Gauge
+	loggers            *loggers
+	tracer             *tracing.Tracer
+
+	// initialized holds the services that have been initialized, in the
+	// order they were initialized in.
+	initialized []*registry.Descriptor
+	running     map[*registry.Descriptor]*runningService
+	// held are the services that were stopped because a service they
+	// depend on was stopped. They are started again along with it.
+	held map[*registry.Descriptor]bool
+	// stopped is closed once Shutdown() has completed.
+	stopped         chan struct{}
+	defaultDeadline registry.StartDeadline
+	sync.Mutex
+	// opMu ensures services are only started or stopped by one operation
+	// at a time, including startup and shutdown.
+	opMu sync.Mutex
+}
+
+// runningService tracks the Run() call of a background service.
+type runningService struct {
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func NewCoreSrv() *CoreSrv {
+func NewCoreSrv(config *cfg.Cfg) *CoreSrv {
 	rootCtx, shutdownFn := context.WithCancel(context.Background())
-	childRoutines, childCtx := errgroup.WithContext(rootCtx)
 	return &CoreSrv{
-		context:       childCtx,
+		context:       rootCtx,
 		shutdownFn:    shutdownFn,
-		childRoutines: childRoutines,
+		childRoutines: &errgroup.Group{},
+		cfg:           config,
+		metrics:       metrics.New(),
+		loggers:       newLoggers(),
+		running:       make(map[*registry.Descriptor]*runningService),
+		held:          make(map[*registry.Descriptor]bool),
+		stopped:       make(chan struct{}),
 	}
 }
 
 func (srv *CoreSrv) Run() error {
 	serviceGraph := inject.Graph{}
 
-	config := cfg.New(viper.GetViper())
+	config := srv.cfg
+	// fail on invalid settings before any service is initialized
+	if err := config.Load(); err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
 	config.Watch()
+	srv.loggers.configure(config.Section("log").(*LogConfig))
+	config.Subscribe("log", srv.logConfigChanged)
+
+	tracer, err := newTracer(config.Section("tracing").(*TracingConfig))
+	if err != nil {
+		return err
+	}
+	srv.tracer = tracer
+	defer srv.shutdownTracer()
 
 	// inject our config into each service
 	// This allows us to just simply provide direct configuration to each service if we dont
 	// want to use a configFile, EnvVars or cmdLine args
 	serviceGraph.Provide(&inject.Object{Value: config})
 
-	// inject our logger
+	// inject our logger. Services get their own *logrus.Entry, with the
+	// service field set, when they are added to the graph. Other objects
+	// created by the graph get an entry of the standard logger.
 	serviceGraph.Provide(&inject.Object{Value: log.StandardLogger()})
+	serviceGraph.Provide(&inject.Object{Value: log.NewEntry(log.StandardLogger())})
+
+	// inject our metrics, so services can register their own
+	serviceGraph.Provide(&inject.Object{Value: srv.metrics})
+
+	// inject our tracer, so services can trace their work
+	serviceGraph.Provide(&inject.Object{Value: srv.tracer})
+	srv.registerMetrics()
+
+	// services can start and stop other services through registry.Lifecycle
+	serviceGraph.Provide(&inject.Object{Value: srv})
 
-	services := registry.GetServices()
 	// Add all services to dependency graph
-	for _, service := range services {
-		service.Inject(&serviceGraph)
+	for _, service := range registry.GetServices() {
+		service.SetLogger(srv.loggers.entry(service))
+		if err := service.Inject(&serviceGraph); err != nil {
+			return fmt.Errorf("Failed to add service to dependency graph: %v", err)
+		}
 	}
 
 	// Inject dependencies to services
@@ -55,76 +131,330 @@ func (srv *CoreSrv) Run() error {
 		return fmt.Errorf("Failed to populate service dependency: %v", err)
 	}
 
+	// Order services so that they are initialized after their dependencies
+	services, err := registry.Resolve()
+	if err != nil {
+		return fmt.Errorf("Failed to resolve service dependencies: %v", err)
+	}
+
+	srv.defaultDeadline, err = srv.defaultStartDeadline()
+	if err != nil {
+		return err
+	}
+
 	// Init & start services
+	srv.opMu.Lock()
 	for _, service := range services {
 		if service.IsDisabled() {
+			service.SetState(registry.StateDisabled)
 			continue
 		}
+		if srv.isShuttingDown() {
+			srv.opMu.Unlock()
+			<-srv.stopped
+			return nil
+		}
 
-		log.Info("Initializing " + service.Name)
+		service.Logger().Info("Initializing " + service.Name)
+		for _, dep := range service.Dependencies {
+			if dep.IsDisabled() {
+				service.Logger().Warnf("%s depends on %s which is disabled", service.Name, dep.Name)
+			}
+		}
 
-		if err := service.Instance.Init(); err != nil {
+		if err := srv.initService(service); err != nil {
+			srv.opMu.Unlock()
+			// stop the services that were already initialized.
+			srv.Shutdown(fmt.Sprintf("%s failed to initialize", service.Name))
 			return fmt.Errorf("Service init failed: %v", err)
 		}
 	}
 
-	// Start background services
-	for _, svc := range services {
-		// variable needed for accessing loop variable in function callback
-		descriptor := svc
-		service, ok := descriptor.BackgroundService()
-		if !ok {
+	// Verify services before any of them are running in the background
+	for _, service := range services {
+		verifier, ok := service.Verifier()
+		if !ok || service.IsDisabled() {
 			continue
 		}
+		if err := verifier.Verify(); err != nil {
+			srv.opMu.Unlock()
+			srv.Shutdown(fmt.Sprintf("%s verification failed", service.Name))
+			return fmt.Errorf("Service verification failed: %v", err)
+		}
+	}
 
+	// Start background services
+	for _, descriptor := range services {
+		if _, ok := descriptor.BackgroundService(); !ok {
+			continue
+		}
 		if descriptor.IsDisabled() {
 			continue
 		}
+		srv.launch(descriptor)
+	}
+	srv.opMu.Unlock()
+
+	// start and stop services when they are enabled or disabled.
+	config.Subscribe("", srv.configChanged)
 
-		srv.childRoutines.Go(func() error {
-			// Skip starting new service when shutting down
-			// Can happen when service stop/return during startup
-			if srv.shutdownInProgress {
-				return nil
+	// services can be stopped and started again at runtime, so keep
+	// running until shutdown, then let the shutdown of the remaining
+	// services finish before returning.
+	<-srv.context.Done()
+	err = srv.childRoutines.Wait()
+	<-srv.stopped
+	return err
+}
+
+// initService calls Init() on the service. Services that are not
+// BackgroundServices are running once they have been initialized.
+func (srv *CoreSrv) initService(descriptor *registry.Descriptor) error {
+	descriptor.SetState(registry.StateInitializing)
+	start := time.Now()
+	err := descriptor.Instance.Init()
+	srv.initDuration.Set(time.Since(start).Seconds(), descriptor.Name)
+	if err != nil {
+		descriptor.RecordFailure(err)
+		descriptor.SetState(registry.StateFailed)
+		return err
+	}
+	srv.Lock()
+	srv.initialized = append(srv.initialized, descriptor)
+	srv.Unlock()
+	if _, ok := descriptor.BackgroundService(); !ok {
+		descriptor.SetState(registry.StateRunning)
+	}
+	return nil
+}
+
+// launch runs a background service in its own goroutine.
+func (srv *CoreSrv) launch(descriptor *registry.Descriptor) {
+	// each service gets its own context so that services can be
+	// stopped one at a time.
+	ctx, cancel := context.WithCancel(srv.context)
+	rs := &runningService{cancel: cancel, done: make(chan struct{})}
+	srv.Lock()
+	srv.running[descriptor] = rs
+	srv.Unlock()
+	descriptor.SetState(registry.StateRunning)
+
+	srv.childRoutines.Go(func() error {
+		defer close(rs.done)
+		defer cancel()
+
+		// Skip starting new service when shutting down
+		// Can happen when service stop/return during startup
+		if srv.isShuttingDown() {
+			return nil
+		}
+
+		// The supervisor restarts the service according to its restart
+		// policy, and only returns an error once it has given up.
+		err := descriptor.Supervise(ctx)
+
+		if err != nil {
+			descriptor.Logger().Error("Stopped "+descriptor.Name, ". reason: ", err)
+		} else {
+			descriptor.Logger().Info("Stopped "+descriptor.Name, ". reason: ", err)
+		}
+
+		srv.Lock()
+		if srv.running[descriptor] == rs {
+			delete(srv.running, descriptor)
+		}
+		srv.Unlock()
+		finished := false
+		if err != nil {
+			descriptor.SetState(registry.StateFailed)
+		} else if descriptor.State() == registry.StateRunning {
+			// Run() returned without being asked to stop.
+			descriptor.SetState(registry.StateStopped)
+			finished = true
+		}
+
+		// A failed service brings down the rest of the services in
+		// an orderly way, as does a service without a restart policy
+		// that has finished. Services that are restarted on failure
+		// are left stopped when they finish.
+		if !srv.isShuttingDown() {
+			if err != nil {
+				go srv.Shutdown(fmt.Sprintf("%s failed", descriptor.Name))
+			} else if finished && descriptor.RestartPolicy.Mode == registry.RestartNever {
+				go srv.Shutdown(fmt.Sprintf("%s stopped", descriptor.Name))
 			}
+		}
+		return err
+	})
 
-			err := service.Run(srv.context)
+	if _, ok := descriptor.ReadyNotifier(); ok {
+		go srv.watchStartDeadline(ctx, descriptor, srv.defaultDeadline)
+	}
+}
 
-			// If error is not canceled then the service crashed
-			if err != context.Canceled && err != nil {
-				log.Error("Stopped "+descriptor.Name, ". reason: ", err)
-			} else {
-				log.Info("Stopped "+descriptor.Name, ". reason: ", err)
+// registerMetrics registers the metrics of the services and of the config.
+func (srv *CoreSrv) registerMetrics() {
+	states := []registry.ServiceState{
+		registry.StateDisabled,
+		registry.StateInitializing,
+		registry.StateRunning,
+		registry.StateStopping,
+		registry.StateStopped,
+		registry.StateFailed,
+	}
+	srv.metrics.GaugeFunc("service_state", "1 for the current lifecycle state of each service, 0 for the other states.", []string{"service", "state"}, func(emit func(float64, ...string)) {
+		for _, d := range registry.GetServices() {
+			current := d.State()
+			for _, state := range states {
+				emit(metrics.BoolValue(state == current), d.Name, string(state))
 			}
+		}
+	})
+	srv.metrics.CounterFunc("service_restarts_total", "Restarts of each service by its supervisor.", []string{"service"}, func(emit func(float64, ...string)) {
+		for _, d := range registry.GetServices() {
+			emit(float64(d.Status().Restarts), d.Name)
+		}
+	})
+	srv.initDuration = srv.metrics.Gauge("service_init_duration_seconds", "Time taken by the last Init() call of each service.", "service")
+
+	srv.metrics.CounterFunc("config_reloads_total", "Config reloads, by result.", []string{"result"}, func(emit func(float64, ...string)) {
+		status := srv.cfg.ReloadStatus()
+		emit(float64(status.Reloads), "applied")
+		emit(float64(status.Failures), "rejected")
+	})
+	srv.metrics.GaugeFunc("config_revision", "Revision of the current config.", nil, func(emit func(float64, ...string)) {
+		emit(float64(srv.cfg.Revision()))
+	})
+	srv.metrics.CounterFunc("tracing_spans_total", "Spans handed to the exporter, by result.", []string{"result"}, func(emit func(float64, ...string)) {
+		exported, dropped := srv.tracer.Stats()
+		emit(float64(exported), "exported")
+		emit(float64(dropped), "dropped")
+	})
+	srv.metrics.GaugeFunc("config_restart_required", "1 if changes to static settings are waiting for a restart.", nil, func(emit func(float64, ...string)) {
+		emit(metrics.BoolValue(len(srv.cfg.PendingRestart()) > 0))
+	})
+}
 
-			// Mark that we are in shutdown mode
-			// So more services are not started
-			srv.shutdownInProgress = true
-			return err
-		})
+func (srv *CoreSrv) defaultStartDeadline() (registry.StartDeadline, error) {
+	policy, err := registry.ParseDeadlinePolicy(srv.cfg.GetString("startup.ready-policy"))
+	if err != nil {
+		return registry.StartDeadline{}, fmt.Errorf("startup.ready-policy: %s", err)
 	}
+	return registry.StartDeadline{
+		Timeout: srv.cfg.GetDuration("startup.ready-timeout"),
+		Policy:  policy,
+	}, nil
+}
 
-	return srv.childRoutines.Wait()
+// watchStartDeadline shuts down the server if the service is not ready
+// within its start deadline and the deadline policy is DeadlineFail.
+func (srv *CoreSrv) watchStartDeadline(ctx context.Context, descriptor *registry.Descriptor, deadline registry.StartDeadline) {
+	if d, ok := descriptor.StartDeadliner(); ok {
+		deadline = d.StartDeadline()
+	}
+	err := descriptor.AwaitReady(ctx, deadline)
+	if err != nil && deadline.Policy == registry.DeadlineFail && !srv.isShuttingDown() {
+		srv.Shutdown(err.Error())
+	}
 }
 
+func (srv *CoreSrv) isShuttingDown() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.shutdownInProgress
+}
+
+// Shutdown stops all services in the reverse order that they were
+// initialized in, so that services are stopped before the services
+// they depend on.
 func (srv *CoreSrv) Shutdown(reason string) {
+	srv.Lock()
+	if srv.shutdownInProgress {
+		srv.Unlock()
+		return
+	}
 	log.Info("Shutdown started. reason: ", reason)
 	srv.shutdownReason = reason
 	srv.shutdownInProgress = true
+	srv.Unlock()
+
+	// wait for any service that is being started or stopped.
+	srv.opMu.Lock()
+	defer srv.opMu.Unlock()
+	srv.Lock()
+	initialized := make([]*registry.Descriptor, len(srv.initialized))
+	copy(initialized, srv.initialized)
+	srv.Unlock()
+
+	timeout := srv.cfg.GetDuration("shutdown.timeout")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var failed []string
+	for i := len(initialized) - 1; i >= 0; i-- {
+		descriptor := initialized[i]
+		if state := descriptor.State(); state == registry.StateStopped || state == registry.StateDisabled {
+			continue
+		}
+		descriptor.Logger().Info("Stopping " + descriptor.Name)
+		descriptor.SetState(registry.StateStopping)
+		if err := srv.stopService(ctx, descriptor); err != nil {
+			descriptor.Logger().Errorf("Failed to stop %s. reason: %s", descriptor.Name, err)
+			failed = append(failed, descriptor.Name)
+			descriptor.SetState(registry.StateFailed)
+			continue
+		}
+		descriptor.SetState(registry.StateStopped)
+	}
+	if len(failed) > 0 {
+		log.Errorf("Services that did not stop cleanly within the shutdown timeout of %s: %s", timeout, strings.Join(failed, ", "))
+	}
 
 	// call cancel func on root context
 	srv.shutdownFn()
 
 	// wait for child routines
 	srv.childRoutines.Wait()
+	close(srv.stopped)
+}
+
+// stopService calls Stop() on the service if it is Stoppable, then cancels
+// the context passed to its Run() method and waits for Run() to return.
+// The service is given at most shutdown.service-timeout to stop, but never
+// longer than the deadline of ctx.
+func (srv *CoreSrv) stopService(ctx context.Context, descriptor *registry.Descriptor) error {
+	timeout := srv.cfg.GetDuration("shutdown.service-timeout")
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stopErr error
+	if service, ok := descriptor.Stoppable(); ok {
+		stopErr = service.Stop(ctx)
+	}
+
+	srv.Lock()
+	rs, ok := srv.running[descriptor]
+	srv.Unlock()
+	if ok {
+		rs.cancel()
+		select {
+		case <-rs.done:
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not stop in time", descriptor.Name)
+		}
+	}
+	return stopErr
 }
 
 func (srv *CoreSrv) Exit(reason error) int {
 	// default exit code is 1
 	code := 1
 
-	if (reason == nil || reason == context.Canceled) && srv.shutdownReason != "" {
-		reason = fmt.Errorf(srv.shutdownReason)
+	srv.Lock()
+	shutdownReason := srv.shutdownReason
+	srv.Unlock()
+	if (reason == nil || reason == context.Canceled) && shutdownReason != "" {
+		reason = errors.New(shutdownReason)
 		code = 0
 	}
 
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/components"
+	"github.com/woodsaj/go-server/registry"
+	"gopkg.in/macaron.v1"
+)
+
+// recorder collects the lifecycle calls made on the fake services.
+type recorder struct {
+	events []string
+	sync.Mutex
+}
+
+func (r *recorder) add(event string) {
+	r.Lock()
+	r.events = append(r.events, event)
+	r.Unlock()
+}
+
+func (r *recorder) list() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recorder) reset() {
+	r.Lock()
+	r.events = nil
+	r.Unlock()
+}
+
+// fake is embedded by the fake services. Each fake service needs its own
+// type, as the inject graph only allows one unnamed object per type.
+type fake struct {
+	name    string
+	rec     *recorder
+	initErr error
+}
+
+func (f *fake) Init() error {
+	f.rec.add("init " + f.name)
+	return f.initErr
+}
+
+func (f *fake) Stop(ctx context.Context) error {
+	f.rec.add("stop " + f.name)
+	return nil
+}
+
+// fakeStore is a core service that every other fake depends on.
+type fakeStore struct {
+	fake
+}
+
+// fakeCache is a background service that can be disabled.
+type fakeCache struct {
+	fake
+	Store *fakeStore `inject:""`
+
+	disabled bool
+	// run is called by Run if set. Otherwise Run blocks until ctx is done.
+	run func(ctx context.Context) error
+	sync.Mutex
+}
+
+func (f *fakeCache) IsDisabled() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.disabled
+}
+
+func (f *fakeCache) setDisabled(disabled bool) {
+	f.Lock()
+	f.disabled = disabled
+	f.Unlock()
+}
+
+func (f *fakeCache) Run(ctx context.Context) error {
+	f.rec.add("run " + f.name)
+	if f.run != nil {
+		return f.run(ctx)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// fakeWorker is a background service that depends on the cache.
+type fakeWorker struct {
+	fake
+	Cache *fakeCache `inject:""`
+}
+
+func (f *fakeWorker) Run(ctx context.Context) error {
+	f.rec.add("run " + f.name)
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeWorker) RegisterRoutes(r *components.RouteGroup) {
+	r.Get("/worker", func(ctx *macaron.Context) {})
+}
+
+// fakeRouted is a service that serves a route at path.
+type fakeRouted struct {
+	fake
+	path string
+}
+
+func (f *fakeRouted) RegisterRoutes(r *components.RouteGroup) {
+	r.Get(f.path, func(ctx *macaron.Context) {})
+}
+
+// fakeLate is a background service that is ready once ready is closed.
+type fakeLate struct {
+	fake
+	ready    chan struct{}
+	deadline registry.StartDeadline
+}
+
+func (f *fakeLate) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeLate) Ready() <-chan struct{} {
+	return f.ready
+}
+
+func (f *fakeLate) StartDeadline() registry.StartDeadline {
+	return f.deadline
+}
+
+type fakeServices struct {
+	rec    *recorder
+	store  *fakeStore
+	cache  *fakeCache
+	worker *fakeWorker
+	// descriptors by name.
+	d map[string]*registry.Descriptor
+}
+
+// registerFakes replaces the registered services with the fake store,
+// cache and worker for the duration of the test.
+func registerFakes(t *testing.T) *fakeServices {
+	rec := &recorder{}
+	f := &fakeServices{
+		rec:    rec,
+		store:  &fakeStore{fake{name: "Store", rec: rec}},
+		cache:  &fakeCache{fake: fake{name: "Cache", rec: rec}},
+		worker: &fakeWorker{fake: fake{name: "Worker", rec: rec}},
+		d:      make(map[string]*registry.Descriptor),
+	}
+	saved := registry.SetServices(nil)
+	t.Cleanup(func() { registry.SetServices(saved) })
+	for _, d := range []*registry.Descriptor{
+		{Name: "Worker", Instance: f.worker, InitPriority: registry.High},
+		{Name: "Cache", Instance: f.cache},
+		{Name: "Store", Instance: f.store},
+	} {
+		registry.Register(d)
+		f.d[d.Name] = d
+	}
+	return f
+}
+
+// startSrv runs a server with the given setting overrides until the test
+// ends, and returns once all background services are running.
+func startSrv(t *testing.T, f *fakeServices, overrides map[string]string) *CoreSrv {
+	srv := NewCoreSrv(cfg.New(cfg.Sources{Overrides: overrides}))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Run()
+	}()
+	t.Cleanup(func() {
+		srv.Shutdown("test done")
+		if err := <-errc; err != nil {
+			t.Errorf("Run() returned %s", err)
+		}
+	})
+	waitFor(t, "background services to start", func() bool {
+		for _, d := range f.d {
+			if _, ok := d.BackgroundService(); ok && !d.IsDisabled() && d.State() != registry.StateRunning {
+				return false
+			}
+		}
+		return true
+	})
+	return srv
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func checkEvents(t *testing.T, rec *recorder, want ...string) {
+	t.Helper()
+	if got := rec.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+}
+
+func TestRunInitOrderAndShutdown(t *testing.T) {
+	f := registerFakes(t)
+	srv := NewCoreSrv(cfg.New(cfg.Sources{}))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Run()
+	}()
+	waitFor(t, "Worker to run", func() bool { return f.d["Worker"].State() == registry.StateRunning })
+	waitFor(t, "Cache to run", func() bool { return f.d["Cache"].State() == registry.StateRunning })
+	srv.Shutdown("test done")
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	events := f.rec.list()
+	// background services run concurrently, so only check the order of
+	// the init and stop calls.
+	var ordered []string
+	for _, e := range events {
+		if e[:4] != "run " {
+			ordered = append(ordered, e)
+		}
+	}
+	want := []string{"init Store", "init Cache", "init Worker", "stop Worker", "stop Cache", "stop Store"}
+	if !reflect.DeepEqual(ordered, want) {
+		t.Errorf("got events %q, want %q", ordered, want)
+	}
+	if code := srv.Exit(nil); code != 0 {
+		t.Errorf("Exit(nil) after a shutdown = %d, want 0", code)
+	}
+}
+
+func TestRunInitFailureStopsInitializedServices(t *testing.T) {
+	f := registerFakes(t)
+	f.worker.initErr = errors.New("boom")
+	srv := NewCoreSrv(cfg.New(cfg.Sources{}))
+	err := srv.Run()
+	if err == nil || err.Error() != "Service init failed: boom" {
+		t.Fatalf("got error %v", err)
+	}
+	checkEvents(t, f.rec, "init Store", "init Cache", "init Worker", "stop Cache", "stop Store")
+	if code := srv.Exit(err); code != 1 {
+		t.Errorf("Exit() after an init failure = %d, want 1", code)
+	}
+}
+
+func TestExitDuringShutdown(t *testing.T) {
+	registerFakes(t)
+	srv := NewCoreSrv(cfg.New(cfg.Sources{}))
+	done := make(chan int)
+	go func() {
+		done <- srv.Exit(nil)
+	}()
+	srv.Shutdown("signal")
+	<-done
+	if code := srv.Exit(nil); code != 0 {
+		t.Errorf("Exit(nil) = %d, want 0", code)
+	}
+}
+
+func TestFinishedServiceShutsDown(t *testing.T) {
+	f := registerFakes(t)
+	f.cache.run = func(ctx context.Context) error { return nil }
+	srv := NewCoreSrv(cfg.New(cfg.Sources{}))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Run()
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		srv.Shutdown("test timed out")
+		t.Fatal("a finished service without a restart policy did not shut down the server")
+	}
+	if code := srv.Exit(nil); code != 0 {
+		t.Errorf("Exit(nil) = %d, want 0", code)
+	}
+	if srv.shutdownReason != "Cache stopped" {
+		t.Errorf("shutdown reason %q, want Cache stopped", srv.shutdownReason)
+	}
+}
+
+func TestFinishedServiceRestartedOnFailure(t *testing.T) {
+	f := registerFakes(t)
+	f.d["Cache"].RestartPolicy = registry.RestartPolicy{Mode: registry.RestartOnFailure}
+	finished := make(chan struct{})
+	f.cache.run = func(ctx context.Context) error {
+		<-finished
+		return nil
+	}
+	srv := startSrv(t, f, nil)
+	close(finished)
+	waitFor(t, "Cache to stop", func() bool { return f.d["Cache"].State() == registry.StateStopped })
+	time.Sleep(20 * time.Millisecond)
+	if srv.isShuttingDown() {
+		t.Error("a finished service that is restarted on failure shut down the server")
+	}
+	if state := f.d["Worker"].State(); state != registry.StateRunning {
+		t.Errorf("Worker is %s, want running", state)
+	}
+}
+
+func TestRunRouteConflict(t *testing.T) {
+	f := registerFakes(t)
+	registry.Register(&registry.Descriptor{Name: "Router", Instance: &components.Router{}})
+	registry.Register(&registry.Descriptor{Name: "Routed", Instance: &fakeRouted{fake: fake{name: "Routed", rec: f.rec}, path: "/worker"}})
+	srv := NewCoreSrv(cfg.New(cfg.Sources{}))
+	err := srv.Run()
+	want := "Service verification failed: conflicting routes: GET /worker claimed by Routed and Worker"
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %s", err, want)
+	}
+	// no background service was started, and the initialized services
+	// were stopped.
+	checkEvents(t, f.rec, "init Routed", "init Store", "init Cache", "init Worker", "stop Worker", "stop Cache", "stop Store", "stop Routed")
+}
+
+func TestStartDeadline(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy registry.DeadlinePolicy
+		// ready is set if the service becomes ready in time.
+		ready    bool
+		shutdown bool
+	}{
+		{name: "fail shuts down", policy: registry.DeadlineFail, shutdown: true},
+		{name: "fallback keeps running", policy: registry.DeadlineFallback},
+		{name: "degraded keeps running", policy: registry.DeadlineDegraded},
+		{name: "ready in time", policy: registry.DeadlineFail, ready: true},
+	}
+	for _, tt := range tests {
+		f := registerFakes(t)
+		late := &fakeLate{
+			fake:     fake{name: "Late", rec: f.rec},
+			ready:    make(chan struct{}),
+			deadline: registry.StartDeadline{Timeout: 20 * time.Millisecond, Policy: tt.policy},
+		}
+		if tt.ready {
+			close(late.ready)
+		}
+		d := &registry.Descriptor{Name: "Late", Instance: late}
+		registry.Register(d)
+
+		srv := NewCoreSrv(cfg.New(cfg.Sources{}))
+		errc := make(chan error, 1)
+		go func() {
+			errc <- srv.Run()
+		}()
+		if tt.shutdown {
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Errorf("%s: Run() returned %s", tt.name, err)
+				}
+			case <-time.After(5 * time.Second):
+				srv.Shutdown("test timed out")
+				<-errc
+				t.Fatalf("%s: a missed start deadline did not shut down the server", tt.name)
+			}
+			if want := "Late missed its start deadline of 20ms"; srv.shutdownReason != want {
+				t.Errorf("%s: shutdown reason %q, want %q", tt.name, srv.shutdownReason, want)
+			}
+			continue
+		}
+
+		waitFor(t, "Late to run", func() bool { return d.State() == registry.StateRunning })
+		time.Sleep(50 * time.Millisecond)
+		if srv.isShuttingDown() {
+			t.Errorf("%s: server shut down", tt.name)
+		}
+		if missed := d.MissedStartDeadline(); missed == tt.ready {
+			t.Errorf("%s: MissedStartDeadline() = %t", tt.name, missed)
+		}
+		srv.Shutdown("test done")
+		if err := <-errc; err != nil {
+			t.Errorf("%s: Run() returned %s", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/tracing"
+)
+
+func init() {
+	cfg.RegisterSection("tracing", &TracingConfig{})
+}
+
+// TracingConfig holds the tracing settings.
+type TracingConfig struct {
+	// where spans are exported to. With none, traceparent headers are
+	// still propagated.
+	Exporter string `cfg:"exporter,static" default:"none" validate:"oneof=none stdout file otlp"`
+	// file the file exporter appends spans to, one JSON object per line.
+	File string `cfg:"file,static" default:"traces.json" validate:"required"`
+	// OTLP/HTTP traces endpoint of the collector the otlp exporter sends
+	// spans to.
+	OTLPEndpoint string `cfg:"otlp-endpoint,static" default:"http://localhost:4318/v1/traces" validate:"regexp=^https?://"`
+	// name of the service the spans are reported for.
+	ServiceName string `cfg:"service-name,static" default:"demo-server" validate:"required"`
+}
+
+// newTracer creates the tracer with the configured exporter.
+func newTracer(conf *TracingConfig) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch conf.Exporter {
+	case "stdout":
+		exporter = tracing.NewWriterExporter(os.Stdout)
+	case "file":
+		e, err := tracing.NewFileExporter(conf.File)
+		if err != nil {
+			return nil, fmt.Errorf("tracing.file: %s", err)
+		}
+		exporter = e
+	case "otlp":
+		exporter = tracing.NewOTLPExporter(conf.OTLPEndpoint, nil)
+	}
+	if exporter != nil {
+		log.Infof("exporting traces to %s", conf.Exporter)
+	}
+	return tracing.New(conf.ServiceName, exporter), nil
+}
+
+// shutdownTracer exports the spans that have not been exported yet.
+func (srv *CoreSrv) shutdownTracer() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.tracer.Shutdown(ctx); err != nil {
+		log.Errorf("Failed to export the remaining spans. %s", err)
+	}
+}
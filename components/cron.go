@@ -0,0 +1,311 @@
+package components
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule determines when a scheduled task runs.
+type Schedule interface {
+	// Next returns the first time after t that the task should run.
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// ParseSchedule parses either a fixed interval or a cron expression.
+//
+// Intervals are Go durations, eg. "5s", optionally prefixed with "@every ".
+// Cron expressions have 5 fields (minute hour day-of-month month
+// day-of-week) or 6 fields with a leading seconds field. Each field
+// supports "*", lists, ranges and steps, eg. "*/15 0-30/5,45 * * MON-FRI".
+// The descriptors @yearly, @monthly, @weekly, @daily and @hourly are
+// also supported. Cron expressions are evaluated in loc.
+func ParseSchedule(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		return parseInterval(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+	}
+	if d, err := time.ParseDuration(spec); err == nil {
+		return parseInterval(d.String())
+	}
+
+	switch spec {
+	case "@yearly", "@annually":
+		spec = "0 0 0 1 1 *"
+	case "@monthly":
+		spec = "0 0 0 1 * *"
+	case "@weekly":
+		spec = "0 0 0 * * 0"
+	case "@daily", "@midnight":
+		spec = "0 0 0 * * *"
+	case "@hourly":
+		spec = "0 0 * * * *"
+	}
+	return parseCron(spec, loc)
+}
+
+// IntervalSchedule runs a task at a fixed interval.
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+func parseInterval(spec string) (Schedule, error) {
+	d, err := time.ParseDuration(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q. %s", spec, err)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("interval must be > 0, got %s", d)
+	}
+	return &IntervalSchedule{Interval: d}, nil
+}
+
+func (s *IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.Interval)
+}
+
+func (s *IntervalSchedule) String() string {
+	return "@every " + s.Interval.String()
+}
+
+// CronSchedule runs a task at the times matching a cron expression. Each
+// field is a bit set of the values that match.
+type CronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	// domStar and dowStar record if the day fields were "*". If either is
+	// restricted, a day matches if either field matches.
+	domStar, dowStar bool
+
+	spec     string
+	location *time.Location
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondsField = cronField{name: "second", min: 0, max: 59}
+	minutesField = cronField{name: "minute", min: 0, max: 59}
+	hoursField   = cronField{name: "hour", min: 0, max: 23}
+	domField     = cronField{name: "day-of-month", min: 1, max: 31}
+	monthField   = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is also sunday, so that ranges such as "5-7" work. It is mapped to
+	// 0 once the field is parsed.
+	dowField = cronField{name: "day-of-week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+func parseCron(spec string, loc *time.Location) (Schedule, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("invalid cron expression %q. expected 5 or 6 fields, got %d", spec, len(fields))
+	}
+
+	s := &CronSchedule{
+		spec:     spec,
+		location: loc,
+		domStar:  fields[3] == "*" || fields[3] == "?",
+		dowStar:  fields[5] == "*" || fields[5] == "?",
+	}
+	var err error
+	for i, f := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{secondsField, &s.second},
+		{minutesField, &s.minute},
+		{hoursField, &s.hour},
+		{domField, &s.dom},
+		{monthField, &s.month},
+		{dowField, &s.dow},
+	} {
+		*f.bits, err = f.field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q. %s", spec, err)
+		}
+	}
+	return s, nil
+}
+
+// parse converts a single cron field to a bit set of matching values.
+func (f cronField) parse(expr string) (uint64, error) {
+	var result uint64
+	for _, part := range strings.Split(expr, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+			part = part[:i]
+		}
+
+		start, end := f.min, f.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			start = v
+			// "5/10" means starting at 5, every 10.
+			if step == 1 {
+				end = v
+			}
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+		}
+		for v := start; v <= end; v += step {
+			result |= 1 << uint(v)
+		}
+	}
+	if f.name == dowField.name && result&(1<<7) != 0 {
+		result = result&^(1<<7) | 1
+	}
+	return result, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field. must be between %d and %d", s, f.name, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (s *CronSchedule) String() string {
+	return s.spec
+}
+
+// allHours is the hour bit set of a schedule that runs every hour.
+const allHours = 1<<24 - 1
+
+// Next returns the first matching time after t. The zero time is returned
+// if no time matches within the next 5 years, eg. for "0 0 30 2 *".
+//
+// Daylight saving changes are handled like cron does. Schedules with
+// fixed hours run once when the clocks go back, in the first of the
+// repeated hours, and times skipped when the clocks go forward run at the
+// time the clocks went forward to. Schedules that run every hour run in
+// every hour that actually passes.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	origLoc := t.Location()
+	t = t.In(s.location)
+	// start at the next whole second.
+	t = t.Add(time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
+	yearLimit := t.Year() + 5
+
+	prev := t
+	for t.Year() <= yearLimit {
+		if s.skippedMatch(prev, t) {
+			return t.In(origLoc)
+		}
+		prev = t
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 || (s.hour != allHours && repeated(t)) {
+			// step in absolute time so that both of the repeated hours
+			// are visited when the clocks go back.
+			t = t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second).Add(time.Hour)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t.In(origLoc)
+	}
+	return time.Time{}
+}
+
+// skippedMatch returns true if the clocks went forward between prev and t,
+// and the schedule matches a time that was skipped. Schedules that run
+// every hour don't catch up on skipped times.
+func (s *CronSchedule) skippedMatch(prev, t time.Time) bool {
+	if s.hour == allHours {
+		return false
+	}
+	_, prevOffset := prev.Zone()
+	_, offset := t.Zone()
+	if offset <= prevOffset {
+		return false
+	}
+	// look for a match between the wall clock times, in a location without
+	// daylight saving.
+	wall := *s
+	wall.location = time.UTC
+	next := wall.Next(wallClock(prev))
+	return !next.IsZero() && next.Before(wallClock(t))
+}
+
+// repeated returns true if the wall clock time of t already occurred
+// earlier, as the clocks went back.
+func repeated(t time.Time) bool {
+	_, offset := t.Zone()
+	// offsets don't change more than once in a few hours.
+	_, before := t.Add(-6 * time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+	_, earlier := t.Add(-time.Duration(before-offset) * time.Second).Zone()
+	return earlier == before
+}
+
+// wallClock returns the wall clock time of t in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
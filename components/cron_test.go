@@ -0,0 +1,266 @@
+package components
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"", "empty schedule"},
+		{"   ", "empty schedule"},
+		{"0s", "interval must be > 0"},
+		{"-5s", "interval must be > 0"},
+		{"@every nonsense", `invalid interval "nonsense"`},
+		{"* * * *", "expected 5 or 6 fields, got 4"},
+		{"* * * * * * *", "expected 5 or 6 fields, got 7"},
+		{"60 * * * *", `invalid value "60" in minute field. must be between 0 and 59`},
+		{"* 24 * * *", `invalid value "24" in hour field. must be between 0 and 23`},
+		{"* * 0 * *", `invalid value "0" in day-of-month field. must be between 1 and 31`},
+		{"* * * 13 * ", `invalid value "13" in month field. must be between 1 and 12`},
+		{"* * * foo * ", `invalid value "foo" in month field`},
+		{"* * * * 8", `invalid value "8" in day-of-week field`},
+		{"* * * * MON-FOO", `invalid value "FOO" in day-of-week field`},
+		{"*/0 * * * *", `invalid step in minute field "*/0"`},
+		{"*/x * * * *", `invalid step in minute field "*/x"`},
+		{"30-10 * * * *", `invalid range in minute field "30-10"`},
+		{"61 * * * * *", `invalid value "61" in second field`},
+	}
+	for _, tt := range tests {
+		_, err := ParseSchedule(tt.spec, time.UTC)
+		if err == nil {
+			t.Errorf("ParseSchedule(%q): expected an error", tt.spec)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseSchedule(%q): got error %q, want it to contain %q", tt.spec, err, tt.err)
+		}
+	}
+}
+
+func TestParseScheduleString(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"5s", "@every 5s"},
+		{"@every 1m30s", "@every 1m30s"},
+		{" 90s ", "@every 1m30s"},
+		{"*/15 * * * *", "*/15 * * * *"},
+		{"@daily", "0 0 0 * * *"},
+		{"@hourly", "0 0 * * * *"},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec, time.UTC)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %s", tt.spec, err)
+			continue
+		}
+		if got := s.String(); got != tt.want {
+			t.Errorf("ParseSchedule(%q).String() = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want []string
+	}{
+		{
+			name: "interval",
+			spec: "@every 90s",
+			from: "2026-01-01T00:00:00.5Z",
+			want: []string{"2026-01-01T00:01:30.5Z", "2026-01-01T00:03:00.5Z"},
+		},
+		{
+			name: "seconds field",
+			spec: "*/20 * * * * *",
+			from: "2026-01-01T00:00:50.25Z",
+			want: []string{"2026-01-01T00:01:00Z", "2026-01-01T00:01:20Z", "2026-01-01T00:01:40Z"},
+		},
+		{
+			name: "ranges and steps",
+			spec: "0-30/15,45 9 * * *",
+			from: "2026-01-01T09:20:00Z",
+			want: []string{"2026-01-01T09:30:00Z", "2026-01-01T09:45:00Z", "2026-01-02T09:00:00Z"},
+		},
+		{
+			name: "day rollover",
+			spec: "0 23 * * *",
+			from: "2026-01-31T23:00:00Z",
+			want: []string{"2026-02-01T23:00:00Z"},
+		},
+		{
+			name: "month rollover",
+			spec: "0 0 31 * *",
+			from: "2026-01-31T00:00:00Z",
+			want: []string{"2026-03-31T00:00:00Z", "2026-05-31T00:00:00Z"},
+		},
+		{
+			name: "year rollover",
+			spec: "@monthly",
+			from: "2026-12-15T12:00:00Z",
+			want: []string{"2027-01-01T00:00:00Z", "2027-02-01T00:00:00Z"},
+		},
+		{
+			name: "leap day",
+			spec: "0 12 29 FEB *",
+			from: "2026-03-01T00:00:00Z",
+			want: []string{"2028-02-29T12:00:00Z", "2032-02-29T12:00:00Z"},
+		},
+		{
+			name: "weekdays by name",
+			spec: "0 8 * * MON-FRI",
+			from: "2026-10-16T08:00:00Z", // a friday
+			want: []string{"2026-10-19T08:00:00Z", "2026-10-20T08:00:00Z"},
+		},
+		{
+			name: "sunday as 7",
+			spec: "0 0 * * 7",
+			from: "2026-10-16T00:00:00Z",
+			want: []string{"2026-10-18T00:00:00Z"},
+		},
+		{
+			name: "range ending in sunday as 7",
+			spec: "0 0 * * 5-7",
+			from: "2026-10-15T00:00:00Z", // a thursday
+			want: []string{"2026-10-16T00:00:00Z", "2026-10-17T00:00:00Z", "2026-10-18T00:00:00Z", "2026-10-23T00:00:00Z"},
+		},
+		{
+			name: "day of month or day of week",
+			spec: "0 0 1 * SUN",
+			from: "2026-10-24T00:00:00Z",
+			want: []string{"2026-10-25T00:00:00Z", "2026-11-01T00:00:00Z", "2026-11-08T00:00:00Z"},
+		},
+		{
+			name: "never",
+			spec: "0 0 30 2 *",
+			from: "2026-01-01T00:00:00Z",
+			want: []string{"0001-01-01T00:00:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec, time.UTC)
+		if err != nil {
+			t.Errorf("%s: ParseSchedule(%q): %s", tt.name, tt.spec, err)
+			continue
+		}
+		checkNext(t, tt.name, s, parseTime(t, tt.from), tt.want)
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	newYork := loadLocation(t, "America/New_York")
+	tests := []struct {
+		name string
+		spec string
+		loc  *time.Location
+		from string
+		want []string
+	}{
+		{
+			name: "fixed time skipped when clocks go forward runs once they have",
+			spec: "30 2 * * *",
+			loc:  berlin,
+			from: "2026-03-29T00:00:00+01:00",
+			want: []string{"2026-03-29T03:00:00+02:00", "2026-03-30T02:30:00+02:00"},
+		},
+		{
+			name: "fixed time after the gap is not moved",
+			spec: "30 3 * * *",
+			loc:  berlin,
+			from: "2026-03-29T00:00:00+01:00",
+			want: []string{"2026-03-29T03:30:00+02:00", "2026-03-30T03:30:00+02:00"},
+		},
+		{
+			name: "hourly skips the hour that does not exist",
+			spec: "0 * * * *",
+			loc:  berlin,
+			from: "2026-03-29T00:30:00+01:00",
+			want: []string{"2026-03-29T01:00:00+01:00", "2026-03-29T03:00:00+02:00", "2026-03-29T04:00:00+02:00"},
+		},
+		{
+			name: "fixed time in the repeated hour runs once",
+			spec: "30 2 * * *",
+			loc:  berlin,
+			from: "2026-10-25T00:00:00+02:00",
+			want: []string{"2026-10-25T02:30:00+02:00", "2026-10-26T02:30:00+01:00"},
+		},
+		{
+			name: "fixed time in the repeated hour from within it",
+			spec: "30 2 * * *",
+			loc:  berlin,
+			from: "2026-10-25T02:10:00+02:00",
+			want: []string{"2026-10-25T02:30:00+02:00", "2026-10-26T02:30:00+01:00"},
+		},
+		{
+			name: "hourly runs in both repeated hours",
+			spec: "0 * * * *",
+			loc:  berlin,
+			from: "2026-10-25T01:30:00+02:00",
+			want: []string{"2026-10-25T02:00:00+02:00", "2026-10-25T02:00:00+01:00", "2026-10-25T03:00:00+01:00"},
+		},
+		{
+			name: "steps within a skipped hour",
+			spec: "*/20 1-2 * * *",
+			loc:  newYork,
+			from: "2026-03-08T01:30:00-05:00",
+			want: []string{"2026-03-08T01:40:00-05:00", "2026-03-08T03:00:00-04:00", "2026-03-09T01:00:00-04:00"},
+		},
+		{
+			name: "daily across a transition",
+			spec: "@daily",
+			loc:  newYork,
+			from: "2026-11-01T00:00:00-04:00",
+			want: []string{"2026-11-02T00:00:00-05:00", "2026-11-03T00:00:00-05:00"},
+		},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec, tt.loc)
+		if err != nil {
+			t.Errorf("%s: ParseSchedule(%q): %s", tt.name, tt.spec, err)
+			continue
+		}
+		checkNext(t, tt.name, s, parseTime(t, tt.from), tt.want)
+	}
+}
+
+// checkNext calls s.Next repeatedly from the given time, and compares the
+// results with want.
+func checkNext(t *testing.T, name string, s Schedule, from time.Time, want []string) {
+	t.Helper()
+	next := from
+	for i, w := range want {
+		next = s.Next(next)
+		if expected := parseTime(t, w); !next.Equal(expected) {
+			t.Errorf("%s: run %d of %q from %s: got %s, want %s", name, i+1, s, from.Format(time.RFC3339), next.Format(time.RFC3339), w)
+			return
+		}
+	}
+}
+
+func parseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	v, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		t.Fatalf("invalid time %q. %s", s, err)
+	}
+	return v
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("failed to load location %s. %s", name, err)
+	}
+	return loc
+}
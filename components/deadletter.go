@@ -0,0 +1,151 @@
+package components
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/macaron.v1"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a job that failed after exhausting its retries.
+type DeadLetter struct {
+	Job      Job       `json:"job"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// DeadLetterQueue is a bounded in memory store of dead letters. When full,
+// the oldest dead letter is discarded to make room for new ones.
+type DeadLetterQueue struct {
+	size    int
+	letters []DeadLetter
+	logger  *log.Entry
+	sync.Mutex
+}
+
+func NewDeadLetterQueue(size int, logger *log.Entry) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		size:    size,
+		letters: make([]DeadLetter, 0),
+		logger:  logger,
+	}
+}
+
+func (d *DeadLetterQueue) Add(letter DeadLetter) {
+	d.Lock()
+	defer d.Unlock()
+	if d.size <= 0 {
+		d.logger.Warnf("dead letter queue is disabled. discarding job %d", letter.Job.ID)
+		return
+	}
+	if len(d.letters) >= d.size {
+		d.logger.Warnf("dead letter queue is full. discarding job %d", d.letters[0].Job.ID)
+		d.letters = d.letters[1:]
+	}
+	d.letters = append(d.letters, letter)
+}
+
+// List returns a copy of all dead letters, oldest first.
+func (d *DeadLetterQueue) List() []DeadLetter {
+	d.Lock()
+	defer d.Unlock()
+	letters := make([]DeadLetter, len(d.letters))
+	copy(letters, d.letters)
+	return letters
+}
+
+// Get returns the dead letter for the job with the given id.
+func (d *DeadLetterQueue) Get(id uint64) (DeadLetter, bool) {
+	d.Lock()
+	defer d.Unlock()
+	for _, l := range d.letters {
+		if l.Job.ID == id {
+			return l, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// Remove deletes and returns the dead letter for the job with the given id.
+func (d *DeadLetterQueue) Remove(id uint64) (DeadLetter, bool) {
+	d.Lock()
+	defer d.Unlock()
+	for i, l := range d.letters {
+		if l.Job.ID == id {
+			d.letters = append(d.letters[:i], d.letters[i+1:]...)
+			return l, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+func (d *DeadLetterQueue) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.letters)
+}
+
+// RegisterRoutes exposes the dead letter queue so that failed jobs can
+// be inspected and redriven. Deleting and redriving jobs are admin routes.
+func (wp *WorkerPool) RegisterRoutes(r *RouteGroup) {
+	g := r.Group("/workers/dead-letters")
+	g.Get("", wp.listDeadLetters).Name("dead-letters")
+	g.Get("/:id", wp.getDeadLetter).Name("dead-letter")
+	admin := g.Admin()
+	admin.Delete("/:id", wp.deleteDeadLetter).Name("dead-letter-delete")
+	admin.Post("/:id/redrive", wp.redriveDeadLetter).Name("dead-letter-redrive")
+}
+
+func (wp *WorkerPool) listDeadLetters(ctx *macaron.Context) {
+	ctx.JSON(200, wp.DeadLetters.List())
+}
+
+func (wp *WorkerPool) getDeadLetter(ctx *macaron.Context) {
+	id, err := strconv.ParseUint(ctx.Params(":id"), 10, 64)
+	if err != nil {
+		ctx.PlainText(400, []byte("invalid job id"))
+		return
+	}
+	letter, ok := wp.DeadLetters.Get(id)
+	if !ok {
+		ctx.PlainText(404, []byte(ErrDeadLetterNotFound.Error()))
+		return
+	}
+	ctx.JSON(200, letter)
+}
+
+func (wp *WorkerPool) deleteDeadLetter(ctx *macaron.Context) {
+	id, err := strconv.ParseUint(ctx.Params(":id"), 10, 64)
+	if err != nil {
+		ctx.PlainText(400, []byte("invalid job id"))
+		return
+	}
+	if _, ok := wp.DeadLetters.Remove(id); !ok {
+		ctx.PlainText(404, []byte(ErrDeadLetterNotFound.Error()))
+		return
+	}
+	ctx.Status(204)
+}
+
+func (wp *WorkerPool) redriveDeadLetter(ctx *macaron.Context) {
+	id, err := strconv.ParseUint(ctx.Params(":id"), 10, 64)
+	if err != nil {
+		ctx.PlainText(400, []byte("invalid job id"))
+		return
+	}
+	h, err := wp.Redrive(ctx.Req.Context(), id)
+	if err == ErrDeadLetterNotFound {
+		ctx.PlainText(404, []byte(err.Error()))
+		return
+	}
+	if err != nil {
+		ctx.PlainText(503, []byte(err.Error()))
+		return
+	}
+	ctx.JSON(202, map[string]uint64{"id": h.Job.ID})
+}
@@ -0,0 +1,214 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/registry"
+	"gopkg.in/macaron.v1"
+)
+
+func TestDeadLetterQueueSize(t *testing.T) {
+	logger := log.New()
+	logger.Out = io.Discard
+	d := NewDeadLetterQueue(2, log.NewEntry(logger))
+	for id := uint64(1); id <= 3; id++ {
+		d.Add(DeadLetter{Job: Job{ID: id}})
+	}
+	letters := d.List()
+	if len(letters) != 2 || letters[0].Job.ID != 2 || letters[1].Job.ID != 3 {
+		t.Errorf("got dead letters %+v, want jobs 2 and 3", letters)
+	}
+
+	d = NewDeadLetterQueue(0, log.NewEntry(logger))
+	d.Add(DeadLetter{Job: Job{ID: 1}})
+	if d.Len() != 0 {
+		t.Errorf("a disabled dead letter queue kept %d jobs", d.Len())
+	}
+}
+
+func TestWorkerStopDeadLetters(t *testing.T) {
+	wp := newTestPool(t, nil)
+	release := make(chan struct{})
+	w := &fakeJobs{do: func(ctx context.Context, job *Job) error {
+		switch job.Payload {
+		case "fail":
+			return errors.New("boom")
+		case "block":
+			<-release
+		}
+		return nil
+	}}
+	retry := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1, QueueSize: 1, Retry: retry}); err != nil {
+		t.Fatal(err)
+	}
+	submit := func(payload string) *JobHandle {
+		h, err := wp.Submit(context.Background(), &Job{Worker: "w", Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	retried := submit("fail")
+	waitForStats(t, wp, "w", func(s WorkerStats) bool { return s.Retried == 1 && s.InFlight == 0 })
+	blocked := submit("block")
+	waitForStats(t, wp, "w", func(s WorkerStats) bool { return s.InFlight == 1 })
+	queued := submit("ok")
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- wp.Stop(context.Background())
+	}()
+	// the job waiting to be retried does not get another attempt.
+	if err := wait(t, retried); err == nil || err.Error() != "worker pool is closed before retry. boom" {
+		t.Errorf("got error %v for the job waiting to be retried", err)
+	}
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	// the jobs in flight and in the queue are still executed.
+	for _, h := range []*JobHandle{blocked, queued} {
+		if err := wait(t, h); err != nil {
+			t.Errorf("job %v failed. %s", h.Job.Payload, err)
+		}
+	}
+
+	want := WorkerStats{Processed: 2, Failed: 1, Retried: 1, DeadLettered: 1}
+	if stats := wp.Stats()["w"]; stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+	letters := wp.DeadLetters.List()
+	if len(letters) != 1 || letters[0].Job.ID != retried.Job.ID || letters[0].Job.Attempts != 1 {
+		t.Errorf("unexpected dead letters %+v", letters)
+	}
+}
+
+func TestWorkerStopTimeout(t *testing.T) {
+	wp := newTestPool(t, nil)
+	w := &fakeJobs{do: func(ctx context.Context, job *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := wp.Submit(context.Background(), &Job{Worker: "w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, wp, "w", func(s WorkerStats) bool { return s.InFlight == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wp.Stop(ctx); err == nil || err.Error() != "workers still had jobs in flight: [w]" {
+		t.Errorf("got error %v from Stop", err)
+	}
+	// the job in flight is cancelled.
+	if err := wait(t, h); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	want := WorkerStats{Failed: 1, DeadLettered: 1}
+	if stats := wp.Stats()["w"]; stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+}
+
+func TestWorkerRedrive(t *testing.T) {
+	wp := newTestPool(t, nil)
+	var fixed int32
+	w := &fakeJobs{do: func(ctx context.Context, job *Job) error {
+		if atomic.LoadInt32(&fixed) == 0 {
+			return errors.New("boom")
+		}
+		return nil
+	}}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1, QueueSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	failed := func() uint64 {
+		h, err := wp.Submit(context.Background(), &Job{Worker: "w"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wait(t, h); err == nil {
+			t.Fatal("job did not fail")
+		}
+		return h.Job.ID
+	}
+
+	id := failed()
+	if _, err := wp.Redrive(context.Background(), id+1); err != ErrDeadLetterNotFound {
+		t.Errorf("got error %v redriving an unknown job", err)
+	}
+	atomic.StoreInt32(&fixed, 1)
+	h, err := wp.Redrive(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, h); err != nil {
+		t.Errorf("redriven job failed. %s", err)
+	}
+	if h.Job.ID == id || h.Job.Attempts != 1 {
+		t.Errorf("redriven job has id %d and %d attempts, want a new id and 1 attempt", h.Job.ID, h.Job.Attempts)
+	}
+	if wp.DeadLetters.Len() != 0 {
+		t.Errorf("redriven job is still dead lettered")
+	}
+	want := WorkerStats{Processed: 1, Failed: 1, DeadLettered: 1}
+	if stats := wp.Stats()["w"]; stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+
+	// a job that cannot be submitted stays in the dead letter queue.
+	atomic.StoreInt32(&fixed, 0)
+	id = failed()
+	wp.Stop(context.Background())
+	if _, err := wp.Redrive(context.Background(), id); err != ErrPoolClosed {
+		t.Errorf("got error %v redriving after Stop, want %v", err, ErrPoolClosed)
+	}
+	if _, ok := wp.DeadLetters.Get(id); !ok {
+		t.Errorf("job %d was lost by a failed redrive", id)
+	}
+}
+
+func TestDeadLetterRoutes(t *testing.T) {
+	d := &registry.Descriptor{Name: "WorkerPool", Instance: newTestPool(t, nil)}
+	d.SetState(registry.StateRunning)
+	registerServices(t, d)
+	r := newTestRouter(t)
+	if err := r.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range r.routes {
+		if route.name == "" {
+			t.Errorf("%s %s has no name", route.Method, route.Path)
+		}
+	}
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	r.Mount(m)
+
+	tests := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/workers/dead-letters", 200},
+		{"DELETE", "/workers/dead-letters/1", 403},
+		{"POST", "/workers/dead-letters/1/redrive", 403},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/registry"
+)
+
+func init() {
+	registry.RegisterService(&Health{}, 99)
+
+	// runtime settings
+	cfg.SetDefault("health.check-timeout", time.Second*5)
+	cfg.SetDefault("health.cache-ttl", time.Second)
+}
+
+// HealthReport is the aggregated health of all enabled services.
+type HealthReport struct {
+	Status registry.HealthState             `json:"status"`
+	Checks map[string]registry.HealthStatus `json:"checks"`
+	Time   time.Time                        `json:"time"`
+}
+
+// Live returns true if no service is down. For reports from Liveness that
+// is when no service has failed.
+func (r *HealthReport) Live() bool {
+	return r.Status != registry.HealthDown
+}
+
+// Ready returns true if all services are up or degraded. Degraded services,
+// eg. one that is being replaced by a fallback until it is ready, still
+// serve requests, so they do not make the process unready.
+func (r *HealthReport) Ready() bool {
+	return r.Status == registry.HealthUp || r.Status == registry.HealthDegraded
+}
+
+// Health runs the health checks of all services and aggregates the results.
+type Health struct {
+	Cfg *cfg.Cfg `inject:""`
+
+	last *HealthReport
+	// running is the check in progress, if any.
+	running *healthCall
+	sync.Mutex
+}
+
+// healthCall is a run of the health checks that concurrent callers of
+// Check share.
+type healthCall struct {
+	done   chan struct{}
+	report *HealthReport
+	// cancelled is set if the context of the caller that ran the checks
+	// was done before they completed, so the report can not be trusted.
+	cancelled bool
+}
+
+func (h *Health) Init() error {
+	return nil
+}
+
+// Check returns the health of all enabled services, except services that
+// have been stopped at runtime. Results are cached
+// for health.cache-ttl so that frequent probes don't overload services,
+// and probes that arrive while the checks are running wait for their
+// result instead of running them again.
+func (h *Health) Check(ctx context.Context) *HealthReport {
+	for {
+		h.Lock()
+		if h.last != nil && time.Since(h.last.Time) < h.Cfg.GetDuration("health.cache-ttl") {
+			report := h.last
+			h.Unlock()
+			return report
+		}
+		call := h.running
+		if call == nil {
+			call = &healthCall{done: make(chan struct{})}
+			h.running = call
+			h.Unlock()
+			h.run(ctx, call)
+			return call.report
+		}
+		h.Unlock()
+
+		// the checks are bounded by health.check-timeout.
+		<-call.done
+		if !call.cancelled || ctx.Err() != nil {
+			return call.report
+		}
+		// the checks were cut short by the caller that ran them, so run
+		// them again.
+	}
+}
+
+// Liveness reports whether the process itself is alive, without running
+// the health checks of the services. Only services that have failed are
+// reported as down. A dependency that is down, or a check that is slow,
+// only makes the process unready, as restarting the process would not fix
+// it.
+func (h *Health) Liveness() *HealthReport {
+	report := &HealthReport{
+		Status: registry.HealthUp,
+		Checks: make(map[string]registry.HealthStatus),
+		Time:   time.Now(),
+	}
+	for _, s := range registry.GetServices() {
+		if s.State() == registry.StateFailed {
+			report.Checks[s.Name] = registry.HealthStatus{Status: registry.HealthDown, Message: "failed. " + s.Status().LastError}
+			report.Status = registry.HealthDown
+		}
+	}
+	return report
+}
+
+// run runs the health checks for call, and caches the report unless ctx
+// was done before the checks completed.
+func (h *Health) run(ctx context.Context, call *healthCall) {
+	report := h.checkAll(ctx)
+	h.Lock()
+	call.report = report
+	call.cancelled = ctx.Err() != nil
+	if !call.cancelled {
+		h.last = report
+	}
+	h.running = nil
+	h.Unlock()
+	close(call.done)
+}
+
+// checkAll runs the health checks of all services concurrently.
+func (h *Health) checkAll(ctx context.Context) *HealthReport {
+	report := &HealthReport{
+		Status: registry.HealthUp,
+		Checks: make(map[string]registry.HealthStatus),
+		Time:   time.Now(),
+	}
+	timeout := h.Cfg.GetDuration("health.check-timeout")
+	results := make(chan checkResult)
+	count := 0
+	for _, s := range registry.GetServices() {
+		if s.IsDisabled() || s.State() == registry.StateStopped {
+			continue
+		}
+		count++
+		go func(d *registry.Descriptor) {
+			results <- checkResult{d.Name, checkService(ctx, d, timeout)}
+		}(s)
+	}
+	for i := 0; i < count; i++ {
+		r := <-results
+		report.Checks[r.name] = r.status
+		report.Status = worst(report.Status, r.status.Status)
+	}
+	return report
+}
+
+type checkResult struct {
+	name   string
+	status registry.HealthStatus
+}
+
+// checkService returns the health of a single service. Services that are
+// not ready yet are reported as starting, or degraded once they have
+// missed their start deadline. Services that don't implement
+// registry.HealthChecker are assumed to be up.
+func checkService(ctx context.Context, d *registry.Descriptor, timeout time.Duration) registry.HealthStatus {
+	switch d.State() {
+	case registry.StateFailed:
+		return registry.HealthStatus{Status: registry.HealthDown, Message: "failed. " + d.Status().LastError}
+	case registry.StateInitializing:
+		return registry.HealthStatus{Status: registry.HealthStarting, Message: "initializing"}
+	case registry.StateStopping:
+		return registry.HealthStatus{Status: registry.HealthDegraded, Message: "stopping"}
+	}
+
+	if r, ok := d.ReadyNotifier(); ok {
+		select {
+		case <-r.Ready():
+		default:
+			if d.MissedStartDeadline() {
+				return registry.HealthStatus{Status: registry.HealthDegraded, Message: "not ready within start deadline"}
+			}
+			return registry.HealthStatus{Status: registry.HealthStarting, Message: "not ready"}
+		}
+	}
+
+	checker, ok := d.HealthChecker()
+	if !ok {
+		return registry.HealthStatus{Status: registry.HealthUp}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result := make(chan registry.HealthStatus, 1)
+	go func() {
+		result <- checker.Health(ctx)
+	}()
+	select {
+	case status := <-result:
+		return status
+	case <-ctx.Done():
+		return registry.HealthStatus{
+			Status:  registry.HealthDown,
+			Message: fmt.Sprintf("health check did not complete within %s", timeout),
+		}
+	}
+}
+
+var severity = map[registry.HealthState]int{
+	registry.HealthUp:       0,
+	registry.HealthDegraded: 1,
+	registry.HealthStarting: 2,
+	registry.HealthDown:     3,
+}
+
+func worst(a, b registry.HealthState) registry.HealthState {
+	if severity[b] > severity[a] {
+		return b
+	}
+	return a
+}
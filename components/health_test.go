@@ -0,0 +1,141 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/registry"
+)
+
+// fakeChecker is a service that reports the given health, after delay.
+type fakeChecker struct {
+	status registry.HealthStatus
+	delay  time.Duration
+}
+
+func (f *fakeChecker) Init() error { return nil }
+
+func (f *fakeChecker) Health(ctx context.Context) registry.HealthStatus {
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+	}
+	return f.status
+}
+
+// registerServices replaces the registered services for the duration of
+// the test.
+func registerServices(t *testing.T, list ...*registry.Descriptor) {
+	saved := registry.SetServices(list)
+	t.Cleanup(func() { registry.SetServices(saved) })
+}
+
+func newTestCfg(t *testing.T, overrides map[string]string) *cfg.Cfg {
+	c := cfg.New(cfg.Sources{Overrides: overrides})
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestHealthProbes(t *testing.T) {
+	up := registry.HealthStatus{Status: registry.HealthUp}
+	tests := []struct {
+		name  string
+		state registry.ServiceState
+		check registry.HealthStatus
+		delay time.Duration
+		// status is the status of the readiness report.
+		status registry.HealthState
+		live   bool
+		ready  bool
+	}{
+		{name: "up", state: registry.StateRunning, check: up, status: registry.HealthUp, live: true, ready: true},
+		{
+			name:   "degraded is ready",
+			state:  registry.StateRunning,
+			check:  registry.HealthStatus{Status: registry.HealthDegraded, Message: "slow"},
+			status: registry.HealthDegraded,
+			live:   true,
+			ready:  true,
+		},
+		{
+			name:   "dependency down is live but not ready",
+			state:  registry.StateRunning,
+			check:  registry.HealthStatus{Status: registry.HealthDown, Message: "database unreachable"},
+			status: registry.HealthDown,
+			live:   true,
+		},
+		{
+			name:   "check timeout is live but not ready",
+			state:  registry.StateRunning,
+			check:  up,
+			delay:  time.Second,
+			status: registry.HealthDown,
+			live:   true,
+		},
+		{name: "initializing", state: registry.StateInitializing, check: up, status: registry.HealthStarting, live: true},
+		{name: "stopping", state: registry.StateStopping, check: up, status: registry.HealthDegraded, live: true, ready: true},
+		{name: "failed", state: registry.StateFailed, check: up, status: registry.HealthDown},
+	}
+	for _, tt := range tests {
+		d := &registry.Descriptor{Name: "Checked", Instance: &fakeChecker{status: tt.check, delay: tt.delay}}
+		d.SetState(tt.state)
+		if tt.state == registry.StateFailed {
+			d.RecordFailure(errors.New("boom"))
+		}
+		other := &registry.Descriptor{Name: "Other", Instance: &fakeChecker{status: up}}
+		other.SetState(registry.StateRunning)
+		registerServices(t, d, other)
+		h := &Health{Cfg: newTestCfg(t, map[string]string{"health.check-timeout": "20ms", "health.cache-ttl": "0s"})}
+
+		if live := h.Liveness().Live(); live != tt.live {
+			t.Errorf("%s: Live() = %t, want %t", tt.name, live, tt.live)
+		}
+		report := h.Check(context.Background())
+		if report.Status != tt.status || report.Ready() != tt.ready {
+			t.Errorf("%s: got status %s ready=%t, want %s ready=%t", tt.name, report.Status, report.Ready(), tt.status, tt.ready)
+		}
+		if report.Checks["Other"].Status != registry.HealthUp {
+			t.Errorf("%s: Other reported as %+v", tt.name, report.Checks["Other"])
+		}
+	}
+}
+
+func TestHealthLivenessFailedService(t *testing.T) {
+	d := &registry.Descriptor{Name: "Checked", Instance: &fakeChecker{}}
+	d.SetState(registry.StateFailed)
+	d.RecordFailure(errors.New("boom"))
+	registerServices(t, d)
+	h := &Health{Cfg: newTestCfg(t, nil)}
+	report := h.Liveness()
+	want := registry.HealthStatus{Status: registry.HealthDown, Message: "failed. boom"}
+	if report.Status != registry.HealthDown || report.Checks["Checked"].Status != want.Status || report.Checks["Checked"].Message != want.Message {
+		t.Errorf("unexpected liveness report %+v", report)
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	checker := &fakeChecker{status: registry.HealthStatus{Status: registry.HealthUp}}
+	d := &registry.Descriptor{Name: "Checked", Instance: checker}
+	d.SetState(registry.StateRunning)
+	registerServices(t, d)
+	h := &Health{Cfg: newTestCfg(t, map[string]string{"health.cache-ttl": "1m"})}
+	first := h.Check(context.Background())
+	checker.status = registry.HealthStatus{Status: registry.HealthDown}
+	if second := h.Check(context.Background()); second != first {
+		t.Errorf("report was not cached")
+	}
+
+	// a report from a check whose caller gave up is not cached.
+	h = &Health{Cfg: newTestCfg(t, map[string]string{"health.cache-ttl": "1m"})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.Check(ctx)
+	if report := h.Check(context.Background()); report.Status != registry.HealthDown {
+		t.Errorf("got status %s, want the report of a new check", report.Status)
+	}
+}
@@ -1,38 +1,732 @@
 package components
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/metrics"
 	"github.com/woodsaj/go-server/registry"
+	"gopkg.in/macaron.v1"
 )
 
 func init() {
 	registry.RegisterService(&ProcessorController{}, 99)
+
+	// runtime settings
+	// name of the processor used when no processor is requested. If not
+	// set the first processor registered is used. Changing it switches
+	// the active processor.
+	cfg.SetDefault("processor.default", "")
+	// maximum time to wait for a processor to become ready when switching to it.
+	cfg.SetDefault("processor.switch-timeout", time.Minute)
+	// maximum time to wait for in-flight calls to the old processor after switching.
+	cfg.SetDefault("processor.drain-timeout", time.Second*10)
 }
 
 type Processor interface {
-	Data() string
+	// Data is called with the context of the request or job it is called
+	// for, so that processors can trace their work as part of it.
+	Data(ctx context.Context) string
 	Ready() <-chan struct{}
 }
 
+// ProcessorInfo describes a registered processor.
+type ProcessorInfo struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Capabilities []string `json:"capabilities"`
+	Ready        bool     `json:"ready"`
+	Default      bool     `json:"default"`
+	Switching    bool     `json:"switching"`
+	Unavailable  bool     `json:"unavailable"`
+	Stopped      bool     `json:"stopped"`
+	InFlight     int64    `json:"inFlight"`
+}
+
+// SwitchEvent is passed to OnSwitch listeners when the active processor changes.
+type SwitchEvent struct {
+	Old string
+	New string
+}
+
+type namedProcessor struct {
+	name         string
+	processor    Processor
+	capabilities map[string]bool
+	// unavailable is set when the processor missed its start deadline with
+	// the fallback policy, until it becomes ready.
+	unavailable bool
+	// stopped is set while the service providing the processor is not
+	// running.
+	stopped bool
+	// inFlight is the number of callers that have acquired the processor.
+	inFlight int64
+	// idle is closed while inFlight is 0.
+	idle chan struct{}
+	// cancelWait stops waiting for the processor to become ready after it
+	// missed its start deadline.
+	cancelWait context.CancelFunc
+}
+
+// acquire counts a call against the processor. It must be called with the
+// controller locked.
+func (np *namedProcessor) acquire() {
+	if np.inFlight == 0 {
+		np.idle = make(chan struct{})
+	}
+	np.inFlight++
+}
+
+// release ends a call counted by acquire. It must be called with the
+// controller locked.
+func (np *namedProcessor) release() {
+	np.inFlight--
+	if np.inFlight == 0 {
+		close(np.idle)
+	}
+}
+
+// usable returns true if the processor can be selected.
+func (np *namedProcessor) usable() bool {
+	return !np.unavailable && !np.stopped
+}
+
 func (c *ProcessorController) Init() error {
+	c.processors = make(map[string]*namedProcessor)
+	c.listeners = make([]func(SwitchEvent), 0)
+	c.configured = c.Cfg.GetString("processor.default")
+	c.changed = make(chan struct{})
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.Cfg.Subscribe("processor.default", c.configChanged)
+	registry.OnStartDeadlineMissed(c.startDeadlineMissed)
+	registry.OnStateChange(c.serviceStateChanged)
+
+	c.switches = c.Metrics.Counter("processor_switches_total", "Changes of the active processor.", "from", "to")
+	c.Metrics.GaugeFunc("processor_active", "1 for the active processor, 0 for the others.", []string{"processor"}, func(emit func(float64, ...string)) {
+		for _, p := range c.List() {
+			emit(metrics.BoolValue(p.Default), p.Name)
+		}
+	})
+	c.Metrics.GaugeFunc("processor_available", "1 if the processor can be selected, 0 if it is unavailable or stopped.", []string{"processor"}, func(emit func(float64, ...string)) {
+		for _, p := range c.List() {
+			emit(metrics.BoolValue(!p.Unavailable && !p.Stopped), p.Name)
+		}
+	})
+	c.Metrics.GaugeFunc("processor_in_flight", "Calls in progress on each processor.", []string{"processor"}, func(emit func(float64, ...string)) {
+		for _, p := range c.List() {
+			emit(float64(p.InFlight), p.Name)
+		}
+	})
 	return nil
 }
 
+// ProcessorController holds the named set of processors. Services request
+// a processor by name or capability, or get the default processor.
 type ProcessorController struct {
-	Processor Processor
+	Cfg     *cfg.Cfg          `inject:""`
+	Metrics *metrics.Registry `inject:""`
+	Log     *log.Entry        `inject:""`
+
+	processors map[string]*namedProcessor
+	// order holds the processor names in the order they were registered.
+	order []string
+	// active is the name of the default processor.
+	active    string
+	switching string
+	// configured is the last seen value of processor.default. A switch made
+	// through the API is kept until processor.default itself changes.
+	configured string
+	listeners  []func(SwitchEvent)
+	switches   *metrics.Counter
+	// changed is closed and replaced whenever the processor returned by
+	// Select may have changed.
+	changed chan struct{}
+	// ctx is cancelled when the controller is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	sync.RWMutex
+	// switchMu ensures only one switch happens at a time.
+	switchMu sync.Mutex
 }
 
-func (c *ProcessorController) Set(p Processor) error {
-	log.Infof("setting processor to %T", p)
-	if c.Processor != nil {
-		return fmt.Errorf("Only 1 processor can be set.")
+// Register adds a processor under the given name, along with the
+// capabilities it provides.
+func (c *ProcessorController) Register(name string, p Processor, capabilities ...string) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.processors[name]; ok {
+		return fmt.Errorf("processor %s is already registered", name)
+	}
+	c.Log.Infof("registering processor %s (%T) with capabilities %v", name, p, capabilities)
+	np := &namedProcessor{
+		name:         name,
+		processor:    p,
+		capabilities: make(map[string]bool),
+		idle:         make(chan struct{}),
+	}
+	close(np.idle)
+	for _, capability := range capabilities {
+		np.capabilities[capability] = true
+	}
+	c.processors[name] = np
+	c.order = append(c.order, name)
+	if c.active == "" {
+		if def := c.Cfg.GetString("processor.default"); def == "" || def == name {
+			c.active = name
+		}
 	}
-	c.Processor = p
 	return nil
 }
 
+// Get returns the default processor, or nil if no processor is available.
 func (c *ProcessorController) Get() Processor {
-	return c.Processor
+	p, err := c.Default()
+	if err != nil {
+		c.Log.Error(err)
+		return nil
+	}
+	return p
+}
+
+// Default returns the active processor. This is initially the processor
+// named by processor.default.
+func (c *ProcessorController) Default() (Processor, error) {
+	c.RLock()
+	defer c.RUnlock()
+	np, err := c.defaultProcessor()
+	if err != nil {
+		return nil, err
+	}
+	return np.processor, nil
+}
+
+// defaultProcessor must be called with c locked.
+func (c *ProcessorController) defaultProcessor() (*namedProcessor, error) {
+	if c.active == "" {
+		if len(c.order) == 0 {
+			return nil, fmt.Errorf("no processors have been registered")
+		}
+		return nil, fmt.Errorf("default processor %s is not registered", c.Cfg.GetString("processor.default"))
+	}
+	return c.processors[c.active], nil
+}
+
+// GetByName returns the processor registered with the given name.
+func (c *ProcessorController) GetByName(name string) (Processor, error) {
+	c.RLock()
+	defer c.RUnlock()
+	np, ok := c.processors[name]
+	if !ok {
+		return nil, fmt.Errorf("processor %s is not registered", name)
+	}
+	return np.processor, nil
+}
+
+// GetByCapability returns a processor with the given capability. The
+// default processor is preferred, otherwise processors are tried in the
+// order they were registered.
+func (c *ProcessorController) GetByCapability(capability string) (Processor, error) {
+	c.RLock()
+	defer c.RUnlock()
+	np, err := c.processorWithCapability(capability)
+	if err != nil {
+		return nil, err
+	}
+	return np.processor, nil
+}
+
+// processorWithCapability must be called with c locked.
+func (c *ProcessorController) processorWithCapability(capability string) (*namedProcessor, error) {
+	if np, err := c.defaultProcessor(); err == nil && np.capabilities[capability] {
+		return np, nil
+	}
+	for _, name := range c.order {
+		if np := c.processors[name]; np.capabilities[capability] && np.usable() {
+			return np, nil
+		}
+	}
+	return nil, fmt.Errorf("no processor with capability %s is registered", capability)
+}
+
+// Select returns the processor configured for the given config section.
+// <section>.processor selects a processor by name, and
+// <section>.processor-capability selects one by capability. If neither
+// is set the default processor is returned. The default processor is also
+// returned in place of a named processor that missed its start deadline or
+// is stopped.
+func (c *ProcessorController) Select(section string) (Processor, error) {
+	name, capability := c.selection(section)
+	c.RLock()
+	defer c.RUnlock()
+	np, err := c.selectProcessor(section, name, capability)
+	if err != nil {
+		return nil, err
+	}
+	return np.processor, nil
+}
+
+// selection returns the processor name and capability configured for the
+// section. Both are empty if section is empty.
+func (c *ProcessorController) selection(section string) (name, capability string) {
+	if section == "" {
+		return "", ""
+	}
+	return c.Cfg.GetString(section + ".processor"), c.Cfg.GetString(section + ".processor-capability")
+}
+
+// selectProcessor returns the processor for the name and capability
+// returned by selection. It must be called with c locked.
+func (c *ProcessorController) selectProcessor(section, name, capability string) (*namedProcessor, error) {
+	if name != "" {
+		np, ok := c.processors[name]
+		if !ok {
+			return nil, fmt.Errorf("processor %s is not registered", name)
+		}
+		if !np.usable() {
+			c.Log.Debugf("%s: processor %s is unavailable. using the default processor", section, name)
+			return c.defaultProcessor()
+		}
+		return np, nil
+	}
+	if capability != "" {
+		return c.processorWithCapability(capability)
+	}
+	return c.defaultProcessor()
+}
+
+// Acquire returns the processor selected for the given config section, as
+// Select does, or the active processor if section is empty. The returned
+// release function must be called once the caller has finished with the
+// processor, so that switching processors can wait for in-flight calls.
+func (c *ProcessorController) Acquire(section string) (Processor, func(), error) {
+	name, capability := c.selection(section)
+	// the call is counted under the same lock that Switch changes the
+	// active processor under, so a switch either sees the call when it
+	// drains, or the call gets the new processor.
+	c.Lock()
+	defer c.Unlock()
+	np, err := c.selectProcessor(section, name, capability)
+	if err != nil {
+		return nil, nil, err
+	}
+	return np.processor, c.acquire(np), nil
+}
+
+// AcquireByName returns the processor registered with the given name, as
+// GetByName does. The call is counted like calls made through Acquire, so
+// the returned release function must be called once the caller has
+// finished with the processor.
+func (c *ProcessorController) AcquireByName(name string) (Processor, func(), error) {
+	c.Lock()
+	defer c.Unlock()
+	np, ok := c.processors[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("processor %s is not registered", name)
+	}
+	return np.processor, c.acquire(np), nil
+}
+
+// acquire counts a call against np, and returns the function that ends
+// it. It must be called with c locked.
+func (c *ProcessorController) acquire(np *namedProcessor) func() {
+	np.acquire()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.Lock()
+			np.release()
+			c.Unlock()
+		})
+	}
+}
+
+// WaitReady waits for the processor selected for the given config section
+// to be ready, and returns it. If the selected processor changes while
+// waiting, eg. because it missed its start deadline, WaitReady waits for
+// the new selection instead.
+func (c *ProcessorController) WaitReady(ctx context.Context, section string) (Processor, error) {
+	for {
+		c.RLock()
+		changed := c.changed
+		c.RUnlock()
+		p, err := c.Select(section)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-p.Ready():
+			return p, nil
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// notifyChanged wakes up WaitReady callers. It must be called with c locked.
+func (c *ProcessorController) notifyChanged() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Stop stops waiting for late processors to become ready.
+func (c *ProcessorController) Stop(ctx context.Context) error {
+	c.cancel()
+	return nil
+}
+
+// startDeadlineMissed is called when a service misses its start deadline.
+// If the service is a processor and the policy is DeadlineFallback, it is
+// marked unavailable and, if it is the active processor, another processor
+// is switched to until it becomes ready.
+func (c *ProcessorController) startDeadlineMissed(d *registry.Descriptor, deadline registry.StartDeadline) {
+	if deadline.Policy != registry.DeadlineFallback {
+		return
+	}
+	c.Lock()
+	np := c.processorOf(d)
+	if np == nil {
+		c.Unlock()
+		return
+	}
+	np.unavailable = true
+	c.notifyChanged()
+	active := c.active == np.name
+	fallback := c.fallbackFor(np)
+	if np.cancelWait != nil {
+		np.cancelWait()
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	np.cancelWait = cancel
+	c.Unlock()
+	c.Log.Warnf("processor %s is unavailable until it becomes ready", np.name)
+
+	if !active {
+		fallback = ""
+	}
+	go c.awaitLate(ctx, np, fallback)
+
+	if active {
+		c.fallBack(np, fallback)
+	}
+}
+
+// awaitLate waits for a processor that missed its start deadline to become
+// ready and makes it available again. If it was the active processor and
+// the fallback is still active, it is switched back to. Waiting stops if
+// the service providing the processor is stopped.
+func (c *ProcessorController) awaitLate(ctx context.Context, np *namedProcessor, fallback string) {
+	select {
+	case <-np.processor.Ready():
+	case <-ctx.Done():
+		return
+	}
+	c.Lock()
+	if ctx.Err() != nil {
+		c.Unlock()
+		return
+	}
+	defer np.cancelWait()
+	np.unavailable = false
+	np.cancelWait = nil
+	c.notifyChanged()
+	switchBack := fallback != "" && (c.active == fallback || c.switching == fallback)
+	c.Unlock()
+	c.Log.Infof("processor %s is now ready and available", np.name)
+
+	if switchBack {
+		// waits for the switch to the fallback if it is still in progress.
+		if err := c.Switch(ctx, np.name); err != nil {
+			c.Log.Errorf("failed to switch back from processor %s to %s. %s", fallback, np.name, err)
+		}
+	}
+}
+
+// serviceStateChanged marks the processor of a service that is not running
+// as stopped, and falls back to another processor if it was active.
+func (c *ProcessorController) serviceStateChanged(d *registry.Descriptor, old, state registry.ServiceState) {
+	stopped := state != registry.StateRunning
+	c.Lock()
+	np := c.processorOf(d)
+	if np == nil || np.stopped == stopped {
+		c.Unlock()
+		return
+	}
+	np.stopped = stopped
+	if np.cancelWait != nil {
+		// the deadline applies to each start of the service.
+		np.cancelWait()
+		np.cancelWait = nil
+		np.unavailable = false
+	}
+	c.notifyChanged()
+	active := c.active == np.name
+	fallback := c.fallbackFor(np)
+	// the service may be started again soon, so only fall back to a
+	// processor that can take over straight away.
+	ready := fallback != "" && isReady(c.processors[fallback].processor)
+	c.Unlock()
+
+	if !stopped {
+		c.Log.Infof("processor %s is available again", np.name)
+		return
+	}
+	c.Log.Warnf("processor %s is unavailable as %s is %s", np.name, d.Name, state)
+	if !active {
+		return
+	}
+	if !ready {
+		c.Log.Errorf("no ready processor to fall back to from %s", np.name)
+		return
+	}
+	c.fallBack(np, fallback)
+}
+
+// fallBack switches from np to the fallback processor in the background.
+func (c *ProcessorController) fallBack(np *namedProcessor, fallback string) {
+	if fallback == "" {
+		c.Log.Errorf("no processor available to fall back to from %s", np.name)
+		return
+	}
+	go func() {
+		if err := c.Switch(context.Background(), fallback); err != nil {
+			c.Log.Errorf("failed to fall back from processor %s to %s. %s", np.name, fallback, err)
+		}
+	}()
+}
+
+// processorOf returns the processor provided by the service, or nil. It
+// must be called with c locked.
+func (c *ProcessorController) processorOf(d *registry.Descriptor) *namedProcessor {
+	for _, np := range c.processors {
+		if interface{}(np.processor) == interface{}(d.Instance) {
+			return np
+		}
+	}
+	return nil
+}
+
+// fallbackFor returns the name of the processor to use in place of np. Ready
+// processors that have all the capabilities of np are preferred. It must be
+// called with c locked.
+func (c *ProcessorController) fallbackFor(np *namedProcessor) string {
+	best, bestScore := "", -1
+	for _, name := range c.order {
+		candidate := c.processors[name]
+		if candidate == np || !candidate.usable() {
+			continue
+		}
+		score := 0
+		if isReady(candidate.processor) {
+			score += 2
+		}
+		hasAll := true
+		for capability := range np.capabilities {
+			if !candidate.capabilities[capability] {
+				hasAll = false
+			}
+		}
+		if hasAll {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best
+}
+
+// OnSwitch registers a listener that is called whenever the active
+// processor changes.
+func (c *ProcessorController) OnSwitch(l func(SwitchEvent)) {
+	c.Lock()
+	c.listeners = append(c.listeners, l)
+	c.Unlock()
+}
+
+// Active returns the name of the active processor, and the name of the
+// processor being switched to if a switch is in progress.
+func (c *ProcessorController) Active() (string, string) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.active, c.switching
+}
+
+// Switch makes the named processor the active processor. It waits for the
+// new processor to be ready before cutting over, then waits for in-flight
+// calls to the old processor to complete before notifying listeners. If
+// the new processor does not become ready within processor.switch-timeout,
+// or ctx is done first, the active processor is left unchanged.
+func (c *ProcessorController) Switch(ctx context.Context, name string) error {
+	c.switchMu.Lock()
+	defer c.switchMu.Unlock()
+
+	c.Lock()
+	np, ok := c.processors[name]
+	old := c.active
+	stopped := ok && np.stopped
+	if ok && !stopped && old != name {
+		c.switching = name
+	}
+	c.Unlock()
+	if !ok {
+		return fmt.Errorf("processor %s is not registered", name)
+	}
+	if stopped {
+		return fmt.Errorf("processor %s is not running", name)
+	}
+	if old == name {
+		return nil
+	}
+	defer func() {
+		c.Lock()
+		c.switching = ""
+		c.Unlock()
+	}()
+
+	c.Log.Infof("switching processor from %s to %s. waiting for %s to be ready.", old, name, name)
+	timeout := c.Cfg.GetDuration("processor.switch-timeout")
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case <-np.processor.Ready():
+	case <-ctx.Done():
+		return fmt.Errorf("processor %s did not become ready. %s", name, ctx.Err())
+	}
+
+	c.Lock()
+	c.active = name
+	c.notifyChanged()
+	oldProcessor := c.processors[old]
+	listeners := make([]func(SwitchEvent), len(c.listeners))
+	copy(listeners, c.listeners)
+	c.Unlock()
+	c.Log.Infof("processor %s is now active", name)
+	c.switches.Inc(old, name)
+
+	if oldProcessor != nil {
+		c.drain(oldProcessor)
+	}
+
+	event := SwitchEvent{Old: old, New: name}
+	for _, l := range listeners {
+		l(event)
+	}
+	return nil
+}
+
+// drain waits for in-flight calls to the processor to complete, for at
+// most processor.drain-timeout.
+func (c *ProcessorController) drain(np *namedProcessor) {
+	c.RLock()
+	idle := np.idle
+	c.RUnlock()
+	timer := time.NewTimer(c.Cfg.GetDuration("processor.drain-timeout"))
+	defer timer.Stop()
+	select {
+	case <-idle:
+		c.Log.Infof("processor %s drained", np.name)
+	case <-timer.C:
+		c.RLock()
+		inFlight := np.inFlight
+		c.RUnlock()
+		c.Log.Warnf("processor %s still has %d calls in flight after switching away from it", np.name, inFlight)
+	}
+}
+
+// configChanged switches the active processor when processor.default
+// changes.
+func (c *ProcessorController) configChanged(e cfg.ChangeEvent) {
+	name := c.Cfg.GetString("processor.default")
+	c.Lock()
+	changed := name != c.configured
+	c.configured = name
+	c.Unlock()
+	if !changed || name == "" {
+		return
+	}
+	if err := c.Switch(context.Background(), name); err != nil {
+		c.Log.Errorf("failed to switch processor. %s", err)
+	}
+}
+
+// List returns information about all registered processors, in the
+// order they were registered.
+func (c *ProcessorController) List() []ProcessorInfo {
+	c.RLock()
+	defer c.RUnlock()
+	def, _ := c.defaultProcessor()
+	result := make([]ProcessorInfo, 0, len(c.order))
+	for _, name := range c.order {
+		np := c.processors[name]
+		capabilities := make([]string, 0, len(np.capabilities))
+		for capability := range np.capabilities {
+			capabilities = append(capabilities, capability)
+		}
+		sort.Strings(capabilities)
+		result = append(result, ProcessorInfo{
+			Name:         name,
+			Type:         fmt.Sprintf("%T", np.processor),
+			Capabilities: capabilities,
+			Ready:        isReady(np.processor),
+			Default:      np == def,
+			Switching:    name == c.switching,
+			Unavailable:  np.unavailable,
+			Stopped:      np.stopped,
+			InFlight:     np.inFlight,
+		})
+	}
+	return result
+}
+
+// RegisterRoutes adds the admin endpoint used to switch the active processor.
+func (c *ProcessorController) RegisterRoutes(r *RouteGroup) {
+	r.Admin().Post("/processors/:name/activate", c.activate).Name("activate")
+}
+
+// activate switches the active processor, and responds once the switch is
+// complete.
+func (c *ProcessorController) activate(ctx *macaron.Context) {
+	name := ctx.Params(":name")
+	if _, err := c.GetByName(name); err != nil {
+		ctx.PlainText(404, []byte(err.Error()))
+		return
+	}
+	if err := c.Switch(ctx.Req.Context(), name); err != nil {
+		ctx.PlainText(503, []byte(err.Error()))
+		return
+	}
+	ctx.JSON(200, c.List())
+}
+
+func isReady(p Processor) bool {
+	select {
+	case <-p.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ProcessorController) Health(ctx context.Context) registry.HealthStatus {
+	c.RLock()
+	np, err := c.defaultProcessor()
+	c.RUnlock()
+	if err != nil {
+		return registry.HealthStatus{Status: registry.HealthDown, Message: err.Error()}
+	}
+	status := registry.HealthStatus{
+		Status:  registry.HealthUp,
+		Details: map[string]interface{}{"default": np.name, "processors": len(c.List())},
+	}
+	if !isReady(np.processor) {
+		status.Status = registry.HealthStarting
+		status.Message = "default processor is not ready"
+	}
+	return status
 }
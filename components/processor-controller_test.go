@@ -0,0 +1,430 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/metrics"
+	"github.com/woodsaj/go-server/registry"
+	"gopkg.in/macaron.v1"
+)
+
+// stubProcessor is a processor whose Data returns its name. It is ready
+// once ready is closed.
+type stubProcessor struct {
+	name         string
+	capabilities []string
+	ready        chan struct{}
+}
+
+// newStub returns a processor with the capabilities "cap-<name>" and
+// capabilities.
+func newStub(name string, ready bool, capabilities ...string) *stubProcessor {
+	p := &stubProcessor{name: name, capabilities: append([]string{"cap-" + name}, capabilities...), ready: make(chan struct{})}
+	if ready {
+		close(p.ready)
+	}
+	return p
+}
+
+func (p *stubProcessor) Init() error { return nil }
+
+func (p *stubProcessor) Data(ctx context.Context) string { return p.name }
+
+func (p *stubProcessor) Ready() <-chan struct{} { return p.ready }
+
+// newTestController returns an initialized controller with the given
+// processors registered, in order, under their names.
+func newTestController(t *testing.T, overrides map[string]string, processors ...*stubProcessor) *ProcessorController {
+	logger := log.New()
+	logger.Out = io.Discard
+	c := &ProcessorController{
+		Cfg:     newTestCfg(t, overrides),
+		Metrics: metrics.New(),
+		Log:     log.NewEntry(logger),
+	}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Stop(context.Background()) })
+	for _, p := range processors {
+		if err := c.Register(p.name, p, p.capabilities...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func init() {
+	// the processor selection of a section, as set by the workers.
+	cfg.SetDefault("proctest.processor", "")
+	cfg.SetDefault("proctest.processor-capability", "")
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func processorInfo(c *ProcessorController, name string) ProcessorInfo {
+	for _, p := range c.List() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return ProcessorInfo{}
+}
+
+func isActive(c *ProcessorController, name string) func() bool {
+	return func() bool {
+		active, switching := c.Active()
+		return active == name && switching == ""
+	}
+}
+
+func inFlight(c *ProcessorController, name string) int64 {
+	for _, p := range c.List() {
+		if p.Name == name {
+			return p.InFlight
+		}
+	}
+	return -1
+}
+
+func TestAcquireByName(t *testing.T) {
+	c := newTestController(t, nil, newStub("foo", true), newStub("bar", true))
+	p, release, err := c.AcquireByName("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := p.Data(context.Background()); data != "foo" {
+		t.Errorf("got processor %s, want foo", data)
+	}
+	if n := inFlight(c, "foo"); n != 1 {
+		t.Errorf("foo has %d calls in flight, want 1", n)
+	}
+
+	// switching away from foo waits for the call to be released.
+	switched := make(chan error)
+	go func() {
+		switched <- c.Switch(context.Background(), "bar")
+	}()
+	select {
+	case err := <-switched:
+		t.Fatalf("switch did not wait for the call in flight. %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if active, _ := c.Active(); active != "bar" {
+		t.Errorf("active processor is %s while draining foo, want bar", active)
+	}
+	release()
+	release()
+	if err := <-switched; err != nil {
+		t.Fatal(err)
+	}
+	if n := inFlight(c, "foo"); n != 0 {
+		t.Errorf("foo has %d calls in flight after release, want 0", n)
+	}
+
+	if _, _, err := c.AcquireByName("baz"); err == nil || err.Error() != "processor baz is not registered" {
+		t.Errorf("got error %v for an unknown processor", err)
+	}
+}
+
+func TestActivateRoute(t *testing.T) {
+	c := newTestController(t, nil, newStub("foo", true), newStub("bar", true))
+	d := &registry.Descriptor{Name: "ProcessorController", Instance: c}
+	d.SetState(registry.StateRunning)
+	registerServices(t, d)
+	r := newTestRouter(t)
+	r.Cfg = newTestCfg(t, map[string]string{"api.admin-token": "secret"})
+	if err := r.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	r.Mount(m)
+
+	activate := func(name, auth string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/processors/"+name+"/activate", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		m.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := activate("bar", ""); code != 401 {
+		t.Errorf("activate without a token: got %d, want 401", code)
+	}
+	if active, _ := c.Active(); active != "foo" {
+		t.Errorf("activate without a token switched to %s", active)
+	}
+	if code := activate("bar", "Bearer secret"); code != 200 {
+		t.Errorf("activate: got %d, want 200", code)
+	}
+	if active, _ := c.Active(); active != "bar" {
+		t.Errorf("active processor is %s, want bar", active)
+	}
+	if code := activate("baz", "Bearer secret"); code != 404 {
+		t.Errorf("activate an unknown processor: got %d, want 404", code)
+	}
+}
+
+func TestProcessorDefault(t *testing.T) {
+	tests := []struct {
+		name       string
+		def        string
+		processors []*stubProcessor
+		want       string
+		err        string
+	}{
+		{name: "first registered", processors: []*stubProcessor{newStub("foo", true), newStub("bar", true)}, want: "foo"},
+		{name: "configured", def: "bar", processors: []*stubProcessor{newStub("foo", true), newStub("bar", false)}, want: "bar"},
+		{name: "not registered", def: "baz", processors: []*stubProcessor{newStub("foo", true)}, err: "default processor baz is not registered"},
+		{name: "none registered", err: "no processors have been registered"},
+	}
+	for _, tt := range tests {
+		c := newTestController(t, map[string]string{"processor.default": tt.def}, tt.processors...)
+		p, err := c.Default()
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && p.Data(context.Background()) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, p.Data(context.Background()), tt.want)
+		}
+	}
+
+	c := newTestController(t, nil, newStub("foo", true))
+	if err := c.Register("foo", newStub("foo", true)); err == nil || err.Error() != "processor foo is already registered" {
+		t.Errorf("got error %v registering foo twice", err)
+	}
+}
+
+func TestProcessorSelect(t *testing.T) {
+	tests := []struct {
+		name       string
+		processor  string
+		capability string
+		// unavailable is the processor that missed its start deadline.
+		unavailable string
+		want        string
+		err         string
+	}{
+		{name: "default", want: "foo"},
+		{name: "by name", processor: "bar", want: "bar"},
+		{name: "name wins over capability", processor: "bar", capability: "cap-baz", want: "bar"},
+		{name: "unknown name", processor: "nope", err: "processor nope is not registered"},
+		{name: "by capability", capability: "cap-bar", want: "bar"},
+		{name: "default preferred for capability", capability: "shared", want: "foo"},
+		{name: "capability in registration order", capability: "extra", want: "bar"},
+		{name: "unknown capability", capability: "nope", err: "no processor with capability nope is registered"},
+		{name: "unavailable by name", processor: "bar", unavailable: "bar", want: "foo"},
+		{name: "unavailable skipped for capability", capability: "extra", unavailable: "bar", want: "baz"},
+	}
+	for _, tt := range tests {
+		processors := map[string]*stubProcessor{
+			"foo": newStub("foo", true, "shared"),
+			"bar": newStub("bar", false, "shared", "extra"),
+			"baz": newStub("baz", true, "extra"),
+		}
+		c := newTestController(t, map[string]string{
+			"proctest.processor":            tt.processor,
+			"proctest.processor-capability": tt.capability,
+		}, processors["foo"], processors["bar"], processors["baz"])
+		if tt.unavailable != "" {
+			d := &registry.Descriptor{Name: tt.unavailable, Instance: processors[tt.unavailable]}
+			d.AwaitReady(context.Background(), registry.StartDeadline{Timeout: time.Millisecond, Policy: registry.DeadlineFallback})
+		}
+
+		p, err := c.Select("proctest")
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && p.Data(context.Background()) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, p.Data(context.Background()), tt.want)
+		}
+	}
+}
+
+func TestProcessorSwitch(t *testing.T) {
+	bar := newStub("bar", false)
+	c := newTestController(t, nil, newStub("foo", true), bar)
+	var events []SwitchEvent
+	c.OnSwitch(func(e SwitchEvent) { events = append(events, e) })
+
+	switched := make(chan error)
+	go func() {
+		switched <- c.Switch(context.Background(), "bar")
+	}()
+	// the switch waits for bar to be ready.
+	waitUntil(t, "the switch to start", func() bool {
+		_, switching := c.Active()
+		return switching == "bar"
+	})
+	if active, _ := c.Active(); active != "foo" {
+		t.Errorf("switched to %s before bar was ready", active)
+	}
+	if !processorInfo(c, "bar").Switching {
+		t.Error("bar is not reported as being switched to")
+	}
+	close(bar.ready)
+	if err := <-switched; err != nil {
+		t.Fatal(err)
+	}
+	if !isActive(c, "bar")() {
+		t.Errorf("bar is not active")
+	}
+	if len(events) != 1 || events[0] != (SwitchEvent{Old: "foo", New: "bar"}) {
+		t.Errorf("got switch events %+v", events)
+	}
+
+	// switching to the active processor does nothing.
+	if err := c.Switch(context.Background(), "bar"); err != nil || len(events) != 1 {
+		t.Errorf("switch to the active processor: got %v and %d events", err, len(events))
+	}
+	if err := c.Switch(context.Background(), "nope"); err == nil || err.Error() != "processor nope is not registered" {
+		t.Errorf("got error %v switching to an unknown processor", err)
+	}
+}
+
+func TestProcessorSwitchTimeout(t *testing.T) {
+	c := newTestController(t, map[string]string{"processor.switch-timeout": "10ms"}, newStub("foo", true), newStub("bar", false))
+	err := c.Switch(context.Background(), "bar")
+	if want := "processor bar did not become ready. context deadline exceeded"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+	if !isActive(c, "foo")() {
+		t.Error("active processor changed after a failed switch")
+	}
+}
+
+func TestProcessorSwitchDrainTimeout(t *testing.T) {
+	c := newTestController(t, map[string]string{"processor.drain-timeout": "10ms"}, newStub("foo", true), newStub("bar", true))
+	_, release, err := c.Acquire("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	done := make(chan error)
+	go func() {
+		done <- c.Switch(context.Background(), "bar")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("switch waited for the call in flight after the drain timeout")
+	}
+	if n := inFlight(c, "foo"); n != 1 {
+		t.Errorf("foo has %d calls in flight, want 1", n)
+	}
+	// new calls get the new processor.
+	p, release, err := c.Acquire("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if data := p.Data(context.Background()); data != "bar" {
+		t.Errorf("acquired %s after the switch, want bar", data)
+	}
+}
+
+func TestStartDeadlineFallback(t *testing.T) {
+	tests := []struct {
+		policy registry.DeadlinePolicy
+		// fallback is the processor used while bar is not ready.
+		fallback string
+	}{
+		{policy: registry.DeadlineFallback, fallback: "foo"},
+		{policy: registry.DeadlineDegraded, fallback: "bar"},
+		{policy: registry.DeadlineFail, fallback: "bar"},
+	}
+	for _, tt := range tests {
+		bar := newStub("bar", false)
+		c := newTestController(t, map[string]string{"processor.default": "bar"}, newStub("foo", true), bar)
+		d := &registry.Descriptor{Name: "Bar", Instance: bar}
+		err := d.AwaitReady(context.Background(), registry.StartDeadline{Timeout: time.Millisecond, Policy: tt.policy})
+		if err == nil {
+			t.Fatalf("%s: bar did not miss its start deadline", tt.policy)
+		}
+		waitUntil(t, fmt.Sprintf("%s: %s to be active", tt.policy, tt.fallback), isActive(c, tt.fallback))
+		if unavailable := processorInfo(c, "bar").Unavailable; unavailable != (tt.policy == registry.DeadlineFallback) {
+			t.Errorf("%s: bar unavailable = %t", tt.policy, unavailable)
+		}
+
+		// bar is switched back to once it is ready.
+		close(bar.ready)
+		waitUntil(t, fmt.Sprintf("%s: bar to be active", tt.policy), isActive(c, "bar"))
+		waitUntil(t, fmt.Sprintf("%s: bar to be available", tt.policy), func() bool { return !processorInfo(c, "bar").Unavailable })
+	}
+}
+
+func TestStartDeadlineFallbackNotActive(t *testing.T) {
+	bar := newStub("bar", false)
+	c := newTestController(t, map[string]string{"proctest.processor": "bar"}, newStub("foo", true), bar)
+	ready := make(chan Processor)
+	go func() {
+		p, err := c.WaitReady(context.Background(), "proctest")
+		if err != nil {
+			t.Error(err)
+		}
+		ready <- p
+	}()
+
+	d := &registry.Descriptor{Name: "Bar", Instance: bar}
+	d.AwaitReady(context.Background(), registry.StartDeadline{Timeout: time.Millisecond, Policy: registry.DeadlineFallback})
+	// callers waiting for bar get the default processor instead.
+	if p := <-ready; p.Data(context.Background()) != "foo" {
+		t.Errorf("WaitReady returned %s, want foo", p.Data(context.Background()))
+	}
+	close(bar.ready)
+	waitUntil(t, "bar to be available", func() bool { return !processorInfo(c, "bar").Unavailable })
+	if !isActive(c, "foo")() {
+		t.Error("switched to bar, which was not the active processor")
+	}
+	p, err := c.Select("proctest")
+	if err != nil || p.Data(context.Background()) != "bar" {
+		t.Errorf("got %v, %v once bar is ready, want bar", p, err)
+	}
+}
+
+func TestStoppedProcessorFallback(t *testing.T) {
+	bar := newStub("bar", true)
+	c := newTestController(t, map[string]string{"processor.default": "bar"}, newStub("foo", true), bar)
+	d := &registry.Descriptor{Name: "Bar", Instance: bar}
+	d.SetState(registry.StateRunning)
+	d.SetState(registry.StateStopped)
+	waitUntil(t, "foo to be active", isActive(c, "foo"))
+	if !processorInfo(c, "bar").Stopped {
+		t.Error("bar is not reported as stopped")
+	}
+	if err := c.Switch(context.Background(), "bar"); err == nil || err.Error() != "processor bar is not running" {
+		t.Errorf("got error %v switching to a stopped processor", err)
+	}
+
+	// once started, bar can be selected but is not switched back to.
+	d.SetState(registry.StateRunning)
+	if processorInfo(c, "bar").Stopped {
+		t.Error("bar is still reported as stopped")
+	}
+	if err := c.Switch(context.Background(), "bar"); err != nil {
+		t.Error(err)
+	}
+}
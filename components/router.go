@@ -0,0 +1,288 @@
+package components
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/metrics"
+	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
+	"gopkg.in/macaron.v1"
+)
+
+func init() {
+	registry.RegisterService(&Router{}, 99)
+
+	// bearer token required by admin routes. If empty, they are disabled.
+	// It is an api setting, as the Api serves the routes.
+	cfg.SetSecretDefault("api.admin-token", "")
+}
+
+// RouteRegistrar is implemented by services that provide HTTP routes.
+// RegisterRoutes is called once all services have been initialized, with a
+// RouteGroup owned by the service. It is called for every service, including
+// ones that are not running, as services can be started and stopped at
+// runtime. Routes are only served while their service is running. Routes
+// that change state must be registered through RouteGroup.Admin.
+type RouteRegistrar interface {
+	RegisterRoutes(r *RouteGroup)
+}
+
+// Route is a HTTP route registered by a service.
+type Route struct {
+	Method   string
+	Path     string
+	Owner    string
+	Handlers []macaron.Handler
+
+	name string
+}
+
+// Name sets the name of the route. The name is prefixed with the name
+// of the service that owns the route, eg. "WorkerA.status".
+func (r *Route) Name(name string) *Route {
+	r.name = r.Owner + "." + name
+	return r
+}
+
+// Router collects the HTTP routes of all services so that they can be
+// mounted by the Api. The routes are collected and checked for conflicts
+// before any background service is started, so a conflict stops the server
+// from starting rather than failing the Api.
+type Router struct {
+	Cfg     *cfg.Cfg          `inject:""`
+	Metrics *metrics.Registry `inject:""`
+	Tracer  *tracing.Tracer   `inject:""`
+
+	routes   []*Route
+	duration *metrics.Histogram
+	sync.Mutex
+}
+
+func (r *Router) Init() error {
+	r.routes = make([]*Route, 0)
+	r.duration = r.Metrics.Histogram("http_request_duration_seconds", "Time taken to serve HTTP requests, by route.", nil, "method", "route", "status")
+	return nil
+}
+
+// Group returns a RouteGroup for registering routes owned by the named
+// service. All routes in the group have their path prefixed with prefix
+// and are passed through the given middleware before their own handlers.
+func (r *Router) Group(owner, prefix string, middleware ...macaron.Handler) *RouteGroup {
+	return &RouteGroup{
+		router:     r,
+		owner:      owner,
+		prefix:     prefix,
+		middleware: middleware,
+	}
+}
+
+// Verify collects the routes of every service and returns an error listing
+// every path that has been claimed by more than one route.
+func (r *Router) Verify() error {
+	r.Lock()
+	r.routes = make([]*Route, 0)
+	r.Unlock()
+	for _, d := range registry.GetServices() {
+		if registrar, ok := d.Instance.(RouteRegistrar); ok {
+			registrar.RegisterRoutes(r.Group(d.Name, "", requireRunning(d)))
+		}
+	}
+	return r.conflicts()
+}
+
+func (r *Router) add(route *Route) {
+	r.Lock()
+	r.routes = append(r.routes, route)
+	r.Unlock()
+}
+
+func (r *Router) conflicts() error {
+	r.Lock()
+	defer r.Unlock()
+
+	claimed := make(map[string]*Route)
+	named := make(map[string]*Route)
+	var conflicts []string
+	for _, route := range r.routes {
+		key := route.Method + " " + normalizePath(route.Path)
+		if existing, ok := claimed[key]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s claimed by %s and %s", route.Method, route.Path, existing.Owner, route.Owner))
+			continue
+		}
+		claimed[key] = route
+		if route.name == "" {
+			continue
+		}
+		if existing, ok := named[route.name]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("route name %s used by %s %s and %s %s", route.name, existing.Method, existing.Path, route.Method, route.Path))
+			continue
+		}
+		named[route.name] = route
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("conflicting routes: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// Mount adds all registered routes to m.
+func (r *Router) Mount(m *macaron.Macaron) {
+	r.Lock()
+	defer r.Unlock()
+	for _, route := range r.routes {
+		handlers := append([]macaron.Handler{r.instrument(route)}, route.Handlers...)
+		mounted := m.Handle(route.Method, route.Path, handlers)
+		if route.name != "" {
+			mounted.Name(route.name)
+		}
+	}
+}
+
+// requireRunning only lets requests through to the routes of a service
+// while it is running.
+func requireRunning(d *registry.Descriptor) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		if state := d.State(); state != registry.StateRunning {
+			ctx.PlainText(503, []byte(fmt.Sprintf("%s is %s", d.Name, state)))
+		}
+	}
+}
+
+// RequireAdmin only lets requests with the api.admin-token bearer token
+// through.
+func (r *Router) RequireAdmin(ctx *macaron.Context) {
+	token := r.Cfg.GetString("api.admin-token")
+	if token == "" {
+		ctx.PlainText(403, []byte("admin endpoints are disabled as api.admin-token is not set"))
+		return
+	}
+	auth := ctx.Req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+		ctx.Resp.Header().Set("WWW-Authenticate", "Bearer")
+		ctx.PlainText(401, []byte("invalid admin token"))
+		return
+	}
+}
+
+// instrument records the time taken to serve requests to the route, and
+// traces each request. The trace continues the caller's trace if the
+// request has a traceparent header, and the request context carries the
+// span so that handlers can start child spans.
+func (r *Router) instrument(route *Route) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		start := time.Now()
+		reqCtx, span := r.Tracer.Start(tracing.Extract(ctx.Req.Context(), ctx.Req.Header), route.Method+" "+route.Path)
+		span.SetKind(tracing.KindServer)
+		span.SetAttribute("http.method", route.Method)
+		span.SetAttribute("http.route", route.Path)
+		span.SetAttribute("http.target", ctx.Req.URL.RequestURI())
+		span.SetAttribute("service", route.Owner)
+		ctx.Req.Request = ctx.Req.WithContext(reqCtx)
+
+		ctx.Next()
+
+		status := ctx.Resp.Status()
+		span.SetAttribute("http.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+		span.End()
+		r.duration.Observe(time.Since(start).Seconds(), route.Method, route.Path, strconv.Itoa(status))
+	}
+}
+
+// Routes returns a copy of all registered routes.
+func (r *Router) Routes() []Route {
+	r.Lock()
+	defer r.Unlock()
+	routes := make([]Route, len(r.routes))
+	for i, route := range r.routes {
+		routes[i] = *route
+	}
+	return routes
+}
+
+// normalizePath replaces named parameters in path so that routes that
+// only differ by parameter names are detected as conflicts.
+func normalizePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[i] = ":"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// RouteGroup registers routes owned by a single service.
+type RouteGroup struct {
+	router     *Router
+	owner      string
+	prefix     string
+	middleware []macaron.Handler
+}
+
+// Group returns a sub group with prefix appended to the path prefix of g,
+// and middleware appended to its middleware.
+func (g *RouteGroup) Group(prefix string, middleware ...macaron.Handler) *RouteGroup {
+	mw := make([]macaron.Handler, 0, len(g.middleware)+len(middleware))
+	mw = append(mw, g.middleware...)
+	mw = append(mw, middleware...)
+	return &RouteGroup{
+		router:     g.router,
+		owner:      g.owner,
+		prefix:     g.prefix + prefix,
+		middleware: mw,
+	}
+}
+
+// Admin returns a sub group whose routes require the api.admin-token
+// bearer token. See Router.RequireAdmin.
+func (g *RouteGroup) Admin() *RouteGroup {
+	return g.Group("", g.router.RequireAdmin)
+}
+
+// Handle registers a route. Any handlers before the last one act as
+// middleware for the route.
+func (g *RouteGroup) Handle(method, path string, handlers ...macaron.Handler) *Route {
+	h := make([]macaron.Handler, 0, len(g.middleware)+len(handlers))
+	h = append(h, g.middleware...)
+	h = append(h, handlers...)
+	route := &Route{
+		Method:   strings.ToUpper(method),
+		Path:     g.prefix + path,
+		Owner:    g.owner,
+		Handlers: h,
+	}
+	g.router.add(route)
+	return route
+}
+
+func (g *RouteGroup) Get(path string, handlers ...macaron.Handler) *Route {
+	return g.Handle("GET", path, handlers...)
+}
+
+func (g *RouteGroup) Post(path string, handlers ...macaron.Handler) *Route {
+	return g.Handle("POST", path, handlers...)
+}
+
+func (g *RouteGroup) Put(path string, handlers ...macaron.Handler) *Route {
+	return g.Handle("PUT", path, handlers...)
+}
+
+func (g *RouteGroup) Patch(path string, handlers ...macaron.Handler) *Route {
+	return g.Handle("PATCH", path, handlers...)
+}
+
+func (g *RouteGroup) Delete(path string, handlers ...macaron.Handler) *Route {
+	return g.Handle("DELETE", path, handlers...)
+}
@@ -0,0 +1,198 @@
+package components
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/woodsaj/go-server/metrics"
+	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
+	"gopkg.in/macaron.v1"
+)
+
+func TestRouterConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(r *Router)
+		err      string
+	}{
+		{
+			name: "distinct routes",
+			register: func(r *Router) {
+				a := r.Group("A", "/a")
+				a.Get("/items/:id", nop).Name("item")
+				a.Get("/items", nop).Name("items")
+				a.Post("/items/:id", nop)
+				r.Group("B", "/b").Get("/items/:id", nop).Name("item")
+			},
+		},
+		{
+			name: "same path",
+			register: func(r *Router) {
+				r.Group("A", "").Get("/items", nop)
+				r.Group("B", "").Handle("get", "/items", nop)
+			},
+			err: "conflicting routes: GET /items claimed by A and B",
+		},
+		{
+			name: "parameter names are ignored",
+			register: func(r *Router) {
+				r.Group("A", "").Get("/a/:x", nop)
+				r.Group("B", "/a").Get("/:y", nop)
+			},
+			err: "conflicting routes: GET /a/:y claimed by A and B",
+		},
+		{
+			name: "route name reused within a service",
+			register: func(r *Router) {
+				a := r.Group("A", "/a")
+				a.Get("/items", nop).Name("items")
+				a.Group("/v2").Get("/items", nop).Name("items")
+			},
+			err: "conflicting routes: route name A.items used by GET /a/items and GET /a/v2/items",
+		},
+		{
+			name: "every conflict is reported",
+			register: func(r *Router) {
+				r.Group("A", "").Delete("/x", nop)
+				r.Group("B", "").Delete("/x", nop)
+				r.Group("A", "").Put("/:id", nop)
+				r.Group("C", "").Put("/:name", nop)
+			},
+			err: "conflicting routes: DELETE /x claimed by A and B; PUT /:name claimed by A and C",
+		},
+	}
+	for _, tt := range tests {
+		r := &Router{}
+		tt.register(r)
+		err := r.conflicts()
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func nop(ctx *macaron.Context) {
+	ctx.PlainText(200, []byte("ok"))
+}
+
+// fakeRoutes is a service with a single route.
+type fakeRoutes struct {
+	path string
+}
+
+func (f *fakeRoutes) Init() error { return nil }
+
+func (f *fakeRoutes) RegisterRoutes(r *RouteGroup) {
+	r.Get(f.path, nop).Name("get")
+}
+
+func newTestRouter(t *testing.T) *Router {
+	r := &Router{Cfg: newTestCfg(t, nil), Metrics: metrics.New(), Tracer: tracing.New("test", nil)}
+	t.Cleanup(func() { r.Tracer.Shutdown(context.Background()) })
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRouterVerify(t *testing.T) {
+	registerServices(t,
+		&registry.Descriptor{Name: "A", Instance: &fakeRoutes{path: "/a/:id"}},
+		&registry.Descriptor{Name: "B", Instance: &fakeRoutes{path: "/a/:name"}},
+	)
+	err := newTestRouter(t).Verify()
+	want := "conflicting routes: GET /a/:name claimed by A and B"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestRouterRequireRunning(t *testing.T) {
+	a := &registry.Descriptor{Name: "A", Instance: &fakeRoutes{path: "/a"}}
+	b := &registry.Descriptor{Name: "B", Instance: &fakeRoutes{path: "/b"}}
+	registerServices(t, a, b)
+	r := newTestRouter(t)
+	if err := r.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	r.Mount(m)
+
+	a.SetState(registry.StateRunning)
+	b.SetState(registry.StateStopped)
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/a", 200, "ok"},
+		{"/b", 503, "B is stopped"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || strings.TrimSpace(w.Body.String()) != tt.body {
+			t.Errorf("GET %s: got %d %q, want %d %q", tt.path, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+
+	// routes answer again once their service is started.
+	b.SetState(registry.StateRunning)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/b", nil))
+	if w.Code != 200 {
+		t.Errorf("GET /b: got %d once B is running", w.Code)
+	}
+}
+
+// fakeAdmin is a service with a single admin route.
+type fakeAdmin struct{}
+
+func (f *fakeAdmin) Init() error { return nil }
+
+func (f *fakeAdmin) RegisterRoutes(r *RouteGroup) {
+	r.Admin().Post("/admin", nop).Name("admin")
+}
+
+func TestRouterAdmin(t *testing.T) {
+	d := &registry.Descriptor{Name: "A", Instance: &fakeAdmin{}}
+	d.SetState(registry.StateRunning)
+	registerServices(t, d)
+	tests := []struct {
+		name  string
+		token string
+		auth  string
+		code  int
+		body  string
+	}{
+		{name: "disabled", auth: "Bearer secret", code: 403, body: "admin endpoints are disabled as api.admin-token is not set"},
+		{name: "no token", token: "secret", code: 401, body: "invalid admin token"},
+		{name: "wrong token", token: "secret", auth: "Bearer wrong", code: 401, body: "invalid admin token"},
+		{name: "not a bearer token", token: "secret", auth: "Basic secret", code: 401, body: "invalid admin token"},
+		{name: "valid token", token: "secret", auth: "Bearer secret", code: 200, body: "ok"},
+	}
+	for _, tt := range tests {
+		r := newTestRouter(t)
+		r.Cfg = newTestCfg(t, map[string]string{"api.admin-token": tt.token})
+		if err := r.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		m := macaron.New()
+		m.Use(macaron.Renderer())
+		r.Mount(m)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/admin", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		m.ServeHTTP(w, req)
+		if w.Code != tt.code || strings.TrimSpace(w.Body.String()) != tt.body {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
+)
+
+func init() {
+	registry.RegisterService(&Scheduler{}, 99)
+}
+
+// Overlap determines what happens when a scheduled task is due while its
+// previous run is still in flight.
+type Overlap int
+
+const (
+	// Skip does not run the task, and waits for the next scheduled time.
+	Skip Overlap = iota
+	// Queue runs the task again as soon as the previous run completes.
+	Queue
+)
+
+func (o Overlap) String() string {
+	if o == Queue {
+		return "queue"
+	}
+	return "skip"
+}
+
+// ParseOverlap converts "skip" or "queue" to an Overlap.
+func ParseOverlap(s string) (Overlap, error) {
+	switch s {
+	case "skip":
+		return Skip, nil
+	case "queue":
+		return Queue, nil
+	}
+	return Skip, fmt.Errorf("unknown overlap policy %q. must be one of skip or queue", s)
+}
+
+// TaskFunc is the function run by a scheduled task. t is the time the run
+// was scheduled for.
+type TaskFunc func(ctx context.Context, t time.Time) error
+
+// TaskSettings are the settings of a scheduled task.
+type TaskSettings struct {
+	Schedule Schedule
+	Location *time.Location
+	Jitter   time.Duration
+	Overlap  Overlap
+}
+
+// TaskConfig is implemented by the config sections of scheduled tasks. The
+// sections usually have these settings:
+//
+//	<section>.schedule  interval, eg. "5s", or cron expression, eg. "*/5 * * * * *"
+//	<section>.timezone  time zone cron expressions are evaluated in. default "UTC"
+//	<section>.jitter    random delay of up to this duration added to each run
+//	<section>.overlap   "skip" or "queue"
+//
+// and convert them with ParseTaskSettings, both when validating the
+// section and in TaskSettings.
+type TaskConfig interface {
+	TaskSettings() TaskSettings
+}
+
+// ParseTaskSettings converts the settings of a scheduled task to
+// TaskSettings. The returned errors are keyed by setting, so a config
+// section can return them from Validate.
+func ParseTaskSettings(schedule, timezone string, jitter time.Duration, overlap string) (TaskSettings, error) {
+	settings := TaskSettings{Location: time.UTC, Jitter: jitter}
+	var errs cfg.ValidationErrors
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			errs = append(errs, &cfg.FieldError{Key: "timezone", Message: err.Error()})
+		} else {
+			settings.Location = loc
+		}
+	}
+	if len(errs) == 0 {
+		s, err := ParseSchedule(schedule, settings.Location)
+		if err != nil {
+			errs = append(errs, &cfg.FieldError{Key: "schedule", Message: err.Error()})
+		}
+		settings.Schedule = s
+	}
+	if jitter < 0 {
+		errs = append(errs, &cfg.FieldError{Key: "jitter", Message: "must be >= 0"})
+	}
+	if overlap != "" {
+		o, err := ParseOverlap(overlap)
+		if err != nil {
+			errs = append(errs, &cfg.FieldError{Key: "overlap", Message: err.Error()})
+		}
+		settings.Overlap = o
+	}
+	if len(errs) > 0 {
+		return settings, errs
+	}
+	return settings, nil
+}
+
+// TaskStatus describes a scheduled task.
+type TaskStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Timezone string    `json:"timezone"`
+	Overlap  string    `json:"overlap"`
+	Jitter   string    `json:"jitter"`
+	NextRun  time.Time `json:"nextRun"`
+	LastRun  time.Time `json:"lastRun"`
+	Running  bool      `json:"running"`
+	Runs     int64     `json:"runs"`
+	Skipped  int64     `json:"skipped"`
+	Queued   int64     `json:"queued"`
+}
+
+// Scheduler runs tasks on fixed intervals or cron schedules. The schedule
+// of each task is re-read whenever its config section changes.
+type Scheduler struct {
+	Cfg    *cfg.Cfg        `inject:""`
+	Log    *log.Entry      `inject:""`
+	Tracer *tracing.Tracer `inject:""`
+
+	tasks map[string]*task
+	sync.Mutex
+}
+
+func (s *Scheduler) Init() error {
+	s.tasks = make(map[string]*task)
+	return nil
+}
+
+// Settings returns the settings of the task in the given config section,
+// which must implement TaskConfig.
+func (s *Scheduler) Settings(section string) (TaskSettings, error) {
+	conf, ok := s.Cfg.Section(section).(TaskConfig)
+	if !ok {
+		return TaskSettings{}, fmt.Errorf("config section %s does not have task settings", section)
+	}
+	return conf.TaskSettings(), nil
+}
+
+// Add schedules fn to run using the settings in the given config section.
+// The task runs until ctx is done.
+func (s *Scheduler) Add(ctx context.Context, name, section string, fn TaskFunc) error {
+	settings, err := s.Settings(section)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if existing, ok := s.tasks[name]; ok {
+		// a task whose context is done is about to be removed, eg. when
+		// its service is being restarted.
+		if existing.ctx.Err() == nil {
+			return fmt.Errorf("task %s is already scheduled", name)
+		}
+		s.Unlock()
+		<-existing.done
+		s.Lock()
+		if _, ok := s.tasks[name]; ok {
+			return fmt.Errorf("task %s is already scheduled", name)
+		}
+	}
+	t := &task{
+		name:     name,
+		section:  section,
+		logger:   s.Log.WithField("task", name),
+		tracer:   s.Tracer,
+		fn:       fn,
+		settings: settings,
+		reload:   make(chan struct{}, 1),
+		ctx:      ctx,
+		done:     make(chan struct{}),
+	}
+	s.tasks[name] = t
+	sub := s.Cfg.Subscribe(section, func(cfg.ChangeEvent) {
+		s.reload(t)
+	})
+	go func() {
+		t.run(ctx)
+		sub.Unsubscribe()
+		s.Lock()
+		delete(s.tasks, name)
+		s.Unlock()
+		close(t.done)
+	}()
+	s.Log.Infof("scheduled %s to run %s", name, settings.Schedule)
+	return nil
+}
+
+// Status returns the status of every scheduled task, ordered by name.
+func (s *Scheduler) Status() []TaskStatus {
+	s.Lock()
+	result := make([]TaskStatus, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		result = append(result, t.status())
+	}
+	s.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// reload re-reads the settings of the task. Invalid settings are logged
+// and the task keeps its previous settings.
+func (s *Scheduler) reload(t *task) {
+	settings, err := s.Settings(t.section)
+	if err != nil {
+		s.Log.Errorf("not updating schedule of %s. %s", t.name, err)
+		return
+	}
+	t.update(settings)
+}
+
+type task struct {
+	name    string
+	section string
+	fn      TaskFunc
+	logger  *log.Entry
+	tracer  *tracing.Tracer
+
+	settings TaskSettings
+	// reload is signalled when the settings change.
+	reload chan struct{}
+	// ctx is the context the task runs until, and done is closed once the
+	// task has been removed.
+	ctx  context.Context
+	done chan struct{}
+
+	nextRun, lastRun       time.Time
+	running                bool
+	runs, skipped, pending int64
+	sync.Mutex
+}
+
+func (t *task) update(settings TaskSettings) {
+	t.Lock()
+	changed := settings.Schedule.String() != t.settings.Schedule.String() ||
+		settings.Location.String() != t.settings.Location.String() ||
+		settings.Jitter != t.settings.Jitter ||
+		settings.Overlap != t.settings.Overlap
+	t.settings = settings
+	t.Unlock()
+	if !changed {
+		return
+	}
+	t.logger.Infof("schedule of %s changed to %s", t.name, settings.Schedule)
+	select {
+	case t.reload <- struct{}{}:
+	default:
+	}
+}
+
+func (t *task) run(ctx context.Context) {
+	last := time.Now()
+	for {
+		t.Lock()
+		settings := t.settings
+		next := settings.Schedule.Next(last)
+		if next.IsZero() {
+			t.Unlock()
+			t.logger.Errorf("%s: schedule %s never matches. waiting for it to change", t.name, settings.Schedule)
+			select {
+			case <-t.reload:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		fireAt := next
+		if settings.Jitter > 0 {
+			fireAt = fireAt.Add(time.Duration(rand.Int63n(int64(settings.Jitter))))
+		}
+		t.nextRun = fireAt
+		t.Unlock()
+
+		timer := time.NewTimer(time.Until(fireAt))
+		select {
+		case <-timer.C:
+			last = next
+			// don't try to catch up on runs missed while the process was
+			// suspended or the previous computation was slow.
+			if now := time.Now(); now.Sub(last) > time.Second {
+				last = now
+			}
+			t.fire(ctx, next, settings.Overlap)
+		case <-t.reload:
+			timer.Stop()
+			last = time.Now()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fire runs the task unless it is still running from a previous schedule,
+// in which case the overlap policy decides if the run is skipped or queued.
+func (t *task) fire(ctx context.Context, scheduled time.Time, overlap Overlap) {
+	t.Lock()
+	defer t.Unlock()
+	if t.running {
+		if overlap == Queue {
+			t.pending++
+			return
+		}
+		t.skipped++
+		t.logger.Warnf("%s: skipping run scheduled for %s as the previous run is still in flight", t.name, scheduled)
+		return
+	}
+	t.running = true
+	go t.execute(ctx, scheduled)
+}
+
+func (t *task) execute(ctx context.Context, scheduled time.Time) {
+	for {
+		t.Lock()
+		t.lastRun = time.Now()
+		t.runs++
+		t.Unlock()
+
+		if err := t.trace(ctx, scheduled); err != nil && ctx.Err() == nil {
+			t.logger.Errorf("%s: scheduled run failed. %s", t.name, err)
+		}
+
+		t.Lock()
+		if t.pending == 0 || ctx.Err() != nil {
+			t.running = false
+			t.Unlock()
+			return
+		}
+		t.pending--
+		scheduled = time.Now()
+		t.Unlock()
+	}
+}
+
+// trace runs the task function in a span, so that the jobs it submits are
+// traced as part of the run.
+func (t *task) trace(ctx context.Context, scheduled time.Time) error {
+	ctx, span := t.tracer.Start(ctx, "task "+t.name)
+	defer span.End()
+	span.SetAttribute("task", t.name)
+	span.SetAttribute("scheduled", scheduled.Format(time.RFC3339Nano))
+	err := t.fn(ctx, scheduled)
+	span.SetError(err)
+	return err
+}
+
+func (t *task) status() TaskStatus {
+	t.Lock()
+	defer t.Unlock()
+	return TaskStatus{
+		Name:     t.name,
+		Schedule: t.settings.Schedule.String(),
+		Timezone: t.settings.Location.String(),
+		Overlap:  t.settings.Overlap.String(),
+		Jitter:   t.settings.Jitter.String(),
+		NextRun:  t.nextRun,
+		LastRun:  t.lastRun,
+		Running:  t.running,
+		Runs:     t.runs,
+		Skipped:  t.skipped,
+		Queued:   t.pending,
+	}
+}
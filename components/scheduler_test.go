@@ -0,0 +1,31 @@
+package components
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTaskSettings(t *testing.T) {
+	settings, err := ParseTaskSettings("0 9 * * MON-FRI", "Europe/London", time.Second, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Schedule.String() != "0 9 * * MON-FRI" || settings.Location.String() != "Europe/London" ||
+		settings.Jitter != time.Second || settings.Overlap != Queue {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+
+	settings, err = ParseTaskSettings("5s", "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Location != time.UTC || settings.Overlap != Skip {
+		t.Errorf("got %s and %s, want the UTC and skip defaults", settings.Location, settings.Overlap)
+	}
+
+	_, err = ParseTaskSettings("* * *", "Nowhere/Special", -time.Second, "later")
+	want := `3 invalid settings: timezone: unknown time zone Nowhere/Special; jitter: must be >= 0; overlap: unknown overlap policy "later". must be one of skip or queue`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+}
@@ -1,42 +1,621 @@
 package components
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/cfg"
+	"github.com/woodsaj/go-server/metrics"
 	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
 )
 
 func init() {
 	registry.RegisterService(&WorkerPool{}, 99)
+
+	// startup settings
+	cfg.SetStaticDefault("worker-pool.dead-letter-size", 1000)
 }
 
+var (
+	ErrQueueFull     = errors.New("job queue is full")
+	ErrJobDropped    = errors.New("job dropped as the queue was full")
+	ErrPoolClosed    = errors.New("worker pool is closed")
+	ErrUnknownWorker = errors.New("unknown worker")
+)
+
 func (s *WorkerPool) Init() error {
-	s.workers = make([]Worker, 0)
+	s.workers = make(map[string]*workerQueue)
+	s.DeadLetters = NewDeadLetterQueue(s.Cfg.GetInt("worker-pool.dead-letter-size"), s.Log)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.Metrics.CounterFunc("worker_jobs_total", "Jobs handled by each worker, by result.", []string{"worker", "result"}, func(emit func(float64, ...string)) {
+		for name, stats := range s.Stats() {
+			emit(float64(stats.Processed), name, "processed")
+			emit(float64(stats.Failed), name, "failed")
+			emit(float64(stats.Retried), name, "retried")
+			emit(float64(stats.DeadLettered), name, "dead_lettered")
+			emit(float64(stats.Dropped), name, "dropped")
+			emit(float64(stats.Rejected), name, "rejected")
+		}
+	})
+	s.Metrics.GaugeFunc("worker_jobs_queued", "Jobs waiting in each worker's queue.", []string{"worker"}, func(emit func(float64, ...string)) {
+		for name, stats := range s.Stats() {
+			emit(float64(stats.Queued), name)
+		}
+	})
+	s.Metrics.GaugeFunc("worker_jobs_in_flight", "Jobs being executed by each worker.", []string{"worker"}, func(emit func(float64, ...string)) {
+		for name, stats := range s.Stats() {
+			emit(float64(stats.InFlight), name)
+		}
+	})
 	return nil
 }
 
+// Worker executes the jobs submitted to it through the WorkerPool.
 type Worker interface {
-	DoWork()
+	// DoWork executes the job. The passed `context.Context` is cancelled
+	// when the job times out or the pool is stopped. Jobs that return an
+	// error are retried according to the worker's RetryPolicy.
+	DoWork(ctx context.Context, job *Job) error
 	Status() string
 }
 
+// Backpressure determines what happens when a job is submitted to a
+// worker whose queue is full.
+type Backpressure int
+
+const (
+	// Block waits until there is space in the queue.
+	Block Backpressure = iota
+	// Drop discards the job. The job's handle completes with ErrJobDropped.
+	Drop
+	// Reject returns ErrQueueFull to the submitter.
+	Reject
+)
+
+func (b Backpressure) String() string {
+	switch b {
+	case Drop:
+		return "drop"
+	case Reject:
+		return "reject"
+	default:
+		return "block"
+	}
+}
+
+// ParseBackpressure converts "block", "drop" or "reject" to a Backpressure.
+func ParseBackpressure(s string) (Backpressure, error) {
+	switch s {
+	case "block":
+		return Block, nil
+	case "drop":
+		return Drop, nil
+	case "reject":
+		return Reject, nil
+	}
+	return Block, fmt.Errorf("unknown backpressure mode %q. must be one of block, drop or reject", s)
+}
+
+// QueueOptions control how jobs submitted to a worker are executed.
+type QueueOptions struct {
+	// Concurrency is the number of jobs the worker executes at once.
+	Concurrency int
+	// QueueSize is the number of jobs that can be waiting to be executed.
+	QueueSize    int
+	Backpressure Backpressure
+	// Timeout is the maximum time a single attempt of a job may take.
+	// Zero means no timeout.
+	Timeout time.Duration
+	Retry   RetryPolicy
+}
+
+// RetryPolicy determines how failed jobs are retried. Jobs that have
+// failed MaxAttempts times are moved to the dead letter queue.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a job is attempted. A value of
+	// 1 or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the time waited before the first retry. It is
+	// doubled for every subsequent retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomly varies each backoff by up to this fraction of it.
+	Jitter float64
+}
+
+// backoff returns the time to wait before retrying a job that has
+// failed the given number of attempts.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempts && (p.MaxBackoff == 0 || backoff < p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		backoff += time.Duration(p.Jitter * (rand.Float64()*2 - 1) * float64(backoff))
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	return backoff
+}
+
+// Job is a unit of work executed by a Worker.
+type Job struct {
+	// Worker is the name the worker was registered with.
+	Worker  string      `json:"worker"`
+	Payload interface{} `json:"payload"`
+
+	ID        uint64    `json:"id"`
+	Submitted time.Time `json:"submitted"`
+	// Attempts is the number of times the job has been executed.
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// JobHandle is returned when a job is submitted and can be used to wait
+// for the job to complete.
+type JobHandle struct {
+	Job *Job
+
+	// parent is the span the job was submitted from. Each attempt to
+	// execute the job is traced as a child of it.
+	parent tracing.SpanContext
+	done   chan struct{}
+	err    error
+}
+
+func newJobHandle(job *Job) *JobHandle {
+	return &JobHandle{Job: job, done: make(chan struct{})}
+}
+
+func (h *JobHandle) complete(err error) {
+	h.err = err
+	close(h.done)
+}
+
+// Done returns a channel that is closed once the job has completed.
+func (h *JobHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns the error the job failed with. It must only be called after
+// Done() has been closed.
+func (h *JobHandle) Err() error {
+	return h.err
+}
+
+// Wait blocks until the job completes or ctx is cancelled.
+func (h *JobHandle) Wait(ctx context.Context) error {
+	select {
+	case <-h.done:
+		return h.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WorkerStats are counters for the jobs submitted to a worker.
+type WorkerStats struct {
+	// Processed is the number of jobs that succeeded.
+	Processed int64 `json:"processed"`
+	// Failed is the number of jobs that failed and were dead lettered, eg.
+	// after exhausting their retries. Each job is counted once, however
+	// many attempts it had.
+	Failed   int64 `json:"failed"`
+	InFlight int64 `json:"inFlight"`
+	Queued   int64 `json:"queued"`
+	Dropped  int64 `json:"dropped"`
+	Rejected int64 `json:"rejected"`
+	// Retried is the number of failed attempts that were retried.
+	Retried int64 `json:"retried"`
+	// DeadLettered is the number of jobs that exhausted their retries.
+	DeadLettered int64 `json:"deadLettered"`
+}
+
+// WorkerPool executes jobs on the registered workers. Each worker has its
+// own bounded queue of jobs and executes up to QueueOptions.Concurrency of
+// them at once.
 type WorkerPool struct {
-	workers []Worker
+	// lastID is first to ensure 64-bit alignment for atomic operations.
+	lastID uint64
+
+	Cfg     *cfg.Cfg          `inject:""`
+	Metrics *metrics.Registry `inject:""`
+	Log     *log.Entry        `inject:""`
+	Tracer  *tracing.Tracer   `inject:""`
+
+	// DeadLetters holds the jobs that failed after exhausting their retries.
+	DeadLetters *DeadLetterQueue
+
+	workers map[string]*workerQueue
+	// ctx is passed to every job, and is cancelled when the pool is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
 	sync.Mutex
 }
 
-func (wp *WorkerPool) Register(w Worker) {
+// Register adds a worker to the pool and starts executing jobs submitted
+// for it.
+func (wp *WorkerPool) Register(name string, w Worker, opts QueueOptions) error {
+	if opts.Concurrency < 1 {
+		return fmt.Errorf("%s: concurrency must be > 0", name)
+	}
+	if opts.QueueSize < 0 {
+		return fmt.Errorf("%s: queue size must be >= 0", name)
+	}
+	if opts.Retry.Jitter < 0 || opts.Retry.Jitter > 1 {
+		return fmt.Errorf("%s: retry jitter must be between 0 and 1", name)
+	}
+	wp.Lock()
+	defer wp.Unlock()
+	if _, ok := wp.workers[name]; ok {
+		return fmt.Errorf("worker %s is already registered", name)
+	}
+	q := &workerQueue{
+		name:    name,
+		worker:  w,
+		opts:    opts,
+		pool:    wp,
+		jobs:    make(chan *JobHandle, opts.QueueSize),
+		logger:  wp.Log.WithField("worker", name),
+		closing: make(chan struct{}),
+		retries: make(map[*JobHandle]*time.Timer),
+	}
+	q.start()
+	wp.workers[name] = q
+	return nil
+}
+
+// Submit queues a job for execution by the worker named in the job. If the
+// worker's queue is full, the worker's Backpressure setting determines
+// whether Submit blocks until ctx is done, drops the job or returns
+// ErrQueueFull.
+func (wp *WorkerPool) Submit(ctx context.Context, job *Job) (*JobHandle, error) {
 	wp.Lock()
-	wp.workers = append(wp.workers, w)
+	q, ok := wp.workers[job.Worker]
 	wp.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownWorker, job.Worker)
+	}
+	job.ID = atomic.AddUint64(&wp.lastID, 1)
+	job.Submitted = time.Now()
+	job.Attempts = 0
+	h := newJobHandle(job)
+	h.parent = tracing.SpanContextFromContext(ctx)
+	if err := q.submit(ctx, h); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
+// Status returns the status of each worker, ordered by worker name.
 func (wp *WorkerPool) Status() []string {
 	wp.Lock()
-	result := make([]string, len(wp.workers))
-	for i, w := range wp.workers {
-		result[i] = w.Status()
-	}
+	queues := wp.queues()
 	wp.Unlock()
+	result := make([]string, len(queues))
+	for i, q := range queues {
+		stats := q.stats()
+		result[i] = fmt.Sprintf("%s. processed=%d failed=%d retried=%d dead-lettered=%d in-flight=%d queued=%d dropped=%d rejected=%d",
+			q.worker.Status(), stats.Processed, stats.Failed, stats.Retried, stats.DeadLettered, stats.InFlight, stats.Queued, stats.Dropped, stats.Rejected)
+	}
+	return result
+}
+
+// Stats returns the job counters of each worker keyed by worker name.
+func (wp *WorkerPool) Stats() map[string]WorkerStats {
+	wp.Lock()
+	defer wp.Unlock()
+	result := make(map[string]WorkerStats, len(wp.workers))
+	for name, q := range wp.workers {
+		result[name] = q.stats()
+	}
 	return result
 }
+
+// Redrive removes a job from the dead letter queue and submits it again
+// with its attempts reset.
+func (wp *WorkerPool) Redrive(ctx context.Context, id uint64) (*JobHandle, error) {
+	letter, ok := wp.DeadLetters.Remove(id)
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	job := letter.Job
+	h, err := wp.Submit(ctx, &job)
+	if err != nil {
+		// put it back so that the job is not lost.
+		wp.DeadLetters.Add(letter)
+		return nil, err
+	}
+	wp.Log.Infof("%s: redriving dead lettered job %d as job %d", job.Worker, id, job.ID)
+	return h, nil
+}
+
+// Stop stops accepting new jobs and waits for the queued jobs to be
+// executed. Jobs still queued, or waiting to be retried, are moved to
+// the dead letter queue. Once ctx is done, the context passed to jobs
+// still in flight is cancelled.
+func (wp *WorkerPool) Stop(ctx context.Context) error {
+	wp.Lock()
+	queues := wp.queues()
+	wp.Unlock()
+	defer wp.cancel()
+
+	var pending []string
+	for _, q := range queues {
+		if err := q.stop(ctx); err != nil {
+			pending = append(pending, q.name)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("workers still had jobs in flight: %v", pending)
+	}
+	return nil
+}
+
+// queues returns the worker queues ordered by name. wp must be locked.
+func (wp *WorkerPool) queues() []*workerQueue {
+	queues := make([]*workerQueue, 0, len(wp.workers))
+	for _, q := range wp.workers {
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].name < queues[j].name
+	})
+	return queues
+}
+
+// workerQueue is the queue of jobs for a single worker.
+type workerQueue struct {
+	// counters are first to ensure 64-bit alignment for atomic operations.
+	processed, failed, inFlight, dropped, rejected, retried, deadLettered int64
+
+	name   string
+	worker Worker
+	opts   QueueOptions
+	pool   *WorkerPool
+	jobs   chan *JobHandle
+	logger *log.Entry
+
+	// retries holds the timers of failed jobs waiting to be retried.
+	retries   map[*JobHandle]*time.Timer
+	retriesMu sync.Mutex
+
+	// closing is closed when the queue is being stopped. The queued jobs
+	// are still executed.
+	closing chan struct{}
+	// closed is set once no more jobs can be added to the queue.
+	closed bool
+	mu     sync.RWMutex
+	wg     sync.WaitGroup
+}
+
+func (q *workerQueue) start() {
+	for i := 0; i < q.opts.Concurrency; i++ {
+		q.wg.Add(1)
+		go q.execute()
+	}
+}
+
+func (q *workerQueue) submit(ctx context.Context, h *JobHandle) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case q.jobs <- h:
+		return nil
+	default:
+	}
+
+	switch q.opts.Backpressure {
+	case Drop:
+		atomic.AddInt64(&q.dropped, 1)
+		q.logger.Warnf("%s: queue full. dropping job %d", q.name, h.Job.ID)
+		h.complete(ErrJobDropped)
+		return nil
+	case Reject:
+		atomic.AddInt64(&q.rejected, 1)
+		return ErrQueueFull
+	}
+
+	select {
+	case q.jobs <- h:
+		return nil
+	case <-q.closing:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *workerQueue) execute() {
+	defer q.wg.Done()
+	for {
+		select {
+		case h := <-q.jobs:
+			q.run(h)
+		case <-q.closing:
+			// execute what is left in the queue.
+			for {
+				select {
+				case h := <-q.jobs:
+					q.run(h)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *workerQueue) run(h *JobHandle) {
+	job := h.Job
+	job.Attempts++
+	atomic.AddInt64(&q.inFlight, 1)
+	err := q.doWork(h)
+	atomic.AddInt64(&q.inFlight, -1)
+	if err == nil {
+		atomic.AddInt64(&q.processed, 1)
+		h.complete(nil)
+		return
+	}
+
+	job.LastError = err.Error()
+	if job.Attempts >= q.opts.Retry.MaxAttempts {
+		q.deadLetter(h, err)
+		return
+	}
+
+	backoff := q.opts.Retry.backoff(job.Attempts)
+	q.logger.Warnf("%s: job %d failed on attempt %d of %d. retrying in %s. %s", q.name, job.ID, job.Attempts, q.opts.Retry.MaxAttempts, backoff, err)
+	atomic.AddInt64(&q.retried, 1)
+	q.retriesMu.Lock()
+	q.retries[h] = time.AfterFunc(backoff, func() {
+		q.retriesMu.Lock()
+		_, pending := q.retries[h]
+		delete(q.retries, h)
+		q.retriesMu.Unlock()
+		if pending {
+			q.requeue(h)
+		}
+	})
+	q.retriesMu.Unlock()
+}
+
+// doWork executes the job, converting a panic into an error. If the
+// worker has a timeout, the attempt fails once the timeout is reached.
+// Each attempt is traced as a child of the span the job was submitted from.
+func (q *workerQueue) doWork(h *JobHandle) (err error) {
+	job := h.Job
+	ctx, span := q.pool.Tracer.Start(tracing.ContextWithRemote(q.pool.ctx, h.parent), "job "+q.name)
+	span.SetKind(tracing.KindConsumer)
+	span.SetAttribute("worker", q.name)
+	span.SetAttribute("job.id", job.ID)
+	span.SetAttribute("job.attempt", job.Attempts)
+	if job.Attempts == 1 {
+		span.SetAttribute("job.queued_ms", time.Since(job.Submitted).Seconds()*1000)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			q.logger.Errorf("panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+	if q.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.opts.Timeout)
+		defer cancel()
+	}
+	err = q.worker.DoWork(ctx, job)
+	if ctx.Err() == context.DeadlineExceeded {
+		if err == nil {
+			return fmt.Errorf("timed out after %s", q.opts.Timeout)
+		}
+		return fmt.Errorf("timed out after %s. %s", q.opts.Timeout, err)
+	}
+	return err
+}
+
+// requeue adds a job that is being retried back to the queue. If the
+// queue is closed the job is dead lettered.
+func (q *workerQueue) requeue(h *JobHandle) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.deadLetter(h, ErrPoolClosed)
+		return
+	}
+	select {
+	case q.jobs <- h:
+	case <-q.closing:
+		q.deadLetter(h, ErrPoolClosed)
+	}
+}
+
+func (q *workerQueue) deadLetter(h *JobHandle, err error) {
+	atomic.AddInt64(&q.deadLettered, 1)
+	if h.Job.Attempts > 0 {
+		// jobs that never ran, eg. as the pool was stopped, did not fail.
+		atomic.AddInt64(&q.failed, 1)
+	}
+	q.logger.Errorf("%s: job %d failed after %d attempts. moving to dead letter queue. %s", q.name, h.Job.ID, h.Job.Attempts, err)
+	q.pool.DeadLetters.Add(DeadLetter{
+		Job:      *h.Job,
+		Error:    err.Error(),
+		FailedAt: time.Now(),
+	})
+	h.complete(err)
+}
+
+func (q *workerQueue) stop(ctx context.Context) error {
+	select {
+	case <-q.closing:
+	default:
+		close(q.closing)
+	}
+	// wait for submitters to finish.
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	// jobs waiting to be retried won't get another attempt.
+	q.retriesMu.Lock()
+	for h, timer := range q.retries {
+		timer.Stop()
+		delete(q.retries, h)
+		q.deadLetter(h, fmt.Errorf("%v before retry. %s", ErrPoolClosed, h.Job.LastError))
+	}
+	q.retriesMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// fail any job that was added after the executors finished.
+	for {
+		select {
+		case h := <-q.jobs:
+			q.deadLetter(h, ErrPoolClosed)
+		default:
+			return nil
+		}
+	}
+}
+
+func (q *workerQueue) stats() WorkerStats {
+	return WorkerStats{
+		Processed:    atomic.LoadInt64(&q.processed),
+		Failed:       atomic.LoadInt64(&q.failed),
+		InFlight:     atomic.LoadInt64(&q.inFlight),
+		Queued:       int64(len(q.jobs)),
+		Dropped:      atomic.LoadInt64(&q.dropped),
+		Rejected:     atomic.LoadInt64(&q.rejected),
+		Retried:      atomic.LoadInt64(&q.retried),
+		DeadLettered: atomic.LoadInt64(&q.deadLettered),
+	}
+}
@@ -0,0 +1,350 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/woodsaj/go-server/metrics"
+	"github.com/woodsaj/go-server/tracing"
+)
+
+// fakeJobs is a worker that runs do for each job.
+type fakeJobs struct {
+	do func(ctx context.Context, job *Job) error
+}
+
+func (f *fakeJobs) DoWork(ctx context.Context, job *Job) error {
+	return f.do(ctx, job)
+}
+
+func (f *fakeJobs) Status() string { return "fake" }
+
+// blockingJobs returns a worker whose jobs block until release is closed,
+// along with the number of jobs it has executed at once.
+func blockingJobs(release chan struct{}) (*fakeJobs, *int64) {
+	var running, max int64
+	var mu sync.Mutex
+	return &fakeJobs{do: func(ctx context.Context, job *Job) error {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}}, &max
+}
+
+func newTestPool(t *testing.T, overrides map[string]string) *WorkerPool {
+	logger := log.New()
+	logger.Out = io.Discard
+	wp := &WorkerPool{
+		Cfg:     newTestCfg(t, overrides),
+		Metrics: metrics.New(),
+		Log:     log.NewEntry(logger),
+		Tracer:  tracing.New("test", nil),
+	}
+	if err := wp.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		wp.Stop(context.Background())
+		wp.Tracer.Shutdown(context.Background())
+	})
+	return wp
+}
+
+func waitForStats(t *testing.T, wp *WorkerPool, name string, cond func(WorkerStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(wp.Stats()[name]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s. stats %+v", name, wp.Stats()[name])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func wait(t *testing.T, h *JobHandle) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := h.Wait(ctx)
+	if err == context.DeadlineExceeded {
+		t.Fatalf("job %d did not complete", h.Job.ID)
+	}
+	return err
+}
+
+func TestWorkerBackpressure(t *testing.T) {
+	tests := []struct {
+		mode Backpressure
+		// err is the error returned by Submit, and result the error the
+		// job completes with.
+		err     error
+		result  error
+		dropped int64
+		// rejected is the number of rejected jobs.
+		rejected int64
+	}{
+		{mode: Block, err: context.DeadlineExceeded},
+		{mode: Drop, result: ErrJobDropped, dropped: 1},
+		{mode: Reject, err: ErrQueueFull, rejected: 1},
+	}
+	for _, tt := range tests {
+		wp := newTestPool(t, nil)
+		release := make(chan struct{})
+		w, _ := blockingJobs(release)
+		if err := wp.Register("w", w, QueueOptions{Concurrency: 1, QueueSize: 1, Backpressure: tt.mode}); err != nil {
+			t.Fatal(err)
+		}
+		var handles []*JobHandle
+		for i := 0; i < 2; i++ {
+			h, err := wp.Submit(context.Background(), &Job{Worker: "w"})
+			if err != nil {
+				t.Fatalf("%s: %s", tt.mode, err)
+			}
+			handles = append(handles, h)
+			if i == 0 {
+				waitForStats(t, wp, "w", func(s WorkerStats) bool { return s.InFlight == 1 })
+			}
+		}
+
+		// the queue is full.
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		h, err := wp.Submit(ctx, &Job{Worker: "w"})
+		cancel()
+		if err != tt.err {
+			t.Errorf("%s: Submit returned %v, want %v", tt.mode, err, tt.err)
+		}
+		if err == nil {
+			select {
+			case <-h.Done():
+				if h.Err() != tt.result {
+					t.Errorf("%s: job completed with %v, want %v", tt.mode, h.Err(), tt.result)
+				}
+			default:
+				t.Errorf("%s: job was queued", tt.mode)
+			}
+		}
+
+		close(release)
+		for _, h := range handles {
+			if err := wait(t, h); err != nil {
+				t.Errorf("%s: job %d failed. %s", tt.mode, h.Job.ID, err)
+			}
+		}
+		want := WorkerStats{Processed: 2, Dropped: tt.dropped, Rejected: tt.rejected}
+		if stats := wp.Stats()["w"]; stats != want {
+			t.Errorf("%s: got stats %+v, want %+v", tt.mode, stats, want)
+		}
+	}
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+	wp := newTestPool(t, nil)
+	release := make(chan struct{})
+	w, max := blockingJobs(release)
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 3, QueueSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+	var handles []*JobHandle
+	for i := 0; i < 5; i++ {
+		h, err := wp.Submit(context.Background(), &Job{Worker: "w"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+	}
+	waitForStats(t, wp, "w", func(s WorkerStats) bool { return s.InFlight == 3 && s.Queued == 2 })
+	// give the queued jobs a chance to start.
+	time.Sleep(10 * time.Millisecond)
+	if stats := wp.Stats()["w"]; stats.InFlight != 3 {
+		t.Errorf("%d jobs in flight, want 3", stats.InFlight)
+	}
+	close(release)
+	for _, h := range handles {
+		wait(t, h)
+	}
+	if *max != 3 {
+		t.Errorf("%d jobs ran at once, want 3", *max)
+	}
+	if stats := wp.Stats()["w"]; stats.Processed != 5 || stats.InFlight != 0 || stats.Queued != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestWorkerRetry(t *testing.T) {
+	wp := newTestPool(t, nil)
+	// jobs fail until they reach the attempt in their payload.
+	w := &fakeJobs{do: func(ctx context.Context, job *Job) error {
+		if job.Attempts < job.Payload.(int) {
+			return errors.New("not yet")
+		}
+		return nil
+	}}
+	retry := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, Jitter: 0.5}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1, QueueSize: 1, Retry: retry}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := wp.Submit(context.Background(), &Job{Worker: "w", Payload: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, h); err != nil {
+		t.Errorf("job failed on its last attempt. %s", err)
+	}
+	if h.Job.Attempts != 3 {
+		t.Errorf("job had %d attempts, want 3", h.Job.Attempts)
+	}
+	want := WorkerStats{Processed: 1, Retried: 2}
+	if stats := wp.Stats()["w"]; stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+
+	h, err = wp.Submit(context.Background(), &Job{Worker: "w", Payload: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, h); err == nil || err.Error() != "not yet" {
+		t.Errorf("got error %v, want not yet", err)
+	}
+	want = WorkerStats{Processed: 1, Failed: 1, Retried: 4, DeadLettered: 1}
+	if stats := wp.Stats()["w"]; stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+	letter, ok := wp.DeadLetters.Get(h.Job.ID)
+	if !ok || letter.Job.Attempts != 3 || letter.Error != "not yet" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w*time.Millisecond {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w*time.Millisecond)
+		}
+	}
+
+	p.Jitter = 0.5
+	varied := false
+	for i := 0; i < 100; i++ {
+		got := p.backoff(2)
+		if got < 10*time.Millisecond || got > 30*time.Millisecond {
+			t.Fatalf("backoff(2) with jitter = %s, want between 10ms and 30ms", got)
+		}
+		varied = varied || got != 20*time.Millisecond
+	}
+	if !varied {
+		t.Error("jitter did not vary the backoff")
+	}
+}
+
+func TestWorkerTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		do   func(ctx context.Context, job *Job) error
+		err  string
+	}{
+		{
+			name: "job returns the context error",
+			do: func(ctx context.Context, job *Job) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			err: "timed out after 10ms. context deadline exceeded",
+		},
+		{
+			name: "job ignores the context",
+			do: func(ctx context.Context, job *Job) error {
+				time.Sleep(30 * time.Millisecond)
+				return nil
+			},
+			err: "timed out after 10ms",
+		},
+	}
+	for _, tt := range tests {
+		wp := newTestPool(t, nil)
+		if err := wp.Register("w", &fakeJobs{do: tt.do}, QueueOptions{Concurrency: 1, Timeout: 10 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		h, err := wp.Submit(context.Background(), &Job{Worker: "w"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wait(t, h); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+		if stats := wp.Stats()["w"]; stats.Failed != 1 || stats.Processed != 0 {
+			t.Errorf("%s: unexpected stats %+v", tt.name, stats)
+		}
+	}
+}
+
+func TestWorkerPanic(t *testing.T) {
+	wp := newTestPool(t, nil)
+	var calls int64
+	w := &fakeJobs{do: func(ctx context.Context, job *Job) error {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			panic("oops")
+		}
+		return nil
+	}}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := wp.Submit(context.Background(), &Job{Worker: "w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, h); err == nil || err.Error() != "panic: oops" {
+		t.Errorf("got error %v, want panic: oops", err)
+	}
+
+	// the worker keeps executing jobs.
+	h, err = wp.Submit(context.Background(), &Job{Worker: "w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, h); err != nil {
+		t.Errorf("job after the panic failed. %s", err)
+	}
+	want := WorkerStats{Processed: 1, Failed: 1, DeadLettered: 1}
+	if stats := wp.Stats()["w"]; stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+}
+
+func TestWorkerSubmitErrors(t *testing.T) {
+	wp := newTestPool(t, nil)
+	if _, err := wp.Submit(context.Background(), &Job{Worker: "missing"}); err == nil || err.Error() != "unknown worker: missing" {
+		t.Errorf("got error %v for an unknown worker", err)
+	}
+	w := &fakeJobs{do: func(ctx context.Context, job *Job) error { return nil }}
+	if err := wp.Register("w", w, QueueOptions{}); err == nil || err.Error() != "w: concurrency must be > 0" {
+		t.Errorf("got error %v for a concurrency of 0", err)
+	}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wp.Register("w", w, QueueOptions{Concurrency: 1}); err == nil || err.Error() != "worker w is already registered" {
+		t.Errorf("got error %v when registering w twice", err)
+	}
+	wp.Stop(context.Background())
+	if _, err := wp.Submit(context.Background(), &Job{Worker: "w"}); err != ErrPoolClosed {
+		t.Errorf("got error %v after Stop, want %v", err, ErrPoolClosed)
+	}
+}
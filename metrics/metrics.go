@@ -0,0 +1,227 @@
+// Package metrics provides counters, gauges and histograms that are exposed
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Type is the type of a metric.
+type Type string
+
+const (
+	CounterType   Type = "counter"
+	GaugeType     Type = "gauge"
+	HistogramType Type = "histogram"
+)
+
+// DefBuckets are the default histogram buckets, suitable for latencies in
+// seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Registry holds all metrics. It is provided to services by the core server,
+// so services register their metrics by injecting it.
+type Registry struct {
+	families map[string]*family
+	sync.Mutex
+}
+
+func New() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is a metric along with all of its label combinations.
+type family struct {
+	name    string
+	help    string
+	typ     Type
+	labels  []string
+	buckets []float64
+
+	series map[string]*series
+	// collect, if set, reports the values of the metric when it is
+	// written instead of the series.
+	collect func(emit func(value float64, labelValues ...string))
+	sync.Mutex
+}
+
+// series is the value of a metric for a single combination of label values.
+type series struct {
+	labelValues []string
+	value       float64
+	// counts are the cumulative bucket counts of a histogram.
+	counts []uint64
+	count  uint64
+}
+
+// register returns the family with the given name, creating it if needed.
+// Registering the same metric again returns the existing family, so that
+// services can register their metrics each time they are initialized.
+// It panics if a different metric has already been registered with the
+// name, as that is a programming error.
+func (r *Registry) register(name, help string, typ Type, buckets []float64, labels []string) *family {
+	if !nameRe.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	for _, l := range labels {
+		if !nameRe.MatchString(l) || strings.HasPrefix(l, "__") || l == "le" {
+			panic(fmt.Sprintf("metrics: invalid label name %q for %s", l, name))
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s is already registered as a %s with labels %v", name, f.typ, f.labels))
+		}
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// get returns the series for the label values, creating it if needed.
+// f must be locked.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == HistogramType {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up, eg. the number of requests served.
+type Counter struct {
+	f *family
+}
+
+// Counter registers a counter. Counter names should end in "_total".
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, CounterType, nil, labels)}
+}
+
+// Inc adds one to the counter for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter for the label
+// values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: %s can not be decreased", c.f.name))
+	}
+	c.f.Lock()
+	c.f.get(labelValues).value += v
+	c.f.Unlock()
+}
+
+// Gauge is a value that can go up and down, eg. the length of a queue.
+type Gauge struct {
+	f *family
+}
+
+// Gauge registers a gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, GaugeType, nil, labels)}
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.Lock()
+	g.f.get(labelValues).value = v
+	g.f.Unlock()
+}
+
+// Add adds v, which may be negative, to the gauge for the label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.Lock()
+	g.f.get(labelValues).value += v
+	g.f.Unlock()
+}
+
+// Histogram counts observations, eg. request durations, in buckets.
+type Histogram struct {
+	f *family
+}
+
+// Histogram registers a histogram with the given bucket upper bounds. If
+// buckets is nil, DefBuckets are used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	if len(buckets) > 0 && math.IsInf(buckets[len(buckets)-1], 1) {
+		// the +Inf bucket is always added.
+		buckets = buckets[:len(buckets)-1]
+	}
+	return &Histogram{r.register(name, help, HistogramType, buckets, labels)}
+}
+
+// Observe adds an observation for the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.Lock()
+	s := h.f.get(labelValues)
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	h.f.Unlock()
+}
+
+// CounterFunc registers a counter whose values are reported by fn each time
+// the metrics are written, eg. from counters a component already keeps. fn
+// calls emit once for each combination of label values.
+func (r *Registry) CounterFunc(name, help string, labels []string, fn func(emit func(value float64, labelValues ...string))) {
+	r.register(name, help, CounterType, nil, labels).setCollect(fn)
+}
+
+// GaugeFunc registers a gauge whose values are reported by fn each time the
+// metrics are written. fn calls emit once for each combination of label
+// values.
+func (r *Registry) GaugeFunc(name, help string, labels []string, fn func(emit func(value float64, labelValues ...string))) {
+	r.register(name, help, GaugeType, nil, labels).setCollect(fn)
+}
+
+func (f *family) setCollect(fn func(emit func(value float64, labelValues ...string))) {
+	f.Lock()
+	f.collect = fn
+	f.Unlock()
+}
+
+// BoolValue returns 1 for true and 0 for false, for gauges that report a
+// condition.
+func BoolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteText writes all metrics in the Prometheus text exposition format,
+// ordered by name. Metrics without any values are left out.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		samples := f.samples()
+		if len(samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range samples {
+			labels := f.labelPairs(s.labelValues)
+			if f.typ != HistogramType {
+				fmt.Fprintf(bw, "%s%s %s\n", f.name, braces(labels), formatFloat(s.value))
+				continue
+			}
+			for i, upper := range f.buckets {
+				le := append(labels, `le="`+formatFloat(upper)+`"`)
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, braces(le), s.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, braces(append(labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.name, braces(labels), formatFloat(s.value))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.name, braces(labels), s.count)
+		}
+	}
+	return bw.Flush()
+}
+
+// samples returns a copy of the values of the metric, ordered by label
+// values.
+func (f *family) samples() []series {
+	f.Lock()
+	collect := f.collect
+	var result []series
+	if collect == nil {
+		result = make([]series, 0, len(f.series))
+		for _, s := range f.series {
+			c := *s
+			c.counts = append([]uint64(nil), s.counts...)
+			result = append(result, c)
+		}
+	}
+	f.Unlock()
+
+	if collect != nil {
+		collect(func(value float64, labelValues ...string) {
+			if len(labelValues) != len(f.labels) {
+				panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+			}
+			result = append(result, series{labelValues: labelValues, value: value})
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].labelValues, "\xff") < strings.Join(result[j].labelValues, "\xff")
+	})
+	return result
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(f.labels), len(f.labels)+1)
+	for i, l := range f.labels {
+		pairs[i] = l + `="` + escape(values[i], true) + `"`
+	}
+	return pairs
+}
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape escapes backslashes and newlines, and double quotes in label
+// values.
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := New()
+	// registered out of order to check that the output is sorted by name.
+	g := r.Gauge("zeta_temperature", "A gauge with\na newline and a \\ in its help.", "room")
+	g.Set(21.5, `living "room"`)
+	g.Set(math.Inf(1), "oven")
+	g.Set(-3, `back\slash
+newline`)
+	h := r.Histogram("alpha_duration_seconds", "A histogram.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/b")
+	h.Observe(0.5, "/b")
+	h.Observe(5, "/b")
+	h.Observe(0.1, "/a")
+	c := r.Counter("middle_total", "A counter without labels.")
+	c.Add(2)
+	c.Inc()
+	r.Counter("empty_total", "A counter that was never incremented.", "x")
+	r.GaugeFunc("func_value", "A gauge reported by a func.", []string{"name"}, func(emit func(float64, ...string)) {
+		emit(BoolValue(false), "b")
+		emit(BoolValue(true), "a")
+	})
+
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP alpha_duration_seconds A histogram.
+# TYPE alpha_duration_seconds histogram
+alpha_duration_seconds_bucket{route="/a",le="0.1"} 1
+alpha_duration_seconds_bucket{route="/a",le="1"} 1
+alpha_duration_seconds_bucket{route="/a",le="+Inf"} 1
+alpha_duration_seconds_sum{route="/a"} 0.1
+alpha_duration_seconds_count{route="/a"} 1
+alpha_duration_seconds_bucket{route="/b",le="0.1"} 1
+alpha_duration_seconds_bucket{route="/b",le="1"} 2
+alpha_duration_seconds_bucket{route="/b",le="+Inf"} 3
+alpha_duration_seconds_sum{route="/b"} 5.55
+alpha_duration_seconds_count{route="/b"} 3
+# HELP func_value A gauge reported by a func.
+# TYPE func_value gauge
+func_value{name="a"} 1
+func_value{name="b"} 0
+# HELP middle_total A counter without labels.
+# TYPE middle_total counter
+middle_total 3
+# HELP zeta_temperature A gauge with\na newline and a \\ in its help.
+# TYPE zeta_temperature gauge
+zeta_temperature{room="back\\slash\nnewline"} -3
+zeta_temperature{room="living \"room\""} 21.5
+zeta_temperature{room="oven"} +Inf
+`
+	if got := b.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
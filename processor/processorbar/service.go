@@ -8,30 +8,58 @@ import (
 	"github.com/woodsaj/go-server/cfg"
 	"github.com/woodsaj/go-server/components"
 	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
 )
 
 type ProcessorBar struct {
 	Cfg         *cfg.Cfg                        `inject:""`
 	PController *components.ProcessorController `inject:""`
+	Log         *log.Entry                      `inject:""`
+	Tracer      *tracing.Tracer                 `inject:""`
 
-	ready chan struct{}
+	ready    chan struct{}
+	deadline registry.StartDeadline
 }
 
 func init() {
 	registry.RegisterService(&ProcessorBar{}, 10)
 
+	cfg.RegisterSection("processor-bar", &Config{})
+}
+
+// Config holds the processor-bar settings. ProcessorBar takes 30 seconds
+// to warm up, which is longer than the default max-start-delay. So the
+// defaults demonstrate the fallback policy: ProcessorBar always misses its
+// start deadline, and its users get another processor until it is ready.
+type Config struct {
+	// starts or stops the service when changed at runtime.
+	Enabled bool `cfg:"enabled"`
+
 	//startup settings
-	cfg.SetDefault("processor-bar.enabled", false)
-	cfg.SetDefault("processor-bar.max-start-delay", time.Second*10)
+	// maximum time to wait for ProcessorBar to become ready. 0 disables the deadline.
+	MaxStartDelay time.Duration `cfg:"max-start-delay,static" default:"10s" validate:"min=0s"`
+	// what happens if ProcessorBar is not ready in time.
+	StartDeadlinePolicy string `cfg:"start-deadline-policy,static" default:"fallback" validate:"oneof=fail degraded fallback"`
 
 	// runtime settings
-	cfg.SetDefault("processor-bar.data", "ProcessorBar")
+	Data string `cfg:"data" default:"ProcessorBar"`
+}
+
+func (p *ProcessorBar) config() *Config {
+	return p.Cfg.Section("processor-bar").(*Config)
 }
 
 func (p *ProcessorBar) Init() error {
-	log.Debug("Initializing ProcessorBar svc")
+	p.Log.Debug("Initializing ProcessorBar svc")
 	p.ready = make(chan struct{})
-	err := p.PController.Set(p)
+	conf := p.config()
+	// already validated by Config
+	policy, _ := registry.ParseDeadlinePolicy(conf.StartDeadlinePolicy)
+	p.deadline = registry.StartDeadline{
+		Timeout: conf.MaxStartDelay,
+		Policy:  policy,
+	}
+	err := p.PController.Register("processor-bar", p, "text", "cached")
 	if err != nil {
 		return err
 	}
@@ -39,21 +67,35 @@ func (p *ProcessorBar) Init() error {
 }
 
 func (p *ProcessorBar) IsDisabled() bool {
-	return !p.Cfg.GetBool("processor-bar.enabled")
+	return !p.config().Enabled
 }
 
-func (p *ProcessorBar) Data() string {
-	return p.Cfg.GetString("processor-bar.data")
+func (p *ProcessorBar) Data(ctx context.Context) string {
+	_, span := p.Tracer.Start(ctx, "ProcessorBar.Data")
+	defer span.End()
+	span.SetAttribute("processor", "processor-bar")
+	return p.config().Data
 }
 
 func (p *ProcessorBar) Ready() <-chan struct{} {
 	return p.ready
 }
 
+func (p *ProcessorBar) StartDeadline() registry.StartDeadline {
+	return p.deadline
+}
+
 func (p *ProcessorBar) Run(ctx context.Context) error {
+	done := ctx.Done()
+	select {
+	case <-p.ready:
+		// already warmed up by a previous run.
+		<-done
+		return nil
+	default:
+	}
 	// simulate a 30second startup time.
 	timer := time.NewTimer(time.Second * 30)
-	done := ctx.Done()
 	select {
 	case <-timer.C:
 		close(p.ready)
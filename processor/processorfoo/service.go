@@ -1,15 +1,20 @@
 package processorfoo
 
 import (
+	"context"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/woodsaj/go-server/cfg"
 	"github.com/woodsaj/go-server/components"
 	"github.com/woodsaj/go-server/registry"
+	"github.com/woodsaj/go-server/tracing"
 )
 
 type ProcessorFoo struct {
 	Cfg         *cfg.Cfg                        `inject:""`
 	PController *components.ProcessorController `inject:""`
+	Log         *log.Entry                      `inject:""`
+	Tracer      *tracing.Tracer                 `inject:""`
 
 	ready chan struct{}
 }
@@ -17,17 +22,26 @@ type ProcessorFoo struct {
 func init() {
 	registry.RegisterService(&ProcessorFoo{}, 10)
 
-	// startup settings
-	cfg.SetDefault("processor-foo.enabled", false)
+	cfg.RegisterSection("processor-foo", &Config{})
+}
+
+// Config holds the processor-foo settings.
+type Config struct {
+	// starts or stops the service when changed at runtime.
+	Enabled bool `cfg:"enabled"`
 
 	// runtime settings
-	cfg.SetDefault("processor-foo.data", "ProcessorFoo")
+	Data string `cfg:"data" default:"ProcessorFoo"`
+}
+
+func (p *ProcessorFoo) config() *Config {
+	return p.Cfg.Section("processor-foo").(*Config)
 }
 
 func (p *ProcessorFoo) Init() error {
-	log.Debug("Initializing ProcessorFoo svc")
+	p.Log.Debug("Initializing ProcessorFoo svc")
 	p.ready = make(chan struct{})
-	err := p.PController.Set(p)
+	err := p.PController.Register("processor-foo", p, "text")
 	if err != nil {
 		return err
 	}
@@ -37,11 +51,14 @@ func (p *ProcessorFoo) Init() error {
 }
 
 func (p *ProcessorFoo) IsDisabled() bool {
-	return !p.Cfg.GetBool("processor-foo.enabled")
+	return !p.config().Enabled
 }
 
-func (p *ProcessorFoo) Data() string {
-	return p.Cfg.GetString("processor-foo.data")
+func (p *ProcessorFoo) Data(ctx context.Context) string {
+	_, span := p.Tracer.Start(ctx, "ProcessorFoo.Data")
+	defer span.End()
+	span.SetAttribute("processor", "processor-foo")
+	return p.config().Data
 }
 
 func (p *ProcessorFoo) Ready() <-chan struct{} {
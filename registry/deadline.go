@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DeadlinePolicy determines what happens when a ReadyNotifier service is
+// not ready within its start deadline.
+type DeadlinePolicy int
+
+const (
+	// DeadlineFail shuts down the server.
+	DeadlineFail DeadlinePolicy = iota
+	// DeadlineDegraded keeps the service running and reports it as degraded
+	// until it becomes ready.
+	DeadlineDegraded
+	// DeadlineFallback is like DeadlineDegraded, but also tells services
+	// that use the late service to use an alternative until it is ready.
+	DeadlineFallback
+)
+
+func (p DeadlinePolicy) String() string {
+	switch p {
+	case DeadlineDegraded:
+		return "degraded"
+	case DeadlineFallback:
+		return "fallback"
+	}
+	return "fail"
+}
+
+func (p DeadlinePolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// ParseDeadlinePolicy converts "fail", "degraded" or "fallback" to a
+// DeadlinePolicy.
+func ParseDeadlinePolicy(s string) (DeadlinePolicy, error) {
+	switch s {
+	case "fail":
+		return DeadlineFail, nil
+	case "degraded":
+		return DeadlineDegraded, nil
+	case "fallback":
+		return DeadlineFallback, nil
+	}
+	return DeadlineFail, fmt.Errorf("unknown start deadline policy %q. must be one of fail, degraded or fallback", s)
+}
+
+// StartDeadline is the maximum time a ReadyNotifier service may take to
+// become ready after it has been started. A Timeout of 0 means no deadline.
+type StartDeadline struct {
+	Timeout time.Duration
+	Policy  DeadlinePolicy
+}
+
+// StartDeadliner is implemented by ReadyNotifier services that set their
+// own start deadline. Other ReadyNotifier services use the server default.
+type StartDeadliner interface {
+	StartDeadline() StartDeadline
+}
+
+func (d *Descriptor) StartDeadliner() (StartDeadliner, bool) {
+	svc, ok := d.Instance.(StartDeadliner)
+	return svc, ok
+}
+
+var (
+	deadlineListeners []func(*Descriptor, StartDeadline)
+	deadlineMu        sync.Mutex
+)
+
+// OnStartDeadlineMissed registers a listener that is called whenever a
+// service misses its start deadline.
+func OnStartDeadlineMissed(fn func(d *Descriptor, deadline StartDeadline)) {
+	deadlineMu.Lock()
+	deadlineListeners = append(deadlineListeners, fn)
+	deadlineMu.Unlock()
+}
+
+// AwaitReady waits for a ReadyNotifier service to become ready. If it is
+// not ready within the deadline, the miss is recorded in the status of the
+// service, OnStartDeadlineMissed listeners are called and an error is
+// returned. Nil is returned if ctx is done first.
+func (d *Descriptor) AwaitReady(ctx context.Context, deadline StartDeadline) error {
+	r, ok := d.ReadyNotifier()
+	if !ok || deadline.Timeout <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(deadline.Timeout)
+	defer timer.Stop()
+	select {
+	case <-r.Ready():
+		return nil
+	case <-ctx.Done():
+		return nil
+	case <-timer.C:
+	}
+
+	d.Logger().Errorf("%s did not become ready within its start deadline of %s. policy: %s", d.Name, deadline.Timeout, deadline.Policy)
+	d.mu.Lock()
+	now := time.Now()
+	d.status.StartDeadlineMissed = &now
+	d.mu.Unlock()
+
+	deadlineMu.Lock()
+	listeners := make([]func(*Descriptor, StartDeadline), len(deadlineListeners))
+	copy(listeners, deadlineListeners)
+	deadlineMu.Unlock()
+	for _, l := range listeners {
+		l(d, deadline)
+	}
+	return fmt.Errorf("%s missed its start deadline of %s", d.Name, deadline.Timeout)
+}
+
+// MissedStartDeadline returns true if the service did not become ready
+// within its start deadline.
+func (d *Descriptor) MissedStartDeadline() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status.StartDeadlineMissed != nil
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/facebookgo/inject"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolve works out the dependencies of every registered service from the
+// populated inject graph and orders the services so that each service comes
+// after all of the services it depends on. Services that do not depend on
+// each other are ordered by their InitPriority.
+// Resolve must be called after the graph has been populated.
+func Resolve() ([]*Descriptor, error) {
+	byValue := make(map[interface{}]*Descriptor, len(services))
+	for _, d := range services {
+		if d.object == nil {
+			return nil, fmt.Errorf("service %s was not added to the dependency graph", d.Name)
+		}
+		byValue[d.object.Value] = d
+	}
+
+	for _, d := range services {
+		d.Dependencies = d.Dependencies[:0]
+		seen := make(map[*inject.Object]bool)
+		for _, dep := range sortedFields(d.object) {
+			d.addDependencies(dep, byValue, seen)
+		}
+		log.Debugf("%s depends on %v", d.Name, names(d.Dependencies))
+	}
+
+	sorted, err := sortServices(services)
+	if err != nil {
+		return nil, err
+	}
+	services = sorted
+	return services, nil
+}
+
+// addDependencies records o as a dependency if it is a registered service.
+// Objects that are not services, eg ones created by the inject graph, are
+// walked so that services they depend on are also recorded.
+func (d *Descriptor) addDependencies(o *inject.Object, byValue map[interface{}]*Descriptor, seen map[*inject.Object]bool) {
+	if seen[o] {
+		return
+	}
+	seen[o] = true
+
+	if dep, ok := byValue[o.Value]; ok {
+		if dep != d {
+			d.Dependencies = append(d.Dependencies, dep)
+		}
+		return
+	}
+	for _, field := range sortedFields(o) {
+		d.addDependencies(field, byValue, seen)
+	}
+}
+
+func names(list []*Descriptor) []string {
+	result := make([]string, len(list))
+	for i, d := range list {
+		result[i] = d.Name
+	}
+	return result
+}
+
+// sortedFields returns the objects injected into o, ordered by field name.
+func sortedFields(o *inject.Object) []*inject.Object {
+	names := make([]string, 0, len(o.Fields))
+	for name := range o.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]*inject.Object, len(names))
+	for i, name := range names {
+		fields[i] = o.Fields[name]
+	}
+	return fields
+}
+
+// sortServices topologically sorts the services by their dependencies.
+// If there is a dependency cycle an error naming the services in the
+// cycle is returned.
+func sortServices(list []*Descriptor) ([]*Descriptor, error) {
+	pending := make(map[*Descriptor]int, len(list))
+	dependents := make(map[*Descriptor][]*Descriptor)
+	for _, d := range list {
+		pending[d] = len(d.Dependencies)
+		for _, dep := range d.Dependencies {
+			dependents[dep] = append(dependents[dep], d)
+		}
+	}
+
+	ready := make([]*Descriptor, 0, len(list))
+	for _, d := range list {
+		if pending[d] == 0 {
+			ready = append(ready, d)
+		}
+	}
+
+	sorted := make([]*Descriptor, 0, len(list))
+	for len(ready) > 0 {
+		sort.SliceStable(ready, func(i, j int) bool {
+			if ready[i].InitPriority != ready[j].InitPriority {
+				return ready[i].InitPriority > ready[j].InitPriority
+			}
+			return ready[i].Name < ready[j].Name
+		})
+		d := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, d)
+		for _, dependent := range dependents[d] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(sorted) != len(list) {
+		return nil, fmt.Errorf("dependency cycle detected: %s", strings.Join(findCycle(list, pending), " -> "))
+	}
+	return sorted, nil
+}
+
+// findCycle returns the names of the services that form a dependency cycle,
+// starting and ending with the same service. Only services that could not
+// be sorted are considered.
+func findCycle(list []*Descriptor, pending map[*Descriptor]int) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[*Descriptor]int)
+	var stack []*Descriptor
+	var cycle []string
+
+	var visit func(d *Descriptor) bool
+	visit = func(d *Descriptor) bool {
+		state[d] = visiting
+		stack = append(stack, d)
+		for _, dep := range d.Dependencies {
+			if pending[dep] == 0 {
+				continue
+			}
+			switch state[dep] {
+			case visiting:
+				for i, s := range stack {
+					if s == dep {
+						for _, c := range stack[i:] {
+							cycle = append(cycle, c.Name)
+						}
+						cycle = append(cycle, dep.Name)
+						return true
+					}
+				}
+			case unvisited:
+				if visit(dep) {
+					return true
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[d] = done
+		return false
+	}
+
+	for _, d := range list {
+		if pending[d] > 0 && state[d] == unvisited && visit(d) {
+			return cycle
+		}
+	}
+	return cycle
+}
+
+// Graph is the dependency graph of the registered services.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	// Edges point from a service to each service it depends on.
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a service in the dependency graph.
+type GraphNode struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Priority Priority     `json:"priority"`
+	State    ServiceState `json:"state"`
+}
+
+// GraphEdge is a dependency of one service on another.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GetGraph returns the dependency graph of the registered services, with
+// the services in the order they are initialized in. It must be called
+// after Resolve().
+func GetGraph() Graph {
+	g := Graph{
+		Nodes: make([]GraphNode, 0, len(services)),
+		Edges: make([]GraphEdge, 0),
+	}
+	for _, d := range services {
+		g.Nodes = append(g.Nodes, GraphNode{
+			Name:     d.Name,
+			Type:     fmt.Sprintf("%T", d.Instance),
+			Priority: d.InitPriority,
+			State:    d.State(),
+		})
+		for _, dep := range d.Dependencies {
+			g.Edges = append(g.Edges, GraphEdge{From: d.Name, To: dep.Name})
+		}
+	}
+	return g
+}
+
+// DOT returns the graph in the Graphviz DOT language, eg. for rendering
+// with `dot -Tsvg`. Services that are not running are drawn dashed, and
+// failed services are drawn in red.
+func (g Graph) DOT() string {
+	var b bytes.Buffer
+	b.WriteString("digraph services {\n")
+	b.WriteString("\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		attrs := fmt.Sprintf("label=%q", n.Name+"\n"+n.Type+"\n"+string(n.State))
+		switch n.State {
+		case StateRunning:
+		case StateFailed:
+			attrs += ", color=red, style=dashed"
+		default:
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(&b, "\t%q [%s];\n", n.Name, attrs)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "\t%q -> %q;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/facebookgo/inject"
+)
+
+func TestSortServices(t *testing.T) {
+	tests := []struct {
+		name string
+		// deps are the dependencies of each service, by name.
+		deps     map[string][]string
+		priority map[string]Priority
+		want     []string
+		err      string
+	}{
+		{
+			name:     "independent services by priority, then name",
+			deps:     map[string][]string{"a": nil, "b": nil, "c": nil, "d": nil},
+			priority: map[string]Priority{"c": High, "d": 50},
+			want:     []string{"c", "d", "a", "b"},
+		},
+		{
+			name:     "dependencies before dependents regardless of priority",
+			deps:     map[string][]string{"api": {"pool"}, "pool": {"cfg"}, "cfg": nil},
+			priority: map[string]Priority{"api": High, "pool": 50},
+			want:     []string{"cfg", "pool", "api"},
+		},
+		{
+			name:     "ties between ready services use priority",
+			deps:     map[string][]string{"x": {"base"}, "y": {"base"}, "base": nil, "z": nil},
+			priority: map[string]Priority{"y": 10, "z": 5},
+			want:     []string{"z", "base", "y", "x"},
+		},
+		{
+			name: "cycle",
+			deps: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}, "d": nil},
+			err:  "dependency cycle detected: a -> b -> c -> a",
+		},
+		{
+			name: "cycle behind a dependency",
+			deps: map[string][]string{"top": {"a"}, "a": {"b"}, "b": {"a"}},
+			err:  "dependency cycle detected: a -> b -> a",
+		},
+	}
+	for _, tt := range tests {
+		list := descriptors(tt.deps, tt.priority)
+		sorted, err := sortServices(list)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := names(sorted); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got order %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// descriptors builds services with the given dependencies, in name order.
+func descriptors(deps map[string][]string, priority map[string]Priority) []*Descriptor {
+	byName := make(map[string]*Descriptor)
+	var list []*Descriptor
+	for _, name := range []string{"a", "b", "c", "d", "x", "y", "z", "api", "base", "cfg", "pool", "top"} {
+		if _, ok := deps[name]; !ok {
+			continue
+		}
+		d := &Descriptor{Name: name, InitPriority: priority[name]}
+		byName[name] = d
+		list = append(list, d)
+	}
+	for _, d := range list {
+		for _, dep := range deps[d.Name] {
+			d.Dependencies = append(d.Dependencies, byName[dep])
+		}
+	}
+	return list
+}
+
+type fakeStore struct{}
+
+func (s *fakeStore) Init() error { return nil }
+
+// fakeHelper is not a service, but carries a service into the services
+// that have it injected.
+type fakeHelper struct {
+	Store *fakeStore `inject:""`
+}
+
+type fakeApi struct {
+	Helper *fakeHelper `inject:""`
+}
+
+func (s *fakeApi) Init() error { return nil }
+
+func TestResolve(t *testing.T) {
+	defer func(saved []*Descriptor) { services = saved }(services)
+	services = nil
+	Register(&Descriptor{Name: "Api", Instance: &fakeApi{}, InitPriority: High})
+	store := &fakeStore{}
+	Register(&Descriptor{Name: "Store", Instance: store})
+
+	var graph inject.Graph
+	for _, d := range GetServices() {
+		if err := d.Inject(&graph); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := graph.Populate(); err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(sorted); !reflect.DeepEqual(got, []string{"Store", "Api"}) {
+		t.Errorf("got order %v, want [Store Api]", got)
+	}
+	api := sorted[1]
+	if got := names(api.Dependencies); !reflect.DeepEqual(got, []string{"Store"}) {
+		t.Errorf("Api depends on %v, want [Store]", got)
+	}
+	// services are provided unnamed, so `inject:""` fields get the
+	// registered instance rather than a new one.
+	if api.Instance.(*fakeApi).Helper.Store != store {
+		t.Errorf("Api was not injected with the registered Store")
+	}
+}
+
+func TestResolveNotInjected(t *testing.T) {
+	defer func(saved []*Descriptor) { services = saved }(services)
+	services = nil
+	Register(&Descriptor{Name: "Store", Instance: &fakeStore{}})
+	if _, err := Resolve(); err == nil || err.Error() != "service Store was not added to the dependency graph" {
+		t.Errorf("got error %v", err)
+	}
+}
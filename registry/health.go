@@ -0,0 +1,49 @@
+package registry
+
+import "context"
+
+// HealthState is the overall state reported by a health check.
+type HealthState string
+
+const (
+	// HealthUp means the service is working normally.
+	HealthUp HealthState = "up"
+	// HealthStarting means the service is alive but not yet ready for use.
+	HealthStarting HealthState = "starting"
+	// HealthDegraded means the service is working, but not optimally.
+	HealthDegraded HealthState = "degraded"
+	// HealthDown means the service is not working.
+	HealthDown HealthState = "down"
+)
+
+// HealthStatus is the result of a health check.
+type HealthStatus struct {
+	Status  HealthState            `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthChecker should be implemented by services that can report on
+// their own health.
+type HealthChecker interface {
+	// Health returns the current health of the service. The passed
+	// `context.Context` is cancelled when the check has taken too long.
+	Health(ctx context.Context) HealthStatus
+}
+
+// ReadyNotifier is implemented by services that are not ready for use
+// as soon as they have started, eg. because they need to warm up.
+type ReadyNotifier interface {
+	// Ready returns a channel that is closed once the service is ready.
+	Ready() <-chan struct{}
+}
+
+func (d *Descriptor) HealthChecker() (HealthChecker, bool) {
+	svc, ok := d.Instance.(HealthChecker)
+	return svc, ok
+}
+
+func (d *Descriptor) ReadyNotifier() (ReadyNotifier, bool) {
+	svc, ok := d.Instance.(ReadyNotifier)
+	return svc, ok
+}
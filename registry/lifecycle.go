@@ -0,0 +1,127 @@
+package registry
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceState is the lifecycle state of a service.
+type ServiceState string
+
+const (
+	// StateDisabled means the service is disabled in config.
+	StateDisabled ServiceState = "disabled"
+	// StateInitializing means Init() is being called.
+	StateInitializing ServiceState = "initializing"
+	// StateRunning means the service has been initialized and, if it is a
+	// BackgroundService, its Run() method is running.
+	StateRunning ServiceState = "running"
+	// StateStopping means the service is being stopped.
+	StateStopping ServiceState = "stopping"
+	// StateStopped means the service was stopped and can be started again.
+	StateStopped ServiceState = "stopped"
+	// StateFailed means Init() failed, or Run() failed and the service
+	// could not be restarted.
+	StateFailed ServiceState = "failed"
+)
+
+// Lifecycle starts and stops individual services while the rest of the
+// process keeps running. It is provided by the core server and can be
+// injected into services, eg. to expose it through the api.
+type Lifecycle interface {
+	// StartService starts a stopped service, along with any services it
+	// depends on and the services that were stopped with it.
+	StartService(ctx context.Context, name string) error
+	// StopService stops a service, after stopping the services that
+	// depend on it.
+	StopService(ctx context.Context, name string) error
+	// RestartService stops and then starts a service and its dependents.
+	// The services are not initialized again.
+	RestartService(ctx context.Context, name string) error
+}
+
+var (
+	stateListeners   []func(d *Descriptor, old, new ServiceState)
+	stateListenersMu sync.Mutex
+)
+
+// OnStateChange registers a listener that is called whenever the state of
+// a service changes.
+func OnStateChange(fn func(d *Descriptor, old, new ServiceState)) {
+	stateListenersMu.Lock()
+	stateListeners = append(stateListeners, fn)
+	stateListenersMu.Unlock()
+}
+
+// State returns the current lifecycle state of the service. Services that
+// have not been started yet are reported as stopped.
+func (d *Descriptor) State() ServiceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status.State == "" {
+		return StateStopped
+	}
+	return d.status.State
+}
+
+// SetState records the lifecycle state of the service and notifies the
+// OnStateChange listeners if it changed.
+func (d *Descriptor) SetState(state ServiceState) {
+	d.mu.Lock()
+	old := d.status.State
+	d.status.State = state
+	if state == StateRunning && old != StateRunning {
+		now := time.Now()
+		d.status.StartedAt = &now
+	} else if state != StateRunning {
+		d.status.StartedAt = nil
+	}
+	d.mu.Unlock()
+	if old == state {
+		return
+	}
+
+	stateListenersMu.Lock()
+	listeners := make([]func(*Descriptor, ServiceState, ServiceState), len(stateListeners))
+	copy(listeners, stateListeners)
+	stateListenersMu.Unlock()
+	for _, fn := range listeners {
+		fn(d, old, state)
+	}
+}
+
+// RecordFailure records err as the last error of the service.
+func (d *Descriptor) RecordFailure(err error) {
+	d.recordFailure(err)
+}
+
+// GetService returns the registered service with the given name, ignoring
+// case, or nil if there is none.
+func GetService(name string) *Descriptor {
+	for _, d := range services {
+		if strings.EqualFold(d.Name, name) {
+			return d
+		}
+	}
+	return nil
+}
+
+// Dependents returns the services that depend on d, directly or through
+// other services, in the order they are initialized in. It must be called
+// after Resolve().
+func Dependents(d *Descriptor) []*Descriptor {
+	affected := map[*Descriptor]bool{d: true}
+	var result []*Descriptor
+	// services are sorted so that dependencies always come first.
+	for _, s := range services {
+		for _, dep := range s.Dependencies {
+			if affected[dep] && !affected[s] {
+				affected[s] = true
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
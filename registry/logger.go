@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var entryType = reflect.TypeOf(&log.Entry{})
+
+// SetLogger sets the logger of the service. It must be called before the
+// service is added to the dependency graph.
+func (d *Descriptor) SetLogger(logger *log.Entry) {
+	d.mu.Lock()
+	d.logger = logger
+	d.mu.Unlock()
+}
+
+// Logger returns the logger of the service. Unless another logger was set
+// with SetLogger, it is the standard logger with the service field set to
+// the name of the service.
+func (d *Descriptor) Logger() *log.Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.logger == nil {
+		d.logger = log.WithField("service", d.Name)
+	}
+	return d.logger
+}
+
+// injectLogger sets the `inject:""` fields of the service that are of type
+// *logrus.Entry to the logger of the service. inject does not replace
+// fields that are already set, so each service ends up with its own logger
+// rather than a single shared instance.
+func (d *Descriptor) injectLogger() {
+	v := reflect.ValueOf(d.Instance)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type != entryType || f.PkgPath != "" {
+			continue
+		}
+		if _, ok := f.Tag.Lookup("inject"); !ok {
+			continue
+		}
+		if field := v.Field(i); field.IsNil() {
+			field.Set(reflect.ValueOf(d.Logger()))
+		}
+	}
+}
@@ -3,7 +3,7 @@ package registry
 import (
 	"context"
 	"reflect"
-	"sort"
+	"sync"
 
 	"github.com/facebookgo/inject"
 	log "github.com/sirupsen/logrus"
@@ -13,11 +13,31 @@ type Descriptor struct {
 	Name         string
 	Instance     Service
 	InitPriority Priority
+
+	// RestartPolicy determines what happens when a BackgroundService stops.
+	// The default is to never restart the service.
+	RestartPolicy RestartPolicy
+
+	// Dependencies are the services that this service had injected into it,
+	// either directly or through an object that is not itself a service.
+	// They are populated by Resolve().
+	Dependencies []*Descriptor
+
+	object *inject.Object
+	status ServiceStatus
+	logger *log.Entry
+	mu     sync.Mutex
 }
 
-func (d *Descriptor) Inject(serviceGraph *inject.Graph) {
+func (d *Descriptor) Inject(serviceGraph *inject.Graph) error {
 	log.Debugf("adding %s as type %T to dependency graph.", d.Name, d.Instance)
-	serviceGraph.Provide(&inject.Object{Value: d.Instance, Name: d.Name})
+	// each service gets its own logger, so set it before the graph
+	// assigns one shared instance to all of them.
+	d.injectLogger()
+	// services are provided unnamed so that they are the instances used to
+	// satisfy `inject:""` fields of their type.
+	d.object = &inject.Object{Value: d.Instance}
+	return serviceGraph.Provide(d.object)
 }
 
 func (d *Descriptor) IsDisabled() bool {
@@ -30,6 +50,16 @@ func (d *Descriptor) BackgroundService() (BackgroundService, bool) {
 	return svc, ok
 }
 
+func (d *Descriptor) Stoppable() (Stoppable, bool) {
+	svc, ok := d.Instance.(Stoppable)
+	return svc, ok
+}
+
+func (d *Descriptor) Verifier() (Verifier, bool) {
+	svc, ok := d.Instance.(Verifier)
+	return svc, ok
+}
+
 var services []*Descriptor
 
 func RegisterService(instance Service, prio Priority) {
@@ -44,11 +74,18 @@ func Register(descriptor *Descriptor) {
 	services = append(services, descriptor)
 }
 
-func GetServices() []*Descriptor {
-	sort.Slice(services, func(i, j int) bool {
-		return services[i].InitPriority > services[j].InitPriority
-	})
+// SetServices replaces the registered services and returns the services
+// that were registered before, eg. to run a server with fake services in
+// tests.
+func SetServices(list []*Descriptor) []*Descriptor {
+	previous := services
+	services = list
+	return previous
+}
 
+// GetServices returns all registered services. Once Resolve() has been called
+// the services are returned in the order they should be initialized.
+func GetServices() []*Descriptor {
 	return services
 }
 
@@ -79,6 +116,29 @@ type BackgroundService interface {
 	Run(ctx context.Context) error
 }
 
+// Stoppable should be implemented for services that need to do work, like
+// draining connections, to stop cleanly. Services are stopped in the reverse
+// order they were initialized in, so a service is stopped before any of the
+// services that it depends on.
+type Stoppable interface {
+	// Stop is called at shutdown before the context passed to `Run` is cancelled.
+	// It should return once the service has stopped or the deadline of the
+	// passed `context.Context` has been reached.
+	Stop(ctx context.Context) error
+}
+
+// Verifier should be implemented by services that check what the other
+// services have registered with them, eg. for conflicts, so that problems
+// are found before anything is started.
+type Verifier interface {
+	// Verify is called once `Init` has been called on all services and
+	// before any BackgroundService is started. An error stops the server
+	// from starting.
+	Verify() error
+}
+
+// Priority is used to order services that do not depend on each other.
+// Services with a higher priority are initialized first.
 type Priority int
 
 const (
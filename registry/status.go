@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+// ServiceStatus is the runtime status of a service.
+type ServiceStatus struct {
+	Name string `json:"name"`
+	// Type is the type of the service instance, eg. *workera.WorkerA.
+	Type     string   `json:"type"`
+	Priority Priority `json:"priority"`
+	// Disabled is true if the service is disabled in config.
+	Disabled bool         `json:"disabled"`
+	State    ServiceState `json:"state"`
+	// StartedAt is when the service last entered the running state. It is
+	// only set while the service is running.
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	// Uptime is the time since StartedAt.
+	Uptime        string      `json:"uptime,omitempty"`
+	RestartPolicy RestartMode `json:"restartPolicy"`
+	Restarts      int         `json:"restarts"`
+	LastError     string      `json:"lastError,omitempty"`
+	LastErrorTime *time.Time  `json:"lastErrorTime,omitempty"`
+	// StartDeadlineMissed is when the service missed its start deadline.
+	StartDeadlineMissed *time.Time `json:"startDeadlineMissed,omitempty"`
+	// Dependencies are the names of the services injected into the service.
+	Dependencies []string `json:"dependencies"`
+}
+
+// Status returns a copy of the current status of the service.
+func (d *Descriptor) Status() ServiceStatus {
+	d.mu.Lock()
+	status := d.status
+	status.Name = d.Name
+	if status.State == "" {
+		status.State = StateStopped
+	}
+	status.Type = fmt.Sprintf("%T", d.Instance)
+	status.Priority = d.InitPriority
+	status.RestartPolicy = d.RestartPolicy.Mode
+	if status.StartedAt != nil {
+		status.Uptime = time.Since(*status.StartedAt).Round(time.Second).String()
+	}
+	status.Dependencies = names(d.Dependencies)
+	d.mu.Unlock()
+	// IsDisabled is implemented by the service, so is called without
+	// holding the lock.
+	status.Disabled = d.IsDisabled()
+	return status
+}
+
+func (d *Descriptor) recordFailure(err error) {
+	d.mu.Lock()
+	d.status.LastError = err.Error()
+	now := time.Now()
+	d.status.LastErrorTime = &now
+	d.mu.Unlock()
+}
+
+func (d *Descriptor) recordRestart() {
+	d.mu.Lock()
+	d.status.Restarts++
+	d.mu.Unlock()
+}
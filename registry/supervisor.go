@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// RestartMode determines when a background service is restarted after
+// its Run method returns.
+type RestartMode int
+
+const (
+	// RestartNever never restarts the service. The process is shutdown
+	// once the service stops, whether it failed or not.
+	RestartNever RestartMode = iota
+	// RestartOnFailure restarts the service only when Run returns an error.
+	// If Run returns nil the service is left stopped and the rest of the
+	// process keeps running.
+	RestartOnFailure
+	// RestartAlways restarts the service whenever Run returns.
+	RestartAlways
+)
+
+func (m RestartMode) String() string {
+	switch m {
+	case RestartOnFailure:
+		return "on-failure"
+	case RestartAlways:
+		return "always"
+	default:
+		return "never"
+	}
+}
+
+func (m RestartMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// RestartPolicy describes how a background service is supervised.
+// Zero values are replaced with sensible defaults.
+type RestartPolicy struct {
+	Mode RestartMode
+
+	// InitialBackoff is the time waited before the first restart. It is
+	// doubled for each subsequent restart within Window up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxRestarts is the number of restarts allowed within Window. Once
+	// exhausted the failure is escalated and the process is shutdown.
+	MaxRestarts int
+	Window      time.Duration
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = time.Minute
+	}
+	if p.MaxRestarts == 0 {
+		p.MaxRestarts = 5
+	}
+	if p.Window == 0 {
+		p.Window = time.Minute * 10
+	}
+	return p
+}
+
+// backoff returns the time to wait before the nth restart within the window.
+func (p RestartPolicy) backoff(n int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < n && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// Supervise runs the background service, restarting it according to the
+// RestartPolicy of the descriptor. It returns nil once ctx is cancelled or
+// the service has stopped and should not be restarted. An error is only
+// returned when the service failed and could not be restarted, in which
+// case the failure should be escalated.
+func (d *Descriptor) Supervise(ctx context.Context) error {
+	svc, ok := d.BackgroundService()
+	if !ok {
+		return fmt.Errorf("%s is not a background service", d.Name)
+	}
+	policy := d.RestartPolicy.withDefaults()
+	var restarts []time.Time
+
+	for {
+		err := d.runService(ctx, svc)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil && policy.Mode != RestartAlways {
+			return nil
+		}
+		if err != nil {
+			d.recordFailure(err)
+			if policy.Mode == RestartNever {
+				return err
+			}
+		}
+
+		// only count restarts within the window.
+		now := time.Now()
+		for len(restarts) > 0 && now.Sub(restarts[0]) > policy.Window {
+			restarts = restarts[1:]
+		}
+		if len(restarts) >= policy.MaxRestarts {
+			if err == nil {
+				err = fmt.Errorf("service stopped")
+			}
+			return fmt.Errorf("%s restarted %d times within %s. last error: %v", d.Name, len(restarts), policy.Window, err)
+		}
+		restarts = append(restarts, now)
+
+		backoff := policy.backoff(len(restarts))
+		d.Logger().Warnf("%s stopped. reason: %v. Restarting in %s (restart %d of %d within %s)", d.Name, err, backoff, len(restarts), policy.MaxRestarts, policy.Window)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		d.recordRestart()
+	}
+}
+
+// runService calls Run on the service, converting a panic into an error.
+func (d *Descriptor) runService(ctx context.Context, svc BackgroundService) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.Logger().Errorf("panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return svc.Run(ctx)
+}
@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyDefaults(t *testing.T) {
+	p := RestartPolicy{}.withDefaults()
+	want := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, MaxRestarts: 5, Window: 10 * time.Minute}
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+	p = RestartPolicy{Mode: RestartAlways, InitialBackoff: time.Millisecond, MaxRestarts: 2}.withDefaults()
+	if p.Mode != RestartAlways || p.InitialBackoff != time.Millisecond || p.MaxRestarts != 2 {
+		t.Errorf("set values were replaced: %+v", p)
+	}
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+	// an initial backoff above the maximum is capped.
+	p = RestartPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Second}
+	if got := p.backoff(1); got != time.Second {
+		t.Errorf("backoff(1) = %s, want 1s", got)
+	}
+}
+
+// fakeRunner returns the results in order from each call to Run, and
+// then blocks until ctx is done.
+type fakeRunner struct {
+	results []func() error
+	calls   int
+}
+
+func (f *fakeRunner) Init() error { return nil }
+
+func (f *fakeRunner) Run(ctx context.Context) error {
+	f.calls++
+	if f.calls <= len(f.results) {
+		return f.results[f.calls-1]()
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func fail(msg string) func() error {
+	return func() error { return errors.New(msg) }
+}
+
+func succeed() error { return nil }
+
+func TestSupervise(t *testing.T) {
+	fast := func(mode RestartMode) RestartPolicy {
+		return RestartPolicy{Mode: mode, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, MaxRestarts: 2, Window: time.Minute}
+	}
+	tests := []struct {
+		name     string
+		policy   RestartPolicy
+		results  []func() error
+		err      string
+		calls    int
+		restarts int
+	}{
+		{
+			name:    "never restarts a failed service",
+			policy:  fast(RestartNever),
+			results: []func() error{fail("boom")},
+			err:     "boom",
+			calls:   1,
+		},
+		{
+			name:    "never restarts a finished service",
+			policy:  fast(RestartNever),
+			results: []func() error{succeed},
+			calls:   1,
+		},
+		{
+			name:    "panics are failures",
+			policy:  fast(RestartNever),
+			results: []func() error{func() error { panic("oops") }},
+			err:     "panic: oops",
+			calls:   1,
+		},
+		{
+			name:     "on failure restarts until the service finishes",
+			policy:   fast(RestartOnFailure),
+			results:  []func() error{fail("boom"), func() error { panic("oops") }, succeed},
+			calls:    3,
+			restarts: 2,
+		},
+		{
+			name:     "on failure escalates once the restarts are used up",
+			policy:   fast(RestartOnFailure),
+			results:  []func() error{fail("one"), fail("two"), fail("three")},
+			err:      "Fake restarted 2 times within 1m0s. last error: three",
+			calls:    3,
+			restarts: 2,
+		},
+		{
+			name:     "always restarts a finished service",
+			policy:   fast(RestartAlways),
+			results:  []func() error{succeed, succeed, succeed},
+			err:      "Fake restarted 2 times within 1m0s. last error: service stopped",
+			calls:    3,
+			restarts: 2,
+		},
+		{
+			name: "only restarts within the window count",
+			policy: RestartPolicy{Mode: RestartOnFailure, InitialBackoff: 5 * time.Millisecond, MaxBackoff: 5 * time.Millisecond,
+				MaxRestarts: 1, Window: time.Millisecond},
+			results:  []func() error{fail("one"), fail("two"), fail("three"), succeed},
+			calls:    4,
+			restarts: 3,
+		},
+	}
+	for _, tt := range tests {
+		runner := &fakeRunner{results: tt.results}
+		d := &Descriptor{Name: "Fake", Instance: runner, RestartPolicy: tt.policy}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := d.Supervise(ctx)
+		if ctx.Err() != nil {
+			t.Errorf("%s: Supervise did not return", tt.name)
+		}
+		cancel()
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if runner.calls != tt.calls {
+			t.Errorf("%s: Run called %d times, want %d", tt.name, runner.calls, tt.calls)
+		}
+		if got := d.Status().Restarts; got != tt.restarts {
+			t.Errorf("%s: %d restarts, want %d", tt.name, got, tt.restarts)
+		}
+	}
+}
+
+func TestSuperviseCancel(t *testing.T) {
+	runner := &fakeRunner{results: []func() error{fail("boom")}}
+	d := &Descriptor{Name: "Fake", Instance: runner, RestartPolicy: RestartPolicy{Mode: RestartOnFailure, InitialBackoff: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.Supervise(ctx)
+	}()
+	// the service is waiting to be restarted.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %s after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Supervise did not return after cancel")
+	}
+	if got := d.Status().LastError; got != "boom" {
+		t.Errorf("last error %q, want boom", got)
+	}
+}
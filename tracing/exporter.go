@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exporter sends finished spans somewhere they can be viewed, eg. a file or
+// a collector.
+type Exporter interface {
+	// Export is called with batches of spans from a single goroutine.
+	Export(ctx context.Context, spans []SpanData) error
+	// Shutdown is called once no more spans will be exported.
+	Shutdown(ctx context.Context) error
+}
+
+// WriterExporter writes each span as a line of JSON.
+type WriterExporter struct {
+	w      io.Writer
+	closer io.Closer
+	sync.Mutex
+}
+
+// NewWriterExporter returns an exporter that writes spans to w, eg.
+// os.Stdout.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// NewFileExporter returns an exporter that appends spans to the file at
+// path, creating it if needed. The file is closed on Shutdown.
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{w: f, closer: f}, nil
+}
+
+func (e *WriterExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.Lock()
+	defer e.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, span := range spans {
+		if err := enc.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.closer == nil {
+		return nil
+	}
+	err := e.closer.Close()
+	e.closer = nil
+	return err
+}
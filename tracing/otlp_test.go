@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOTLPRequest(t *testing.T) {
+	start := time.Unix(1700000000, 123456789)
+	spans := []SpanData{
+		{
+			Service:      "demo",
+			TraceID:      "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanID:       "00f067aa0ba902b7",
+			ParentSpanID: "b7ad6b7169203331",
+			Name:         "GET /hello",
+			Kind:         KindServer,
+			Start:        start,
+			End:          start.Add(1500 * time.Millisecond),
+			Attributes: map[string]interface{}{
+				"http.status_code": 500,
+				"http.method":      "GET",
+				"cached":           true,
+				"ratio":            0.5,
+				"job.id":           uint64(7),
+				"size":             int64(-3),
+				"tags":             []string{"a"},
+			},
+			Error: "boom",
+		},
+		{Service: "other", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "0000000000000001", Name: "internal", Kind: KindInternal, Start: start, End: start},
+		{Service: "demo", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "0000000000000002", Name: "consumer", Kind: KindConsumer, Start: start, End: start},
+	}
+
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	var want interface{}
+	err = json.Unmarshal([]byte(`{"resourceSpans": [
+		{
+			"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "demo"}}]},
+			"scopeSpans": [{
+				"scope": {"name": "github.com/woodsaj/go-server/tracing"},
+				"spans": [
+					{
+						"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+						"spanId": "00f067aa0ba902b7",
+						"parentSpanId": "b7ad6b7169203331",
+						"name": "GET /hello",
+						"kind": 2,
+						"startTimeUnixNano": "1700000000123456789",
+						"endTimeUnixNano": "1700000001623456789",
+						"attributes": [
+							{"key": "cached", "value": {"boolValue": true}},
+							{"key": "http.method", "value": {"stringValue": "GET"}},
+							{"key": "http.status_code", "value": {"intValue": "500"}},
+							{"key": "job.id", "value": {"intValue": "7"}},
+							{"key": "ratio", "value": {"doubleValue": 0.5}},
+							{"key": "size", "value": {"intValue": "-3"}},
+							{"key": "tags", "value": {"stringValue": "[a]"}}
+						],
+						"status": {"code": 2, "message": "boom"}
+					},
+					{
+						"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+						"spanId": "0000000000000002",
+						"name": "consumer",
+						"kind": 5,
+						"startTimeUnixNano": "1700000000123456789",
+						"endTimeUnixNano": "1700000000123456789",
+						"status": {"code": 0}
+					}
+				]
+			}]
+		},
+		{
+			"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "other"}}]},
+			"scopeSpans": [{
+				"scope": {"name": "github.com/woodsaj/go-server/tracing"},
+				"spans": [
+					{
+						"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+						"spanId": "0000000000000001",
+						"name": "internal",
+						"kind": 1,
+						"startTimeUnixNano": "1700000000123456789",
+						"endTimeUnixNano": "1700000000123456789",
+						"status": {"code": 0}
+					}
+				]
+			}]
+		}
+	]}`), &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected OTLP request:\n%s", body)
+	}
+}
+
+func TestOTLPKinds(t *testing.T) {
+	// OTLP numbers the kinds from 1, with 0 for unspecified.
+	want := map[SpanKind]int{
+		KindInternal: 1,
+		KindServer:   2,
+		KindClient:   3,
+		KindProducer: 4,
+		KindConsumer: 5,
+	}
+	for kind, code := range want {
+		if got := otlpSpanOf(SpanData{Kind: kind}).Kind; got != code {
+			t.Errorf("kind %s is encoded as %d, want %d", kind, got, code)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	var header http.Header
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write([]byte("nope\n"))
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(srv.URL+"/v1/traces", map[string]string{"Authorization": "Bearer t"})
+	spans := []SpanData{{Service: "demo", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Name: "span"}}
+	if err := e.Export(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := header.Get("Authorization"); got != "Bearer t" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+	want, _ := json.Marshal(otlpRequest(spans))
+	if string(body) != string(want) {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	status = http.StatusBadRequest
+	err := e.Export(context.Background(), spans)
+	if err == nil {
+		t.Fatal("expected an error for a 400 response")
+	}
+	if want := srv.URL + "/v1/traces returned 400 Bad Request. nope"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
+
+// sliceExporter collects exported spans.
+type sliceExporter struct {
+	spans []SpanData
+	err   error
+}
+
+func (e *sliceExporter) Export(ctx context.Context, spans []SpanData) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *sliceExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestTracerExport(t *testing.T) {
+	e := &sliceExporter{}
+	tracer := New("demo", e)
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	parent.SetKind(KindServer)
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttribute("n", 1)
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End()
+	parent.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(e.spans))
+	}
+	c, p := e.spans[0], e.spans[1]
+	if c.Service != "demo" || c.Name != "child" || c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID {
+		t.Errorf("unexpected child span %+v of %+v", c, p)
+	}
+	if c.Error != "failed" || c.Attributes["n"] != 1 || c.Kind != KindInternal {
+		t.Errorf("unexpected child span %+v", c)
+	}
+	if p.ParentSpanID != "" || p.Kind != KindServer {
+		t.Errorf("unexpected parent span %+v", p)
+	}
+	if exported, dropped := tracer.Stats(); exported != 2 || dropped != 0 {
+		t.Errorf("Stats() = %d, %d, want 2, 0", exported, dropped)
+	}
+
+	// spans that end after shutdown are dropped.
+	_, late := tracer.Start(context.Background(), "late")
+	late.End()
+	if _, dropped := tracer.Stats(); dropped != 1 {
+		t.Errorf("dropped %d spans, want 1", dropped)
+	}
+}
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader is the W3C Trace Context header that carries the
+// SpanContext of the caller.
+const TraceparentHeader = "traceparent"
+
+// Traceparent returns the SpanContext in the W3C traceparent format, eg.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	// later versions may add fields, but must keep the first four.
+	var v [1]byte
+	if err := decodeHex(v[:], version); err != nil || v[0] == 0xff || (v[0] == 0 && len(parts) != 4) {
+		return sc, fmt.Errorf("unsupported traceparent version in %q", s)
+	}
+	if err := decodeHex(sc.TraceID[:], traceID); err != nil {
+		return sc, fmt.Errorf("invalid trace id in traceparent %q", s)
+	}
+	if err := decodeHex(sc.SpanID[:], spanID); err != nil {
+		return sc, fmt.Errorf("invalid span id in traceparent %q", s)
+	}
+	var f [1]byte
+	if err := decodeHex(f[:], flags); err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q. ids must not be all zeros", s)
+	}
+	sc.Sampled = f[0]&1 == 1
+	return sc, nil
+}
+
+// decodeHex decodes s into dst, which s must fill exactly. Only lower case
+// hex is valid in traceparent.
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid length or case")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// Extract returns a copy of ctx that carries the SpanContext from the
+// traceparent header, if there is a valid one, so that spans started from
+// it continue the caller's trace.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return ContextWithRemote(ctx, sc)
+}
+
+// Inject sets the traceparent header to the SpanContext carried by ctx, so
+// that the receiver continues the trace. h is unchanged if ctx does not
+// carry a span.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
@@ -0,0 +1,153 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		valid   bool
+		trace   string
+		span    string
+		sampled bool
+	}{
+		{
+			name:    "sampled",
+			header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			valid:   true,
+			trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			span:    "00f067aa0ba902b7",
+			sampled: true,
+		},
+		{
+			name:   "not sampled",
+			header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			valid:  true,
+			trace:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			span:   "00f067aa0ba902b7",
+		},
+		{
+			name:    "other flags are ignored",
+			header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03",
+			valid:   true,
+			trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			span:    "00f067aa0ba902b7",
+			sampled: true,
+		},
+		{
+			name:    "surrounding whitespace",
+			header:  " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ",
+			valid:   true,
+			trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			span:    "00f067aa0ba902b7",
+			sampled: true,
+		},
+		{
+			name:    "future version",
+			header:  "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			valid:   true,
+			trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			span:    "00f067aa0ba902b7",
+			sampled: true,
+		},
+		{
+			name:    "future version with extra fields",
+			header:  "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future-holds",
+			valid:   true,
+			trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			span:    "00f067aa0ba902b7",
+			sampled: true,
+		},
+		{name: "empty", header: ""},
+		{name: "too few fields", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{name: "version ff", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "version 00 with extra fields", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{name: "version not hex", header: "zz-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "version too long", header: "000-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "upper case trace id", header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{name: "upper case span id", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00F067AA0BA902B7-01"},
+		{name: "upper case flags", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0A"},
+		{name: "short trace id", header: "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01"},
+		{name: "long span id", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7aa-01"},
+		{name: "trace id not hex", header: "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01"},
+		{name: "all zero trace id", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "all zero span id", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+	}
+	for _, tt := range tests {
+		sc, err := ParseTraceparent(tt.header)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: ParseTraceparent(%q) should have failed", tt.name, tt.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseTraceparent(%q): %s", tt.name, tt.header, err)
+			continue
+		}
+		if sc.TraceID.String() != tt.trace || sc.SpanID.String() != tt.span || sc.Sampled != tt.sampled {
+			t.Errorf("%s: ParseTraceparent(%q) = %s %s sampled=%t, want %s %s sampled=%t",
+				tt.name, tt.header, sc.TraceID, sc.SpanID, sc.Sampled, tt.trace, tt.span, tt.sampled)
+		}
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sc.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; got != want {
+		t.Errorf("Traceparent() = %q, want %q", got, want)
+	}
+	sc.Sampled = false
+	if got, want := sc.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"; got != want {
+		t.Errorf("Traceparent() = %q, want %q", got, want)
+	}
+	// future versions are sent on as version 00.
+	sc, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sc.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; got != want {
+		t.Errorf("Traceparent() = %q, want %q", got, want)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	tracer := New("test", nil)
+	defer tracer.Shutdown(context.Background())
+
+	h := make(http.Header)
+	Inject(context.Background(), h)
+	if v := h.Get(TraceparentHeader); v != "" {
+		t.Errorf("Inject without a span set traceparent to %q", v)
+	}
+
+	ctx, span := tracer.Start(context.Background(), "client")
+	defer span.End()
+	Inject(ctx, h)
+	if got, want := h.Get(TraceparentHeader), span.Context().Traceparent(); got != want {
+		t.Fatalf("Inject set traceparent to %q, want %q", got, want)
+	}
+
+	_, child := tracer.Start(Extract(context.Background(), h), "server")
+	defer child.End()
+	if child.Context().TraceID != span.Context().TraceID {
+		t.Errorf("child of extracted context has trace %s, want %s", child.Context().TraceID, span.Context().TraceID)
+	}
+	if child.parent != span.Context().SpanID {
+		t.Errorf("child of extracted context has parent %s, want %s", child.parent, span.Context().SpanID)
+	}
+
+	h.Set(TraceparentHeader, "garbage")
+	_, root := tracer.Start(Extract(context.Background(), h), "server")
+	defer root.End()
+	if root.parent.IsValid() || root.Context().TraceID == span.Context().TraceID {
+		t.Errorf("invalid traceparent should start a new trace")
+	}
+}
@@ -0,0 +1,409 @@
+// Package tracing records spans of work, eg. HTTP requests, worker jobs and
+// processor calls, and exports them so that latency can be followed across
+// services. Spans are linked to their parent through context.Context, and
+// to remote callers through the W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TraceID identifies a trace, ie. all the spans of a single request.
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// IsValid returns false for the all zero ID.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid returns false for the all zero ID.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext identifies a span. It is what is propagated to child spans,
+// and to other processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind describes the relationship of a span to its parent and children.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = iota
+	// KindServer is a span for a request received from a remote caller.
+	KindServer
+	// KindClient is a span for a request made to a remote service.
+	KindClient
+	// KindProducer is a span for work queued to be done later.
+	KindProducer
+	// KindConsumer is a span for work taken from a queue.
+	KindConsumer
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case KindServer:
+		return "server"
+	case KindClient:
+		return "client"
+	case KindProducer:
+		return "producer"
+	case KindConsumer:
+		return "consumer"
+	default:
+		return "internal"
+	}
+}
+
+func (k SpanKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Span is a timed unit of work. Spans are started with Tracer.Start, and
+// must be ended with End, which passes them to the exporter.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  SpanID
+	name    string
+	kind    SpanKind
+	start   time.Time
+
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+	sync.Mutex
+}
+
+// Context returns the SpanContext of the span.
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// SetKind sets the kind of the span. Spans are KindInternal by default.
+func (s *Span) SetKind(kind SpanKind) {
+	s.Lock()
+	s.kind = kind
+	s.Unlock()
+}
+
+// SetAttribute records a key value pair on the span, eg. the HTTP status
+// code. Values should be strings, bools or numbers.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.Lock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+	s.Unlock()
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.Lock()
+	s.err = err.Error()
+	s.Unlock()
+}
+
+// End records the end time of the span and passes it to the exporter.
+// Calls after the first are ignored.
+func (s *Span) End() {
+	end := time.Now()
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		TraceID: s.context.TraceID.String(),
+		SpanID:  s.context.SpanID.String(),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   s.start,
+		End:     end,
+		Error:   s.err,
+	}
+	if len(s.attributes) > 0 {
+		data.Attributes = make(map[string]interface{}, len(s.attributes))
+		for key, value := range s.attributes {
+			data.Attributes[key] = value
+		}
+	}
+	s.Unlock()
+	if s.parent.IsValid() {
+		data.ParentSpanID = s.parent.String()
+	}
+	if s.context.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+// SpanData is a finished span, as passed to exporters.
+type SpanData struct {
+	Service      string                 `json:"service"`
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         SpanKind               `json:"kind"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// ContextWithSpan returns a copy of ctx that carries span, so that spans
+// started from it are children of span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// ContextWithRemote returns a copy of ctx that carries the SpanContext of a
+// span in another process or goroutine, so that spans started from it are
+// its children.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// SpanContextFromContext returns the SpanContext of the span carried by
+// ctx, or of the remote parent it carries. The returned SpanContext is not
+// valid if ctx carries neither.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.context
+	}
+	sc, _ := ctx.Value(remoteKey).(SpanContext)
+	return sc
+}
+
+// Tracer starts spans and exports them once they have ended. Spans are
+// exported in batches by a background goroutine, so exporting never blocks
+// the work being traced. It is provided to services by the core server.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	spans    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+
+	exported, dropped int64
+	closed            bool
+	sync.RWMutex
+}
+
+const (
+	// queueSize is the number of ended spans that can wait to be exported.
+	// Spans that end while the queue is full are dropped.
+	queueSize = 2048
+	// batchSize is the maximum number of spans passed to Export at once.
+	batchSize = 256
+	// flushInterval is how often spans are exported if the batch is not
+	// full.
+	flushInterval = time.Second
+	// exportTimeout is the time allowed for each call to Export.
+	exportTimeout = 10 * time.Second
+)
+
+// New creates a Tracer that exports spans, along with the name of the
+// service, to exporter. If exporter is nil, spans are still created and
+// propagated, but not exported.
+func New(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		spans:    make(chan SpanData, queueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a span with the given name, as a child of the span carried
+// by ctx, if any. The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+	}
+	if parent := SpanContextFromContext(ctx); parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+// Enabled returns true if spans are exported.
+func (t *Tracer) Enabled() bool {
+	return t.exporter != nil
+}
+
+// Stats returns the number of spans that were exported, and the number
+// that were dropped because the queue was full or the exporter failed.
+func (t *Tracer) Stats() (exported, dropped int64) {
+	return atomic.LoadInt64(&t.exported), atomic.LoadInt64(&t.dropped)
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	if t.exporter == nil {
+		return
+	}
+	data.Service = t.service
+	t.RLock()
+	defer t.RUnlock()
+	if t.closed {
+		atomic.AddInt64(&t.dropped, 1)
+		return
+	}
+	select {
+	case t.spans <- data:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, batchSize)
+	for {
+		select {
+		case data, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case flushed := <-t.flush:
+			// export what has been queued so far.
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+				if len(batch) >= batchSize {
+					batch = t.export(batch)
+				}
+			}
+			batch = t.export(batch)
+			close(flushed)
+		}
+	}
+}
+
+// export passes the batch to the exporter, and returns it emptied.
+func (t *Tracer) export(batch []SpanData) []SpanData {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := t.exporter.Export(ctx, batch); err != nil {
+		atomic.AddInt64(&t.dropped, int64(len(batch)))
+		log.Errorf("failed to export %d spans. %s", len(batch), err)
+	} else {
+		atomic.AddInt64(&t.exported, int64(len(batch)))
+	}
+	return batch[:0]
+}
+
+// Flush exports the spans that have ended so far, and waits until they
+// have been exported or ctx is done.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the remaining spans and shuts down the exporter. Spans
+// that end after Shutdown has been called are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.spans)
+	t.Unlock()
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
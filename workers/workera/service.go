@@ -2,97 +2,173 @@ package workera
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/woodsaj/go-server/cfg"
 	"github.com/woodsaj/go-server/components"
 	"github.com/woodsaj/go-server/registry"
+	"gopkg.in/macaron.v1"
 )
 
 type WorkerA struct {
 	Cfg         *cfg.Cfg                        `inject:""`
 	WorkerPool  *components.WorkerPool          `inject:""`
 	PController *components.ProcessorController `inject:""`
-
-	reload chan struct{}
+	Scheduler   *components.Scheduler           `inject:""`
+	Log         *log.Entry                      `inject:""`
 }
 
 func init() {
-	registry.RegisterService(&WorkerA{}, 9)
+	registry.Register(&registry.Descriptor{
+		Name:          "WorkerA",
+		Instance:      &WorkerA{},
+		InitPriority:  9,
+		RestartPolicy: registry.RestartPolicy{Mode: registry.RestartOnFailure},
+	})
+
+	cfg.RegisterSection("worker-a", &Config{})
+	cfg.RegisterAlias("worker-a.interval", "worker-a.schedule")
+}
+
+// Config holds the worker-a settings.
+type Config struct {
+	// starts or stops the service when changed at runtime.
+	Enabled bool `cfg:"enabled"`
 
 	// startup settings
-	cfg.SetDefault("worker-a.enabled", false)
+	Concurrency  int           `cfg:"concurrency,static" default:"1" validate:"min=1"`
+	QueueSize    int           `cfg:"queue-size,static" default:"10" validate:"min=0"`
+	Backpressure string        `cfg:"backpressure,static" default:"block" validate:"oneof=block drop reject"`
+	JobTimeout   time.Duration `cfg:"job-timeout,static" default:"10s" validate:"min=0s"`
+	Retry        struct {
+		MaxAttempts    int           `cfg:"max-attempts,static" default:"3" validate:"min=0"`
+		InitialBackoff time.Duration `cfg:"initial-backoff,static" default:"1s" validate:"min=0s"`
+		MaxBackoff     time.Duration `cfg:"max-backoff,static" default:"30s" validate:"min=0s"`
+		Jitter         float64       `cfg:"jitter,static" default:"0.2" validate:"min=0,max=1"`
+	} `cfg:"retry"`
 
 	// runtime settings
-	cfg.SetDefault("worker-a.data", "workerA")
-	cfg.SetDefault("worker-a.interval", time.Second*2)
+	Data string `cfg:"data" default:"workerA"`
+	// interval is a deprecated alias of schedule.
+	Schedule string        `cfg:"schedule" default:"2s" validate:"required"`
+	Timezone string        `cfg:"timezone" default:"UTC"`
+	Jitter   time.Duration `cfg:"jitter" validate:"min=0s"`
+	Overlap  string        `cfg:"overlap" default:"skip" validate:"oneof=skip queue"`
+	// name of the processor to use. Takes precedence over processor-capability.
+	Processor string `cfg:"processor"`
+	// capability the processor must have. If neither is set the default processor is used.
+	ProcessorCapability string `cfg:"processor-capability"`
 }
 
-func (s *WorkerA) Init() error {
-	log.Debug("Initializing WorkerA svc")
-	if s.Cfg.GetDuration("worker-a.interval") == time.Duration(0) {
-		return fmt.Errorf("worker-a.interval must be > 0")
+func (c *Config) Validate() error {
+	var errs cfg.ValidationErrors
+	if _, err := components.ParseTaskSettings(c.Schedule, c.Timezone, c.Jitter, c.Overlap); err != nil {
+		errs = append(errs, err.(cfg.ValidationErrors)...)
+	}
+	if c.Retry.MaxBackoff < c.Retry.InitialBackoff {
+		errs = append(errs, &cfg.FieldError{Key: "retry.max-backoff", Message: "must be >= retry.initial-backoff"})
 	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// TaskSettings returns the settings of the scheduled task, which have
+// already been validated by Validate.
+func (c *Config) TaskSettings() components.TaskSettings {
+	settings, _ := components.ParseTaskSettings(c.Schedule, c.Timezone, c.Jitter, c.Overlap)
+	return settings
+}
+
+func (s *WorkerA) config() *Config {
+	return s.Cfg.Section("worker-a").(*Config)
+}
+
+func (s *WorkerA) Init() error {
+	s.Log.Debug("Initializing WorkerA svc")
+	conf := s.config()
+	// already validated by Config
+	backpressure, _ := components.ParseBackpressure(conf.Backpressure)
 
-	s.reload = make(chan struct{})
-	s.Cfg.OnChange(func() {
-		log.Info("workerA detected config change. Applying changes to runtime settings.")
-		s.reload <- struct{}{}
+	s.PController.OnSwitch(func(e components.SwitchEvent) {
+		// jobs acquire their processor when they run, so only log the change.
+		if conf := s.config(); conf.Processor == "" && conf.ProcessorCapability == "" {
+			s.Log.Infof("WorkerA switched from processor %s to %s", e.Old, e.New)
+		}
+	})
+	return s.WorkerPool.Register("worker-a", s, components.QueueOptions{
+		Concurrency:  conf.Concurrency,
+		QueueSize:    conf.QueueSize,
+		Backpressure: backpressure,
+		Timeout:      conf.JobTimeout,
+		Retry: components.RetryPolicy{
+			MaxAttempts:    conf.Retry.MaxAttempts,
+			InitialBackoff: conf.Retry.InitialBackoff,
+			MaxBackoff:     conf.Retry.MaxBackoff,
+			Jitter:         conf.Retry.Jitter,
+		},
 	})
-	s.WorkerPool.Register(s)
-	return nil
 }
 
 func (s *WorkerA) IsDisabled() bool {
-	return !s.Cfg.GetBool("worker-a.enabled")
+	return !s.config().Enabled
 }
 
-func (s *WorkerA) DoWork() {
-	fmt.Println(s.Cfg.GetString("worker-a.data"))
+func (s *WorkerA) DoWork(ctx context.Context, job *components.Job) error {
+	p, release, err := s.PController.Acquire("worker-a")
+	if err != nil {
+		return err
+	}
+	defer release()
+	s.Log.Infof("WorkerA: %s %s %v", s.config().Data, p.Data(ctx), job.Payload)
+	return nil
 }
 
 func (s *WorkerA) Status() string {
 	return "workerA running"
 }
 
+func (s *WorkerA) RegisterRoutes(r *components.RouteGroup) {
+	g := r.Group("/workers/a")
+	g.Get("", s.getStatus).Name("status")
+	g.Get("/data", s.getData).Name("data")
+}
+
+func (s *WorkerA) getStatus(ctx *macaron.Context) {
+	ctx.PlainText(200, []byte(s.Status()))
+}
+
+func (s *WorkerA) getData(ctx *macaron.Context) {
+	ctx.PlainText(200, []byte(s.config().Data))
+}
+
 func (s *WorkerA) Run(ctx context.Context) error {
 	done := ctx.Done()
 	// wait for our Processor to be ready
-	p := s.PController.Get()
-	log.Info("WorkerA waiting for processor to be ready.")
-	select {
-	case <-done:
-		log.Info("WorkerA shutting down")
-		return nil
-	case <-p.Ready():
-		log.Info("processor ready, starting up WorkerA")
+	s.Log.Info("WorkerA waiting for processor to be ready.")
+	if _, err := s.PController.WaitReady(ctx, "worker-a"); err != nil {
+		if ctx.Err() != nil {
+			s.Log.Info("WorkerA shutting down")
+			return nil
+		}
+		return err
 	}
+	s.Log.Info("processor ready, starting up WorkerA")
 
-	interval := s.Cfg.GetDuration("worker-a.interval")
-	ticker := time.NewTicker(interval)
-
-	for {
-		select {
-		case t := <-ticker.C:
-			log.Infof("WorkerA: %s", t.String())
-		case <-done:
-			log.Info("WorkerA shutting down")
-			return nil
-		case <-s.reload:
-			// config reloaded.  Adjust or ticker interval if it has changed.
-			newInterval := s.Cfg.GetDuration("worker-a.interval")
-			if newInterval == 0 {
-				log.Errorf("worker-a.interval has been updated to invalid value. %s", newInterval.String())
-				continue
-			}
-			if interval != newInterval && newInterval != 0 {
-				interval = newInterval
-				ticker.Stop()
-				ticker = time.NewTicker(interval)
-			}
+	err := s.Scheduler.Add(ctx, "WorkerA", "worker-a", func(ctx context.Context, t time.Time) error {
+		h, err := s.WorkerPool.Submit(ctx, &components.Job{Worker: "worker-a", Payload: t})
+		if err != nil {
+			return err
 		}
+		return h.Wait(ctx)
+	})
+	if err != nil {
+		return err
 	}
+
+	<-done
+	s.Log.Info("WorkerA shutting down")
 	return nil
 }
@@ -2,7 +2,6 @@ package workerb
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,46 +14,116 @@ type WorkerB struct {
 	Cfg         *cfg.Cfg                        `inject:""`
 	WorkerPool  *components.WorkerPool          `inject:""`
 	PController *components.ProcessorController `inject:""`
-
-	reload chan struct{}
+	Scheduler   *components.Scheduler           `inject:""`
+	Log         *log.Entry                      `inject:""`
 }
 
 func init() {
-	registry.RegisterService(&WorkerB{}, 9)
+	registry.Register(&registry.Descriptor{
+		Name:          "WorkerB",
+		Instance:      &WorkerB{},
+		InitPriority:  9,
+		RestartPolicy: registry.RestartPolicy{Mode: registry.RestartOnFailure},
+	})
+
+	cfg.RegisterSection("worker-b", &Config{})
+	cfg.RegisterAlias("worker-b.interval", "worker-b.schedule")
+}
+
+// Config holds the worker-b settings.
+type Config struct {
+	// starts or stops the service when changed at runtime.
+	Enabled bool `cfg:"enabled"`
 
 	// startup settings
-	cfg.SetDefault("worker-b.enabled", false)
+	Concurrency  int           `cfg:"concurrency,static" default:"1" validate:"min=1"`
+	QueueSize    int           `cfg:"queue-size,static" default:"10" validate:"min=0"`
+	Backpressure string        `cfg:"backpressure,static" default:"block" validate:"oneof=block drop reject"`
+	JobTimeout   time.Duration `cfg:"job-timeout,static" default:"10s" validate:"min=0s"`
+	Retry        struct {
+		MaxAttempts    int           `cfg:"max-attempts,static" default:"3" validate:"min=0"`
+		InitialBackoff time.Duration `cfg:"initial-backoff,static" default:"1s" validate:"min=0s"`
+		MaxBackoff     time.Duration `cfg:"max-backoff,static" default:"30s" validate:"min=0s"`
+		Jitter         float64       `cfg:"jitter,static" default:"0.2" validate:"min=0,max=1"`
+	} `cfg:"retry"`
 
 	// runtime settings
-	cfg.SetDefault("worker-b.data", "workerA")
-	cfg.SetDefault("worker-b.interval", time.Second*1)
+	Data string `cfg:"data" default:"workerA"`
+	// interval is a deprecated alias of schedule.
+	Schedule string        `cfg:"schedule" default:"1s" validate:"required"`
+	Timezone string        `cfg:"timezone" default:"UTC"`
+	Jitter   time.Duration `cfg:"jitter" validate:"min=0s"`
+	Overlap  string        `cfg:"overlap" default:"skip" validate:"oneof=skip queue"`
+	// name of the processor to use. Takes precedence over processor-capability.
+	Processor string `cfg:"processor"`
+	// capability the processor must have. If neither is set the default processor is used.
+	ProcessorCapability string `cfg:"processor-capability"`
 }
 
-func (s *WorkerB) Init() error {
-	log.Debug("Initializing WorkerB svc")
+func (c *Config) Validate() error {
+	var errs cfg.ValidationErrors
+	if _, err := components.ParseTaskSettings(c.Schedule, c.Timezone, c.Jitter, c.Overlap); err != nil {
+		errs = append(errs, err.(cfg.ValidationErrors)...)
+	}
+	if c.Retry.MaxBackoff < c.Retry.InitialBackoff {
+		errs = append(errs, &cfg.FieldError{Key: "retry.max-backoff", Message: "must be >= retry.initial-backoff"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
 
-	// validate config
+// TaskSettings returns the settings of the scheduled task, which have
+// already been validated by Validate.
+func (c *Config) TaskSettings() components.TaskSettings {
+	settings, _ := components.ParseTaskSettings(c.Schedule, c.Timezone, c.Jitter, c.Overlap)
+	return settings
+}
 
-	if s.Cfg.GetDuration("worker-b.interval") == time.Duration(0) {
-		return fmt.Errorf("worker-b.interval must be > 0")
-	}
+func (s *WorkerB) config() *Config {
+	return s.Cfg.Section("worker-b").(*Config)
+}
 
-	s.reload = make(chan struct{})
-	s.Cfg.OnChange(func() {
-		log.Info("workerB detected config change. Applying changes to runtime settings.")
-		s.reload <- struct{}{}
-	})
+func (s *WorkerB) Init() error {
+	s.Log.Debug("Initializing WorkerB svc")
 
-	s.WorkerPool.Register(s)
-	return nil
+	conf := s.config()
+	// already validated by Config
+	backpressure, _ := components.ParseBackpressure(conf.Backpressure)
+
+	s.PController.OnSwitch(func(e components.SwitchEvent) {
+		// jobs acquire their processor when they run, so only log the change.
+		if conf := s.config(); conf.Processor == "" && conf.ProcessorCapability == "" {
+			s.Log.Infof("WorkerB switched from processor %s to %s", e.Old, e.New)
+		}
+	})
+	return s.WorkerPool.Register("worker-b", s, components.QueueOptions{
+		Concurrency:  conf.Concurrency,
+		QueueSize:    conf.QueueSize,
+		Backpressure: backpressure,
+		Timeout:      conf.JobTimeout,
+		Retry: components.RetryPolicy{
+			MaxAttempts:    conf.Retry.MaxAttempts,
+			InitialBackoff: conf.Retry.InitialBackoff,
+			MaxBackoff:     conf.Retry.MaxBackoff,
+			Jitter:         conf.Retry.Jitter,
+		},
+	})
 }
 
 func (s *WorkerB) IsDisabled() bool {
-	return !s.Cfg.GetBool("worker-b.enabled")
+	return !s.config().Enabled
 }
 
-func (s *WorkerB) DoWork() {
-	fmt.Println(s.Cfg.GetString("worker-b.data"))
+func (s *WorkerB) DoWork(ctx context.Context, job *components.Job) error {
+	p, release, err := s.PController.Acquire("worker-b")
+	if err != nil {
+		return err
+	}
+	defer release()
+	s.Log.Infof("WorkerB: %s %s %v", s.config().Data, p.Data(ctx), job.Payload)
+	return nil
 }
 
 func (s *WorkerB) Status() string {
@@ -64,40 +133,28 @@ func (s *WorkerB) Status() string {
 func (s *WorkerB) Run(ctx context.Context) error {
 	done := ctx.Done()
 	// wait for our Processor to be ready
-	p := s.PController.Get()
-	log.Info("WorkerB waiting for processor to be ready.")
-	select {
-	case <-done:
-		log.Info("WorkerB shutting down")
-		return nil
-	case <-p.Ready():
-		log.Info("processor ready, starting up WorkerB")
-	}
-
-	interval := s.Cfg.GetDuration("worker-b.interval")
-	ticker := time.NewTicker(interval)
-
-	for {
-		select {
-		case t := <-ticker.C:
-			log.Infof("WorkerB: %s", t.String())
-		case <-done:
-			log.Info("WorkerB shutting down")
+	s.Log.Info("WorkerB waiting for processor to be ready.")
+	if _, err := s.PController.WaitReady(ctx, "worker-b"); err != nil {
+		if ctx.Err() != nil {
+			s.Log.Info("WorkerB shutting down")
 			return nil
-		case <-s.reload:
-			// config reloaded.  Adjust or ticker interval if it has changed.
-			newInterval := s.Cfg.GetDuration("worker-b.interval")
-			if newInterval == 0 {
-				log.Errorf("worker-b.interval has been updated to invalid value. %s", newInterval.String())
-				continue
-			}
-			if interval != newInterval && newInterval != 0 {
-				interval = newInterval
-				ticker.Stop()
-				ticker = time.NewTicker(interval)
-			}
+		}
+		return err
+	}
+	s.Log.Info("processor ready, starting up WorkerB")
 
+	err := s.Scheduler.Add(ctx, "WorkerB", "worker-b", func(ctx context.Context, t time.Time) error {
+		h, err := s.WorkerPool.Submit(ctx, &components.Job{Worker: "worker-b", Payload: t})
+		if err != nil {
+			return err
 		}
+		return h.Wait(ctx)
+	})
+	if err != nil {
+		return err
 	}
+
+	<-done
+	s.Log.Info("WorkerB shutting down")
 	return nil
 }